@@ -0,0 +1,29 @@
+package dnslink
+
+// ResolveAliases resolves several names that publish the same dnslink and
+// merges their results with MergeResults. Every name that could be resolved
+// is noted with an ALIAS log statement, the others with ALIAS_ERROR. An error
+// is only returned if none of the names could be resolved.
+func (r *Resolver) ResolveAliases(names []string) (Result, error) {
+	results := []Result{}
+	log := []LogStatement{}
+	var firstErr error
+	for _, name := range names {
+		result, err := r.Resolve(name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			log = append(log, LogStatement{Code: "ALIAS_ERROR", Entry: name, Reason: err.Error()})
+			continue
+		}
+		results = append(results, result)
+		log = append(log, LogStatement{Code: "ALIAS", Entry: name})
+	}
+	if len(results) == 0 && firstErr != nil {
+		return Result{}, firstErr
+	}
+	merged := MergeResults(results...)
+	merged.Log = append(merged.Log, log...)
+	return merged, nil
+}
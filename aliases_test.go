@@ -0,0 +1,48 @@
+package dnslink
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestResolveAliases(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"dnslink=/ipfs/same", "dnslink=/ipns/only-a"},
+		"_dnslink.b.com": {"dnslink=/ipfs/same"},
+		"_dnslink.c.com": {"dnslink=/ipfs/other"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+
+	result, err := r.ResolveAliases([]string{"a.com", "b.com"})
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "same", Ttl: 100, Source: SourcePrefixed}},
+		"ipns": {{Identifier: "only-a", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "ALIAS", Entry: "a.com"},
+		{Code: "ALIAS", Entry: "b.com"},
+	})
+
+	result, err = r.ResolveAliases([]string{"b.com", "c.com", "missing.com"})
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {
+			{Identifier: "other", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "same", Ttl: 100, Source: SourcePrefixed},
+		},
+	})
+	assertDeepEqual(t, result.TxtEntries, []TxtEntry{
+		{Value: "/ipfs/other", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/same", Ttl: 100, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "ALIAS", Entry: "b.com"},
+		{Code: "ALIAS", Entry: "c.com"},
+		{Code: "ALIAS_ERROR", Entry: "missing.com", Reason: NewDNSRCodeError(3, "No TXT entry for missing.com").Error()},
+	})
+
+	_, err = r.ResolveAliases([]string{"missing.com", "gone.com"})
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "No TXT entry for missing.com"))
+}
@@ -0,0 +1,115 @@
+package dnslink
+
+import (
+	"context"
+	"strings"
+)
+
+// AuditLookup describes the TXT lookup of one of the names that are checked
+// in an audit.
+type AuditLookup struct {
+	Name string `json:"name"`
+	// Exists is false if the name doesn't exist (NXDOMAIN).
+	Exists bool `json:"exists"`
+	// Error holds the error of the lookup, other than NXDOMAIN.
+	Error string `json:"error,omitempty"`
+	// Entries holds the dnslink= TXT values of the name.
+	Entries []string `json:"entries"`
+}
+
+// AuditReport is a health report about the dnslink setup of a domain.
+type AuditReport struct {
+	Domain   string      `json:"domain"`
+	Prefixed AuditLookup `json:"prefixed"`
+	Bare     AuditLookup `json:"bare"`
+	// Conflict is set if both, the prefixed and the bare name, have dnslink
+	// entries that point to different links.
+	Conflict        bool           `json:"conflict"`
+	Invalid         []LogStatement `json:"invalid"`
+	Duplicates      []string       `json:"duplicates"`
+	LongEntries     []string       `json:"longEntries"`
+	Recommendations []string       `json:"recommendations"`
+}
+
+// Healthy is true if the audit found nothing to recommend.
+func (report *AuditReport) Healthy() bool {
+	return len(report.Recommendations) == 0
+}
+
+// Audit looks up both, the _dnslink. prefixed and the bare domain, and
+// reports on problems with the published dnslink entries.
+func (r *Resolver) Audit(domain string) (report AuditReport, err error) {
+	domain = r.normalize(domain)
+	if err = testFqnd(domain); err != nil {
+		return
+	}
+	lookupTXT := r.lookupTXT()
+	report.Domain = domain
+	report.Invalid = []LogStatement{}
+	report.Duplicates = []string{}
+	report.LongEntries = []string{}
+	report.Recommendations = []string{}
+	prefixed, prefixedLinks := auditLookup(lookupTXT, dnsPrefix+domain, &report)
+	bare, bareLinks := auditLookup(lookupTXT, domain, &report)
+	report.Prefixed = prefixed
+	report.Bare = bare
+
+	if len(prefixed.Entries) > 0 && len(bare.Entries) > 0 {
+		diff := DiffResults(Result{Links: prefixedLinks}, Result{Links: bareLinks})
+		report.Conflict = diff.Changed()
+	}
+	if prefixed.Error != "" || bare.Error != "" {
+		report.Recommendations = append(report.Recommendations, "Not all names could be looked up, the report may be incomplete.")
+	}
+	if len(prefixed.Entries) == 0 && len(bare.Entries) == 0 {
+		report.Recommendations = append(report.Recommendations, "No dnslink entries found, publish them as TXT records at "+dnsPrefix+domain+".")
+	} else if len(prefixed.Entries) == 0 {
+		report.Recommendations = append(report.Recommendations, "Move the dnslink entries from "+domain+" to "+dnsPrefix+domain+".")
+	} else if report.Conflict {
+		report.Recommendations = append(report.Recommendations, "The entries at "+domain+" differ from the ones at "+dnsPrefix+domain+" and are ignored, consider removing them.")
+	}
+	if len(report.Invalid) > 0 {
+		report.Recommendations = append(report.Recommendations, "Fix or remove the invalid dnslink entries.")
+	}
+	if len(report.Duplicates) > 0 {
+		report.Recommendations = append(report.Recommendations, "Remove the duplicate dnslink entries.")
+	}
+	if len(report.LongEntries) > 0 {
+		report.Recommendations = append(report.Recommendations, "Check the unusually long dnslink entries.")
+	}
+	return
+}
+
+func auditLookup(lookupTXT LookupTXTContextFunc, name string, report *AuditReport) (AuditLookup, map[string]NamespaceEntries) {
+	lookup := AuditLookup{
+		Name:    name,
+		Exists:  true,
+		Entries: []string{},
+	}
+	input, err := lookupTXT(context.Background(), name)
+	if err != nil {
+		if IsNXDomain(err) {
+			lookup.Exists = false
+		} else {
+			lookup.Error = err.Error()
+		}
+		return lookup, map[string]NamespaceEntries{}
+	}
+	seen := map[string]bool{}
+	for _, entry := range input {
+		if !strings.HasPrefix(entry.Value, txtPrefix) {
+			continue
+		}
+		lookup.Entries = append(lookup.Entries, entry.Value)
+		if seen[entry.Value] {
+			report.Duplicates = append(report.Duplicates, entry.Value)
+		}
+		seen[entry.Value] = true
+		if len(entry.Value) > longEntryLength {
+			report.LongEntries = append(report.LongEntries, entry.Value)
+		}
+	}
+	links, _, log, _ := processEntries(input)
+	report.Invalid = append(report.Invalid, log...)
+	return lookup, links
+}
@@ -0,0 +1,62 @@
+package dnslink
+
+import (
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestAuditHealthy(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.foo.com": {"dnslink=/ipfs/a", "other=value"},
+	}}
+	report, err := (&Resolver{LookupTXT: mock.lookupTXT}).Audit("foo.com")
+	assert.NoError(t, err)
+	assert.True(t, report.Healthy())
+	assertDeepEqual(t, report, AuditReport{
+		Domain:          "foo.com",
+		Prefixed:        AuditLookup{Name: "_dnslink.foo.com", Exists: true, Entries: []string{"dnslink=/ipfs/a"}},
+		Bare:            AuditLookup{Name: "foo.com", Exists: false, Entries: []string{}},
+		Invalid:         []LogStatement{},
+		Duplicates:      []string{},
+		LongEntries:     []string{},
+		Recommendations: []string{},
+	})
+}
+
+func TestAuditMisconfigured(t *testing.T) {
+	long := "dnslink=/ipfs/" + strings.Repeat("a", longEntryLength)
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.foo.com": {"dnslink=/ipfs/a", "dnslink=/ipfs/a", "dnslink=ipfs", long},
+		"foo.com":          {"dnslink=/ipfs/b"},
+	}}
+	report, err := (&Resolver{LookupTXT: mock.lookupTXT}).Audit("foo.com")
+	assert.NoError(t, err)
+	assert.False(t, report.Healthy())
+	assert.True(t, report.Conflict)
+	assertDeepEqual(t, report.Invalid, []LogStatement{
+		{Code: "INVALID_ENTRY", Entry: "dnslink=ipfs", Reason: "WRONG_START"},
+	})
+	assertDeepEqual(t, report.Duplicates, []string{"dnslink=/ipfs/a"})
+	assertDeepEqual(t, report.LongEntries, []string{long})
+	assert.Len(t, report.Recommendations, 4)
+}
+
+func TestAuditBareOnly(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"foo.com": {"dnslink=/ipfs/b"},
+	}}
+	report, err := (&Resolver{LookupTXT: mock.lookupTXT}).Audit("foo.com")
+	assert.NoError(t, err)
+	assert.False(t, report.Prefixed.Exists)
+	assert.False(t, report.Conflict)
+	assertDeepEqual(t, report.Recommendations, []string{"Move the dnslink entries from foo.com to _dnslink.foo.com."})
+
+	report, err = (&Resolver{LookupTXT: mock.lookupTXT}).Audit("bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, report.Recommendations, []string{"No dnslink entries found, publish them as TXT records at _dnslink.bar.com."})
+
+	_, err = (&Resolver{LookupTXT: mock.lookupTXT}).Audit("bar..com")
+	assert.EqualError(t, err, "EMPTY_PART")
+}
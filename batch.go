@@ -0,0 +1,192 @@
+package dnslink
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// ResolveAllContext resolves the given domains using up to concurrency
+// parallel lookups. Cancelling ctx stops the whole batch: domains that were
+// not resolved yet receive ctx.Err() as error. Every domain additionally
+// gets its own deadline derived from ctx if Resolver.DomainTimeout is set.
+//
+// Queries are only aborted with the lookup if it is context-aware (see
+// Resolver.LookupTXTContext and NewUDPLookupContext). A plain
+// Resolver.LookupTXT can not be cancelled: the domain is reported as failed,
+// but its query keeps running until it finishes. The default system lookup
+// is bounded by deadlines, after a cancellation its query runs into the
+// timeout of the system resolver.
+func (r *Resolver) ResolveAllContext(ctx context.Context, domains []string, concurrency int) (map[string]Result, map[string]error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := map[string]Result{}
+	errs := map[string]error{}
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for _, domain := range domains {
+		select {
+		case <-ctx.Done():
+		case slots <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			mutex.Lock()
+			errs[domain] = ctx.Err()
+			mutex.Unlock()
+			continue
+		}
+		wait.Add(1)
+		go func(domain string) {
+			defer func() {
+				<-slots
+				wait.Done()
+			}()
+			result, err := r.resolveWithDeadline(ctx, domain)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs[domain] = err
+			} else {
+				results[domain] = result
+			}
+		}(domain)
+	}
+	wait.Wait()
+	return results, errs
+}
+
+// ResultOrError holds the outcome of the resolution of a single domain.
+type ResultOrError struct {
+	Result Result
+	Err    error
+}
+
+// ResolveMany works like ResolveAllContext, but returns the result or error
+// of every domain in a single map.
+func (r *Resolver) ResolveMany(ctx context.Context, domains []string, concurrency int) map[string]ResultOrError {
+	results, errs := r.ResolveAllContext(ctx, domains, concurrency)
+	outcomes := make(map[string]ResultOrError, len(domains))
+	for domain, result := range results {
+		outcomes[domain] = ResultOrError{Result: result}
+	}
+	for domain, err := range errs {
+		outcomes[domain] = ResultOrError{Err: err}
+	}
+	return outcomes
+}
+
+// defaultSubdomainConcurrency is the number of parallel lookups of
+// ResolveSubdomains.
+const defaultSubdomainConcurrency = 8
+
+// ResolveSubdomains resolves the subdomains of the base domain in parallel,
+// e.g. "a" and "b.c" of "example.com" resolve a.example.com and
+// b.c.example.com. The results are keyed by the given subdomains, an empty
+// subdomain resolves the base domain itself. Every combined name is
+// validated on its own. If subdomains can't be resolved, the error of the
+// first of them is returned, together with the results of the others.
+func (r *Resolver) ResolveSubdomains(base string, subs []string) (map[string]Result, error) {
+	outcomes := r.ResolveSubdomainsContext(context.Background(), base, subs, defaultSubdomainConcurrency)
+	results := make(map[string]Result, len(subs))
+	var firstErr error
+	for _, sub := range subs {
+		outcome := outcomes[sub]
+		if outcome.Err != nil {
+			if firstErr == nil {
+				firstErr = outcome.Err
+			}
+			continue
+		}
+		results[sub] = outcome.Result
+	}
+	return results, firstErr
+}
+
+// ResolveSubdomainsContext works like ResolveSubdomains with the
+// cancellation and concurrency of ResolveMany, and returns the result or
+// error of every subdomain, so an invalid subdomain only fails its own
+// outcome.
+func (r *Resolver) ResolveSubdomainsContext(ctx context.Context, base string, subs []string, concurrency int) map[string]ResultOrError {
+	base = strings.TrimSuffix(base, ".")
+	domains := make([]string, len(subs))
+	for index, sub := range subs {
+		domains[index] = base
+		if sub != "" {
+			domains[index] = sub + "." + base
+		}
+	}
+	many := r.ResolveMany(ctx, domains, concurrency)
+	outcomes := make(map[string]ResultOrError, len(subs))
+	for index, sub := range subs {
+		outcomes[sub] = many[domains[index]]
+	}
+	return outcomes
+}
+
+// ResolveEvent is the outcome of the resolution of a domain of
+// ResolveStream.
+type ResolveEvent struct {
+	Domain string
+	Result Result
+	Err    error
+}
+
+// ResolveStream resolves the domains as they are received, using up to
+// concurrency parallel lookups, and sends an event for every domain in the
+// order the resolutions finish. The returned channel is closed once the
+// domains channel is closed and all of its domains are resolved, so it
+// needs to be read until then. Cancelling ctx stops taking domains, the
+// domains that are being resolved are still sent, usually with ctx.Err()
+// as error. Deadlines and cancellation work like in ResolveAllContext.
+func (r *Resolver) ResolveStream(ctx context.Context, domains <-chan string, concurrency int) <-chan ResolveEvent {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	events := make(chan ResolveEvent, concurrency)
+	go func() {
+		var wait sync.WaitGroup
+		defer func() {
+			wait.Wait()
+			close(events)
+		}()
+		slots := make(chan struct{}, concurrency)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+			}
+			var domain string
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case domain, ok = <-domains:
+			}
+			if !ok || ctx.Err() != nil {
+				return
+			}
+			wait.Add(1)
+			go func(domain string) {
+				defer func() {
+					<-slots
+					wait.Done()
+				}()
+				result, err := r.resolveWithDeadline(ctx, domain)
+				events <- ResolveEvent{Domain: domain, Result: result, Err: err}
+			}(domain)
+		}
+	}()
+	return events
+}
+
+func (r *Resolver) resolveWithDeadline(ctx context.Context, domain string) (Result, error) {
+	if r.DomainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.DomainTimeout)
+		defer cancel()
+	}
+	return resolveContext(ctx, r, domain)
+}
@@ -0,0 +1,213 @@
+package dnslink
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestResolveAllContext(t *testing.T) {
+	mock := newMockDNS()
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	results, errs := r.ResolveAllContext(context.Background(), []string{"foo.com", "bar.com", "hello..com"}, 2)
+	assert.Len(t, results, 2)
+	assert.Equal(t, results["foo.com"].Links["x"][0].Identifier, "a")
+	assert.Equal(t, results["bar.com"].Links["y"][0].Identifier, "b")
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs["hello..com"], "EMPTY_PART")
+}
+
+func TestResolveMany(t *testing.T) {
+	mock := newMockDNS()
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	outcomes := r.ResolveMany(context.Background(), []string{"foo.com", "bar.com", "hello..com", "missing.com"}, 3)
+	assert.Len(t, outcomes, 4)
+	assert.NoError(t, outcomes["foo.com"].Err)
+	assert.Equal(t, "a", outcomes["foo.com"].Result.Links["x"][0].Identifier)
+	assert.NoError(t, outcomes["bar.com"].Err)
+	assert.Equal(t, "b", outcomes["bar.com"].Result.Links["y"][0].Identifier)
+	assert.EqualError(t, outcomes["hello..com"].Err, "EMPTY_PART")
+	assert.Error(t, outcomes["missing.com"].Err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outcomes = r.ResolveMany(ctx, []string{"foo.com"}, 1)
+	assert.Equal(t, context.Canceled, outcomes["foo.com"].Err)
+}
+
+// blockingLookup only returns once the context of the lookup is done, the
+// returned WaitGroup is done once all started lookups returned.
+func blockingLookup() (LookupTXTContextFunc, *sync.WaitGroup) {
+	var running sync.WaitGroup
+	return func(ctx context.Context, domain string) ([]LookupEntry, error) {
+		running.Add(1)
+		defer running.Done()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, &running
+}
+
+func assertReturned(t *testing.T, running *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("lookups are still running")
+	}
+}
+
+func TestResolveAllContextCancel(t *testing.T) {
+	lookup, running := blockingLookup()
+	r := &Resolver{LookupTXTContext: lookup}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	results, errs := r.ResolveAllContext(ctx, []string{"a.com", "b.com", "c.com", "d.com"}, 1)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Len(t, results, 0)
+	assert.Len(t, errs, 4)
+	for _, err := range errs {
+		assert.Equal(t, err, context.Canceled)
+	}
+	assertReturned(t, running)
+}
+
+func TestResolveAllContextDomainTimeout(t *testing.T) {
+	lookup, running := blockingLookup()
+	r := &Resolver{LookupTXTContext: lookup, DomainTimeout: 10 * time.Millisecond}
+	results, errs := r.ResolveAllContext(context.Background(), []string{"a.com", "b.com"}, 2)
+	assert.Len(t, results, 0)
+	assert.Equal(t, errs["a.com"], context.DeadlineExceeded)
+	assert.Equal(t, errs["b.com"], context.DeadlineExceeded)
+	assertReturned(t, running)
+}
+
+func TestResolveAllContextLookupTXT(t *testing.T) {
+	release := make(chan struct{})
+	r := &Resolver{
+		LookupTXT: func(domain string) ([]LookupEntry, error) {
+			<-release
+			return []LookupEntry{{Value: "dnslink=/x/a", Ttl: 100}}, nil
+		},
+		DomainTimeout: 10 * time.Millisecond,
+	}
+	results, errs := r.ResolveAllContext(context.Background(), []string{"a.com"}, 1)
+	assert.Len(t, results, 0)
+	assert.Equal(t, errs["a.com"], context.DeadlineExceeded)
+	// The lookup can not be cancelled and is only released now.
+	close(release)
+}
+
+func TestResolveSubdomains(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.example.com":     {"dnslink=/ipfs/root"},
+		"_dnslink.a.example.com":   {"dnslink=/ipfs/a"},
+		"_dnslink.b.c.example.com": {"dnslink=/ipfs/b"},
+	}}
+	queried := make(chan string, 10)
+	r := &Resolver{LookupTXT: func(domain string) ([]LookupEntry, error) {
+		queried <- domain
+		return mock.lookupTXT(domain)
+	}}
+	outcomes := r.ResolveSubdomainsContext(context.Background(), "example.com.", []string{"a", "b.c", "", "x..y"}, 2)
+	assert.Len(t, outcomes, 4)
+	assert.NoError(t, outcomes["a"].Err)
+	assert.Equal(t, "a", outcomes["a"].Result.Links["ipfs"][0].Identifier)
+	assert.Equal(t, "b", outcomes["b.c"].Result.Links["ipfs"][0].Identifier)
+	assert.Equal(t, "root", outcomes[""].Result.Links["ipfs"][0].Identifier)
+	assert.EqualError(t, outcomes["x..y"].Err, "EMPTY_PART")
+	close(queried)
+	names := []string{}
+	for name := range queried {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{"_dnslink.a.example.com", "_dnslink.b.c.example.com", "_dnslink.example.com"}, names)
+
+	results, err := (&Resolver{LookupTXT: mock.lookupTXT}).ResolveSubdomains("example.com", []string{"a", "x..y", "b.c", "missing"})
+	assert.EqualError(t, err, "EMPTY_PART")
+	assert.Len(t, results, 2)
+	assert.Equal(t, "a", results["a"].Links["ipfs"][0].Identifier)
+	assert.Equal(t, "b", results["b.c"].Links["ipfs"][0].Identifier)
+
+	results, err = (&Resolver{LookupTXT: mock.lookupTXT}).ResolveSubdomains("example.com", []string{"", "a"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+}
+
+func TestResolveStream(t *testing.T) {
+	mock := newMockDNS()
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	r := &Resolver{LookupTXT: func(domain string) ([]LookupEntry, error) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return mock.lookupTXT(domain)
+	}}
+	domains := make(chan string)
+	go func() {
+		for _, domain := range []string{"foo.com", "bar.com", "hello..com", "foo.com", "bar.com"} {
+			domains <- domain
+		}
+		close(domains)
+	}()
+	events := map[string][]ResolveEvent{}
+	for event := range r.ResolveStream(context.Background(), domains, 2) {
+		events[event.Domain] = append(events[event.Domain], event)
+	}
+	assert.Len(t, events["foo.com"], 2)
+	assert.NoError(t, events["foo.com"][0].Err)
+	assert.Equal(t, "a", events["foo.com"][0].Result.Links["x"][0].Identifier)
+	assert.Len(t, events["bar.com"], 2)
+	assert.Equal(t, "b", events["bar.com"][1].Result.Links["y"][0].Identifier)
+	assert.Len(t, events["hello..com"], 1)
+	assert.EqualError(t, events["hello..com"][0].Err, "EMPTY_PART")
+	assert.LessOrEqual(t, maxRunning, 2)
+}
+
+func TestResolveStreamCancel(t *testing.T) {
+	lookup, running := blockingLookup()
+	r := &Resolver{LookupTXTContext: lookup}
+	ctx, cancel := context.WithCancel(context.Background())
+	// The domains channel is never closed.
+	domains := make(chan string, 4)
+	domains <- "a.com"
+	domains <- "b.com"
+	domains <- "c.com"
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	events := []ResolveEvent{}
+	for event := range r.ResolveStream(ctx, domains, 2) {
+		events = append(events, event)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, context.Canceled, event.Err)
+	}
+	assert.Len(t, domains, 1)
+	assertReturned(t, running)
+}
+
+func TestResolveContextSystemLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := resolveContext(ctx, &Resolver{}, "dnslink.dev")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Error(t, err)
+}
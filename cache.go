@@ -0,0 +1,169 @@
+package dnslink
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures a CachingResolver.
+type CacheOptions struct {
+	// TtlClamp caps how long a result is cached, however high its ttl is.
+	// Zero means no cap.
+	TtlClamp time.Duration
+	// MaxEntries evicts the least recently used results once more domains are
+	// cached. Zero means no limit.
+	MaxEntries int
+	// StaleWindow serves expired results for that long after their expiry,
+	// while they are resolved again in the background (stale while
+	// revalidate). A failed refresh keeps the stale result until the window
+	// ends. Zero resolves expired results right away.
+	StaleWindow time.Duration
+}
+
+// CachingResolver wraps a Resolver and keeps the results in memory until the
+// lowest ttl of their links expired. Errors, results without links and
+// results with a ttl of 0, like those of the system lookup, are not cached.
+//
+// A CachingResolver is safe for concurrent use. The cached results are shared
+// between callers and must not be modified.
+type CachingResolver struct {
+	resolver *Resolver
+	options  CacheOptions
+	now      func() time.Time
+	mutex    sync.Mutex
+	entries  map[string]*list.Element
+	// recent holds the *cacheEntry values, most recently used first.
+	recent *list.List
+}
+
+type cacheEntry struct {
+	key        string
+	result     Result
+	expires    time.Time
+	refreshing bool
+}
+
+func NewCachingResolver(resolver *Resolver, options CacheOptions) *CachingResolver {
+	return &CachingResolver{
+		resolver: resolver,
+		options:  options,
+		now:      time.Now,
+		entries:  map[string]*list.Element{},
+		recent:   list.New(),
+	}
+}
+
+func (c *CachingResolver) Resolve(domain string) (Result, error) {
+	return c.ResolveContext(context.Background(), domain)
+}
+
+// ResolveContext returns the cached result of the domain or resolves it with
+// the wrapped Resolver.
+func (c *CachingResolver) ResolveContext(ctx context.Context, domain string) (Result, error) {
+	// The domain is only normalized once, for the key and the resolution.
+	domain = c.resolver.normalize(domain)
+	key := strings.ToLower(domain)
+	c.mutex.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		now := c.now()
+		if now.Before(entry.expires) {
+			c.recent.MoveToFront(element)
+			c.mutex.Unlock()
+			return entry.result, nil
+		}
+		if now.Before(entry.expires.Add(c.options.StaleWindow)) {
+			c.recent.MoveToFront(element)
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key, domain)
+			}
+			c.mutex.Unlock()
+			return entry.result, nil
+		}
+		c.remove(element)
+	}
+	c.mutex.Unlock()
+	result, err := resolveNormalized(ctx, c.resolver, domain)
+	if err != nil {
+		return result, err
+	}
+	c.store(key, result)
+	return result, nil
+}
+
+// Purge removes the cached result of the domain.
+func (c *CachingResolver) Purge(domain string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[c.key(domain)]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *CachingResolver) key(domain string) string {
+	return strings.ToLower(c.resolver.normalize(domain))
+}
+
+// refresh resolves the normalized domain of a stale result again. A result that can be
+// cached replaces the stale one. Whatever the outcome, the stale result is
+// refreshed again by a later request.
+func (c *CachingResolver) refresh(key string, domain string) {
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if element, ok := c.entries[key]; ok {
+			element.Value.(*cacheEntry).refreshing = false
+		}
+	}()
+	result, err := resolveNormalized(context.Background(), c.resolver, domain)
+	if err == nil {
+		c.store(key, result)
+	}
+}
+
+func (c *CachingResolver) store(key string, result Result) {
+	ttl, ok := minTtl(result)
+	if !ok || ttl == 0 {
+		return
+	}
+	duration := time.Duration(ttl) * time.Second
+	if c.options.TtlClamp > 0 && duration > c.options.TtlClamp {
+		duration = c.options.TtlClamp
+	}
+	entry := &cacheEntry{key: key, result: result, expires: c.now().Add(duration)}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.recent.PushFront(entry)
+	if c.options.MaxEntries > 0 && c.recent.Len() > c.options.MaxEntries {
+		c.remove(c.recent.Back())
+	}
+}
+
+// remove drops the element from the cache, the mutex needs to be held.
+func (c *CachingResolver) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// minTtl returns the lowest ttl of the links of the result, false if it has
+// no links.
+func minTtl(result Result) (uint32, bool) {
+	found := false
+	var min uint32
+	for _, entries := range result.Links {
+		for _, entry := range entries {
+			if !found || entry.Ttl < min {
+				min = entry.Ttl
+				found = true
+			}
+		}
+	}
+	return min, found
+}
@@ -0,0 +1,206 @@
+package dnslink
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *testClock) get() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) advance(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// countingDNS answers every domain with an identifier that counts the
+// lookups of the domain.
+type countingDNS struct {
+	mutex   sync.Mutex
+	lookups map[string]int
+	ttl     uint32
+	fail    bool
+	looked  chan string
+}
+
+func (m *countingDNS) lookupTXT(name string) ([]LookupEntry, error) {
+	m.mutex.Lock()
+	m.lookups[name]++
+	count := m.lookups[name]
+	fail := m.fail
+	m.mutex.Unlock()
+	if m.looked != nil {
+		defer func() { m.looked <- name }()
+	}
+	if fail {
+		return nil, errors.New("failed")
+	}
+	return []LookupEntry{{Value: fmt.Sprintf("dnslink=/ipfs/%d", count), Ttl: m.ttl}}, nil
+}
+
+func (m *countingDNS) count(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lookups[name]
+}
+
+func newTestCache(mock *countingDNS, options CacheOptions) (*CachingResolver, *testClock) {
+	clock := &testClock{now: time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)}
+	cache := NewCachingResolver(&Resolver{LookupTXT: mock.lookupTXT}, options)
+	cache.now = clock.get
+	return cache, clock
+}
+
+func cachedIdentifier(t *testing.T, cache *CachingResolver, domain string) string {
+	result, err := cache.Resolve(domain)
+	assert.NoError(t, err)
+	if err != nil {
+		return ""
+	}
+	return result.Links["ipfs"][0].Identifier
+}
+
+func TestCachingResolver(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 100}
+	cache, clock := newTestCache(mock, CacheOptions{})
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	clock.advance(99 * time.Second)
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "_dnslink.Foo.com."))
+	assert.Equal(t, 1, mock.count("_dnslink.foo.com"))
+	clock.advance(time.Second)
+	assert.Equal(t, "2", cachedIdentifier(t, cache, "foo.com"))
+
+	cache.Purge("FOO.com")
+	assert.Equal(t, "3", cachedIdentifier(t, cache, "foo.com"))
+
+	mock.ttl = 0
+	cache.Purge("foo.com")
+	assert.Equal(t, "4", cachedIdentifier(t, cache, "foo.com"))
+	assert.Equal(t, "5", cachedIdentifier(t, cache, "foo.com"))
+
+	mock.ttl = 100
+	mock.fail = true
+	_, err := cache.Resolve("bar.com")
+	assert.Error(t, err)
+	_, err = cache.Resolve("bar.com")
+	assert.Error(t, err)
+	assert.Equal(t, 2, mock.count("_dnslink.bar.com"))
+}
+
+func TestCachingResolverTtlClamp(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 3600}
+	cache, clock := newTestCache(mock, CacheOptions{TtlClamp: 10 * time.Second})
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	clock.advance(9 * time.Second)
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	clock.advance(time.Second)
+	assert.Equal(t, "2", cachedIdentifier(t, cache, "foo.com"))
+}
+
+func TestCachingResolverMaxEntries(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 100}
+	cache, _ := newTestCache(mock, CacheOptions{MaxEntries: 2})
+	for _, domain := range []string{"a.com", "b.com", "a.com", "c.com", "a.com", "b.com"} {
+		_, err := cache.Resolve(domain)
+		assert.NoError(t, err)
+	}
+	// b.com was the least recently used domain when c.com was added.
+	assert.Equal(t, 1, mock.count("_dnslink.a.com"))
+	assert.Equal(t, 2, mock.count("_dnslink.b.com"))
+	assert.Equal(t, 1, mock.count("_dnslink.c.com"))
+	assert.Equal(t, 2, cache.recent.Len())
+}
+
+func TestCachingResolverStaleWhileRevalidate(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 100, looked: make(chan string, 10)}
+	cache, clock := newTestCache(mock, CacheOptions{StaleWindow: time.Minute})
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	<-mock.looked
+
+	// The stale result is served while it is refreshed in the background.
+	clock.advance(130 * time.Second)
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	assert.Equal(t, "_dnslink.foo.com", <-mock.looked)
+	assert.Eventually(t, func() bool {
+		result, err := cache.Resolve("foo.com")
+		return err == nil && result.Links["ipfs"][0].Identifier == "2"
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, mock.count("_dnslink.foo.com"))
+
+	// A failed refresh keeps the stale result until the window ends.
+	mock.mutex.Lock()
+	mock.fail = true
+	mock.mutex.Unlock()
+	clock.advance(130 * time.Second)
+	assert.Equal(t, "2", cachedIdentifier(t, cache, "foo.com"))
+	<-mock.looked
+	assert.Eventually(t, func() bool {
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		return !cache.entries["foo.com"].Value.(*cacheEntry).refreshing
+	}, time.Second, time.Millisecond)
+	clock.advance(time.Minute)
+	_, err := cache.Resolve("foo.com")
+	assert.Error(t, err)
+}
+
+func TestCachingResolverStaleUncacheableRefresh(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 100, looked: make(chan string, 10)}
+	cache, clock := newTestCache(mock, CacheOptions{StaleWindow: time.Minute})
+	assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+	<-mock.looked
+
+	// A refresh with a ttl of 0 can't be cached, the stale result stays and
+	// is refreshed again by the next request.
+	mock.mutex.Lock()
+	mock.ttl = 0
+	mock.mutex.Unlock()
+	clock.advance(130 * time.Second)
+	for round := 2; round <= 3; round++ {
+		assert.Equal(t, "1", cachedIdentifier(t, cache, "foo.com"))
+		assert.Eventually(t, func() bool {
+			cache.mutex.Lock()
+			defer cache.mutex.Unlock()
+			return !cache.entries["foo.com"].Value.(*cacheEntry).refreshing
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, round, mock.count("_dnslink.foo.com"))
+	}
+}
+
+func TestCachingResolverConcurrent(t *testing.T) {
+	mock := &countingDNS{lookups: map[string]int{}, ttl: 100}
+	cache, clock := newTestCache(mock, CacheOptions{MaxEntries: 3, StaleWindow: time.Second})
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			domain := fmt.Sprintf("%d.com", i%5)
+			_, err := cache.Resolve(domain)
+			assert.NoError(t, err)
+			if i%7 == 0 {
+				cache.Purge(domain)
+				clock.advance(50 * time.Second)
+			}
+		}(i)
+	}
+	wait.Wait()
+	// Refreshes may still be running in the background.
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	assert.LessOrEqual(t, cache.recent.Len(), 3)
+}
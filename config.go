@@ -0,0 +1,180 @@
+package dnslink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+// resolverConfig lists the options of a Resolver that are safe to share.
+// Options are added here explicitly, so that credentials of future options
+// don't end up in a dump by accident.
+type resolverConfig struct {
+	// Lookup is "system", "custom" for a LookupTXT or "custom-context" for a
+	// LookupTXTContext function.
+	Lookup                    string  `json:"lookup"`
+	DomainTimeout             string  `json:"domainTimeout"`
+	FallbackOnServFail        bool    `json:"fallbackOnServFail"`
+	FallbackOnNoData          bool    `json:"fallbackOnNoData"`
+	Diagnostics               bool    `json:"diagnostics"`
+	MaxIdentifierLength       int     `json:"maxIdentifierLength"`
+	NormalizeDomain           bool    `json:"normalizeDomain"`
+	FollowIndex               bool    `json:"followIndex"`
+	FastParse                 bool    `json:"fastParse"`
+	ComputeRegistrable        bool    `json:"computeRegistrable"`
+	MaxInvalidRatio           float64 `json:"maxInvalidRatio"`
+	TraceDecoding             bool    `json:"traceDecoding"`
+	CaseInsensitiveNamespaces bool    `json:"caseInsensitiveNamespaces"`
+	StripComments             bool    `json:"stripComments"`
+	WarnNoPrefix              bool    `json:"warnNoPrefix"`
+	RequirePrefix             bool    `json:"requirePrefix"`
+	Provenance                bool    `json:"provenance"`
+	FollowRedirects           bool    `json:"followRedirects"`
+	MaxDepth                  int     `json:"maxDepth"`
+	LookupMode                string  `json:"lookupMode"`
+	KeepDuplicateEntries      bool    `json:"keepDuplicateEntries"`
+	OnQuery                   bool    `json:"onQuery"`
+}
+
+// ConfigJSON renders the effective configuration of the resolver, for
+// example to attach it to a bug report. Functions are only reported as set
+// or not, as their configuration can't be inspected.
+func (r *Resolver) ConfigJSON() ([]byte, error) {
+	config := resolverConfig{
+		Lookup:                    "system",
+		DomainTimeout:             r.DomainTimeout.String(),
+		FallbackOnServFail:        r.FallbackOnServFail,
+		FallbackOnNoData:          r.FallbackOnNoData,
+		Diagnostics:               r.Diagnostics,
+		MaxIdentifierLength:       r.MaxIdentifierLength,
+		NormalizeDomain:           r.NormalizeDomain != nil,
+		FollowIndex:               r.FollowIndex,
+		FastParse:                 r.FastParse,
+		ComputeRegistrable:        r.ComputeRegistrable,
+		MaxInvalidRatio:           r.MaxInvalidRatio,
+		TraceDecoding:             r.TraceDecoding,
+		CaseInsensitiveNamespaces: r.CaseInsensitiveNamespaces,
+		StripComments:             r.StripComments,
+		WarnNoPrefix:              r.WarnNoPrefix,
+		RequirePrefix:             r.RequirePrefix,
+		Provenance:                r.Provenance,
+		FollowRedirects:           r.FollowRedirects,
+		MaxDepth:                  r.MaxDepth,
+		LookupMode:                r.LookupMode.String(),
+		KeepDuplicateEntries:      r.KeepDuplicateEntries,
+		OnQuery:                   r.OnQuery != nil,
+	}
+	if r.LookupTXTContext != nil {
+		config.Lookup = "custom-context"
+	} else if r.LookupTXT != nil {
+		config.Lookup = "custom"
+	}
+	return json.Marshal(config)
+}
+
+// ResolverConfig describes the lookup of a Resolver in a config file, see
+// NewResolverFromConfig, e.g.:
+//
+//	{"transport": "udp", "servers": ["1.1.1.1", "8.8.8.8:53"], "timeout": "5s"}
+type ResolverConfig struct {
+	// Transport is "udp" (default), "tcp", "tls" (DNS-over-TLS), "doh"
+	// (DNS-over-HTTPS) or "system" for the resolver of the operating system.
+	Transport string `json:"transport"`
+	// Servers are the name servers to query, with an optional port. For doh
+	// it is a single endpoint url. The system transport takes no servers.
+	Servers []string `json:"servers"`
+	// Timeout limits every query, a duration like "500ms" or "5s".
+	Timeout string `json:"timeout"`
+	// UDPSize is the buffer size for responses of the udp transport, see
+	// UDPLookupOptions.
+	UDPSize uint16 `json:"udpSize"`
+	// LookupMode is "prefix-then-bare" (default), "prefix-only" or
+	// "bare-only", see Resolver.LookupMode.
+	LookupMode string `json:"lookupMode"`
+}
+
+// NewResolverFromConfig returns a resolver with the lookup that the json
+// ResolverConfig describes. Unknown fields and transports, missing servers
+// and options that don't apply to the transport are errors.
+func NewResolverFromConfig(data []byte) (*Resolver, error) {
+	var config ResolverConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid resolver config: %w", err)
+	}
+	return config.Resolver()
+}
+
+// Resolver returns a resolver with the configured lookup.
+func (config ResolverConfig) Resolver() (*Resolver, error) {
+	r := &Resolver{}
+	mode, err := parseLookupMode(config.LookupMode)
+	if err != nil {
+		return nil, err
+	}
+	r.LookupMode = mode
+	var timeout time.Duration
+	if config.Timeout != "" {
+		timeout, err = time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q, use a duration like 500ms or 5s", config.Timeout)
+		}
+	}
+	transport := config.Transport
+	switch transport {
+	case "":
+		transport = "udp"
+	case "udp", "tcp", "tls", "doh", "system":
+	default:
+		return nil, fmt.Errorf("unknown transport %q, use udp, tcp, tls, doh or system", config.Transport)
+	}
+	if transport == "system" {
+		if len(config.Servers) > 0 || timeout > 0 || config.UDPSize > 0 {
+			return nil, fmt.Errorf("the system transport takes no servers, timeout or udpSize")
+		}
+		return r, nil
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("the %s transport requires servers", transport)
+	}
+	if config.UDPSize > 0 && transport != "udp" {
+		return nil, fmt.Errorf("udpSize only applies to the udp transport")
+	}
+	switch transport {
+	case "udp":
+		r.LookupTXTContext = NewUDPLookupWithOptions(withDefaultPorts(config.Servers, "53"), UDPLookupOptions{UDPSize: config.UDPSize, Timeout: timeout})
+	case "tcp":
+		client := &dns.Client{Net: "tcp", Timeout: timeout}
+		r.LookupTXTContext = newClientLookup(client, withDefaultPorts(config.Servers, "53"), UDPLookupOptions{})
+	case "tls":
+		client := &dns.Client{Net: "tcp-tls", Timeout: timeout}
+		r.LookupTXTContext = newClientLookup(client, withDefaultPorts(config.Servers, "853"), UDPLookupOptions{})
+	case "doh":
+		if len(config.Servers) > 1 {
+			return nil, fmt.Errorf("the doh transport takes a single endpoint")
+		}
+		var client *http.Client
+		if timeout > 0 {
+			client = &http.Client{Timeout: timeout}
+		}
+		r.LookupTXTContext = NewDoHLookupContext(config.Servers[0], client)
+	}
+	return r, nil
+}
+
+func parseLookupMode(mode string) (LookupMode, error) {
+	for _, known := range []LookupMode{PrefixThenBare, PrefixOnly, BareOnly} {
+		if mode == known.String() {
+			return known, nil
+		}
+	}
+	if mode == "" {
+		return PrefixThenBare, nil
+	}
+	return PrefixThenBare, fmt.Errorf("unknown lookupMode %q, use prefix-then-bare, prefix-only or bare-only", mode)
+}
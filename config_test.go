@@ -0,0 +1,105 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestConfigJSON(t *testing.T) {
+	config, err := (&Resolver{}).ConfigJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"lookup": "system",
+		"domainTimeout": "0s",
+		"fallbackOnServFail": false,
+		"fallbackOnNoData": false,
+		"diagnostics": false,
+		"maxIdentifierLength": 0,
+		"normalizeDomain": false,
+		"followIndex": false,
+		"fastParse": false,
+		"computeRegistrable": false,
+		"maxInvalidRatio": 0,
+		"traceDecoding": false,
+		"caseInsensitiveNamespaces": false,
+		"stripComments": false,
+		"warnNoPrefix": false,
+		"requirePrefix": false,
+		"provenance": false,
+		"followRedirects": false,
+		"maxDepth": 0,
+		"lookupMode": "prefix-then-bare",
+		"keepDuplicateEntries": false,
+		"onQuery": false
+	}`, string(config))
+
+	secret := "tsig-secret-value"
+	r := &Resolver{
+		LookupTXTContext: func(ctx context.Context, name string) ([]LookupEntry, error) {
+			return []LookupEntry{{Value: secret}}, nil
+		},
+		DomainTimeout:       2 * time.Second,
+		FallbackOnServFail:  true,
+		MaxIdentifierLength: 100,
+		NormalizeDomain: func(domain string) string {
+			return strings.TrimPrefix(domain, secret)
+		},
+	}
+	config, err = r.ConfigJSON()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(config), secret)
+	parsed := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(config, &parsed))
+	assert.Equal(t, "custom-context", parsed["lookup"])
+	assert.Equal(t, "2s", parsed["domainTimeout"])
+	assert.Equal(t, true, parsed["fallbackOnServFail"])
+	assert.Equal(t, float64(100), parsed["maxIdentifierLength"])
+	assert.Equal(t, true, parsed["normalizeDomain"])
+}
+
+func TestNewResolverFromConfig(t *testing.T) {
+	server := startDNSServerWithTCP(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/"+w.RemoteAddr().Network())}
+		w.WriteMsg(res)
+	})
+	for _, transport := range []string{"udp", "tcp"} {
+		r, err := NewResolverFromConfig([]byte(`{"transport": "` + transport + `", "servers": ["` + server + `"], "timeout": "5s", "lookupMode": "prefix-only"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, PrefixOnly, r.LookupMode)
+		result, err := r.Resolve("foo.com")
+		assert.NoError(t, err)
+		assert.Equal(t, transport, result.Links["ipfs"][0].Identifier)
+	}
+
+	r, err := NewResolverFromConfig([]byte(`{"servers": ["` + server + `"], "udpSize": 1232}`))
+	assert.NoError(t, err)
+	assert.NotNil(t, r.LookupTXTContext)
+	assert.Equal(t, PrefixThenBare, r.LookupMode)
+
+	r, err = NewResolverFromConfig([]byte(`{"transport": "system"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, r.LookupTXTContext)
+
+	for config, message := range map[string]string{
+		`{"transport": "smtp", "servers": ["1.1.1.1"]}`:                         `unknown transport "smtp", use udp, tcp, tls, doh or system`,
+		`{"transport": "tls"}`:                                                  "the tls transport requires servers",
+		`{"servers": []}`:                                                       "the udp transport requires servers",
+		`{"transport": "system", "servers": ["1.1.1.1"]}`:                       "the system transport takes no servers, timeout or udpSize",
+		`{"transport": "tcp", "servers": ["1.1.1.1"], "udpSize": 512}`:          "udpSize only applies to the udp transport",
+		`{"transport": "doh", "servers": ["https://a/dns-query", "https://b"]}`: "the doh transport takes a single endpoint",
+		`{"servers": ["1.1.1.1"], "timeout": "5"}`:                              `invalid timeout "5", use a duration like 500ms or 5s`,
+		`{"servers": ["1.1.1.1"], "lookupMode": "bare"}`:                        `unknown lookupMode "bare", use prefix-then-bare, prefix-only or bare-only`,
+		`{"servers": ["1.1.1.1"], "server": "8.8.8.8"}`:                         `invalid resolver config: json: unknown field "server"`,
+	} {
+		_, err := NewResolverFromConfig([]byte(config))
+		assert.EqualError(t, err, message, config)
+	}
+}
@@ -2,17 +2,25 @@ package dnslink
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	dns "github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
 )
 
 type LogStatement struct {
@@ -38,57 +46,525 @@ func (stmt *LogStatement) MarshalJSON() ([]byte, error) {
 	return json.Marshal(out)
 }
 
+var logCodeDescriptions = map[string]string{
+	"FALLBACK":            "No DNSLink entry found at the _dnslink. subdomain, the domain itself was used.",
+	"INVALID_ENTRY":       "A TXT entry starting with dnslink= is not a valid DNSLink entry.",
+	"WRONG_START":         "DNSLink entry must start with a '/'.",
+	"INVALID_CHARACTER":   "DNSLink entry contains a character that is not allowed.",
+	"NAMESPACE_MISSING":   "DNSLink entry has no namespace, like /ipfs/.",
+	"NO_IDENTIFIER":       "DNSLink entry has no identifier after the namespace.",
+	"TOO_LONG":            "The domain name or one of its labels is too long.",
+	"EMPTY_PART":          "The domain name contains an empty label.",
+	"INVALID_IDN":         "The internationalized domain name could not be converted to punycode.",
+	"OFF_DOMAIN_ANSWER":   "The DNS answer contained a TXT record for a different name, it was ignored.",
+	"DNAME":               "A DNAME record redirected the lookup to a different part of the DNS tree.",
+	"CHUNKED_ENTRY":       "The TXT entry was split into several strings that were joined.",
+	"LONG_ENTRY":          "The TXT entry is unusually long.",
+	"SERVFAIL":            "The name server was unable to process the query.",
+	"NODATA":              "The domain exists but has no TXT records.",
+	"INDEX_CYCLE":         "The domain of a dnslink-index entry was already resolved, it was skipped.",
+	"INDEX_TOO_DEEP":      "Too many dnslink-index entries were followed in a row, the domain was skipped.",
+	"INDEX_ERROR":         "The domain of a dnslink-index entry could not be resolved.",
+	"SIZES":               "Wire sizes of the DNS query and response in bytes.",
+	"TRUNCATED":           "The UDP response was truncated, the query was repeated over TCP.",
+	"TRUNCATED_ANSWER":    "The UDP response was truncated and not repeated over TCP, entries may be missing.",
+	"ALIAS":               "The alias was resolved and its entries are part of the result.",
+	"ALIAS_ERROR":         "The alias could not be resolved.",
+	"DECODED_ENTRY":       "How a TXT entry was decoded from the character-strings of the record.",
+	"IDENTIFIER_TOO_LONG": "The identifier of the DNSLink entry is longer than the configured limit, the entry was ignored.",
+	"NAMESPACE_CASE":      "The namespace of the DNSLink entry was lowercased to merge it with other spellings.",
+	"COMMENT_STRIPPED":    "A trailing comment or trailing spaces were removed from the DNSLink entry.",
+	"NO_PREFIXED_RECORD":  "The DNSLink entries were only found at the bare domain, not at the _dnslink. subdomain.",
+	"RECURSIVE_LOOP":      "A /dnslink/ redirect leads back to a resolved domain or too many redirects were followed.",
+	"REDIRECT_FAILED":     "The domain of a /dnslink/ redirect could not be resolved, it was skipped.",
+	"DUPLICATE_ENTRY":     "The DNSLink entry repeats an earlier entry, it was dropped.",
+	"CNAME_FOLLOWED":      "The DNS answer only had a CNAME record, its target was queried.",
+	"CNAME_LOOP":          "Too many CNAME records were followed in a row, the lookup returned no entries.",
+	"MERGED":              "The following statements belong to a result that was merged with Result.Merge.",
+}
+
+// DescribeLogCode returns a human readable explanation of a log statement
+// code or reason, like "WRONG_START". Unknown codes return an empty string.
+func DescribeLogCode(code string) string {
+	return logCodeDescriptions[code]
+}
+
 type Result struct {
 	TxtEntries []TxtEntry                  `json:"txtEntries"`
 	Links      map[string]NamespaceEntries `json:"links"`
 	Log        []LogStatement              `json:"log"`
+	// RegistrableDomain is the public suffix plus one label of the queried
+	// domain, like example.co.uk for www.example.co.uk. It is only set with
+	// Resolver.ComputeRegistrable and stays empty if the domain is a public
+	// suffix itself.
+	RegistrableDomain string `json:"registrableDomain,omitempty"`
+	// Authenticated is true if the name server set the Authenticated Data
+	// flag on the answer. It is only requested with UDPLookupOptions.DNSSEC
+	// and only as trustworthy as the connection to the name server, unless
+	// the signatures were verified with UDPLookupOptions.Validate.
+	Authenticated bool `json:"authenticated,omitempty"`
+	// Provenance holds the origin of every valid entry of the domain, in the
+	// order of the TXT answer. It is only set with Resolver.Provenance.
+	Provenance []EntryProvenance `json:"provenance,omitempty"`
+	// Query is the name whose TXT records the entries came from, like
+	// _dnslink.example.com or example.com after a fallback. Entries merged
+	// from other domains, e.g. with Resolver.FollowRedirects, keep the name
+	// of the resolved domain. It is not part of the JSON form as that is
+	// defined by the DNSLink specification.
+	Query      string `json:"-"`
+	namespaces []string
+}
+
+// OrderedNamespaces returns the namespaces of the links in the order their
+// first valid entry appeared in the TXT answer.
+//
+// Only results returned by a Resolver (and copies of them) carry the
+// discovery order. It is not part of the JSON form, so results that are
+// constructed by hand, rebuilt from parts of another result or unmarshalled
+// from JSON return their namespaces in sorted order instead.
+func (result *Result) OrderedNamespaces() []string {
+	if result.namespaces != nil {
+		return append([]string{}, result.namespaces...)
+	}
+	namespaces := make([]string, 0, len(result.Links))
+	for ns := range result.Links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// NamespaceList holds the entries of a single namespace.
+type NamespaceList struct {
+	Namespace string
+	Entries   []NamespaceEntry
+}
+
+// AsList returns the links sorted by namespace, which is easier to range over
+// in templates than the Links map.
+func (result Result) AsList() []NamespaceList {
+	namespaces := make([]string, 0, len(result.Links))
+	for ns := range result.Links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	list := make([]NamespaceList, len(namespaces))
+	for index, ns := range namespaces {
+		list[index] = NamespaceList{
+			Namespace: ns,
+			Entries:   result.Links[ns],
+		}
+	}
+	return list
+}
+
+// PreferNamespaces returns the first namespace of the given order that has
+// entries in the result.
+func (result *Result) PreferNamespaces(order ...string) (namespace string, entries []NamespaceEntry, ok bool) {
+	for _, ns := range order {
+		entries, hasEntries := result.Links[ns]
+		if hasEntries && len(entries) > 0 {
+			return ns, entries, true
+		}
+	}
+	return "", nil, false
+}
+
+// Fingerprint returns a stable sha256 hash (hex) over the sorted links of the
+// result. TTLs and log statements are not part of the fingerprint, so it only
+// changes when the links change.
+func (result Result) Fingerprint() string {
+	lines := []string{}
+	for ns, entries := range result.Links {
+		for _, entry := range entries {
+			lines = append(lines, "/"+ns+"/"+entry.Identifier+"\n")
+		}
+	}
+	sort.Strings(lines)
+	hash := sha256.New()
+	for _, line := range lines {
+		hash.Write([]byte(line))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// LinkHeader returns the links of the result as value for an RFC 8288 Link
+// header, like `</ipfs/QmXNosdf...>; rel="dnslink"`, as sent by http gateways.
+// It is empty if there are no links.
+func (result Result) LinkHeader() string {
+	links := []string{}
+	for _, ns := range result.OrderedNamespaces() {
+		for _, entry := range result.Links[ns] {
+			target := (&url.URL{Path: "/" + ns + "/" + entry.Identifier}).EscapedPath()
+			links = append(links, "<"+target+">; rel=\"dnslink\"")
+		}
+	}
+	return strings.Join(links, ", ")
 }
 
+// ResultDiff lists the identifiers, per namespace, that were added or removed
+// between two results. TTLs are not taken into account.
+type ResultDiff struct {
+	Added   map[string][]string `json:"added"`
+	Removed map[string][]string `json:"removed"`
+}
+
+func (diff *ResultDiff) Changed() bool {
+	return len(diff.Added) > 0 || len(diff.Removed) > 0
+}
+
+func DiffResults(previous Result, next Result) ResultDiff {
+	return ResultDiff{
+		Added:   missingLinks(next.Links, previous.Links),
+		Removed: missingLinks(previous.Links, next.Links),
+	}
+}
+
+func missingLinks(links map[string]NamespaceEntries, other map[string]NamespaceEntries) map[string][]string {
+	missing := map[string][]string{}
+	for ns, entries := range links {
+		known := map[string]bool{}
+		for _, entry := range other[ns] {
+			known[entry.Identifier] = true
+		}
+		for _, entry := range entries {
+			if !known[entry.Identifier] {
+				missing[ns] = append(missing[ns], entry.Identifier)
+			}
+		}
+	}
+	return missing
+}
+
+// MergeResults combines the links of several results. Entries that are in
+// more than one result are only kept once, with the lowest ttl. The logs are
+// concatenated and the result is only Authenticated if all results are.
+func MergeResults(results ...Result) Result {
+	merged := Result{
+		Links:         map[string]NamespaceEntries{},
+		Log:           []LogStatement{},
+		Authenticated: len(results) > 0,
+		namespaces:    []string{},
+	}
+	for _, result := range results {
+		for _, ns := range result.OrderedNamespaces() {
+			list, hasList := merged.Links[ns]
+			if !hasList {
+				merged.namespaces = append(merged.namespaces, ns)
+			}
+		entries:
+			for _, entry := range result.Links[ns] {
+				for known := range list {
+					if list[known].Identifier == entry.Identifier {
+						if entry.Ttl < list[known].Ttl {
+							list[known].Ttl = entry.Ttl
+						}
+						continue entries
+					}
+				}
+				list = append(list, entry)
+			}
+			sort.Sort(ByValue{list})
+			merged.Links[ns] = list
+		}
+		merged.Log = append(merged.Log, result.Log...)
+		if merged.RegistrableDomain == "" {
+			merged.RegistrableDomain = result.RegistrableDomain
+		}
+		if !result.Authenticated {
+			merged.Authenticated = false
+		}
+	}
+	merged.TxtEntries = txtEntriesOf(merged.Links)
+	return merged
+}
+
+// Merge combines the result with the links of another one, like
+// MergeResults: entries that are in both are only kept once, with the lower
+// ttl. The log of the other result follows a MERGED statement with its Query,
+// so that the statements can be told apart. The merged result keeps the
+// Query of the result that Merge was called on.
+func (result Result) Merge(other Result) Result {
+	merged := MergeResults(result, other)
+	merged.Log = append([]LogStatement{}, result.Log...)
+	merged.Log = append(merged.Log, LogStatement{Code: "MERGED", Entry: other.Query})
+	merged.Log = append(merged.Log, other.Log...)
+	merged.Query = result.Query
+	return merged
+}
+
+// txtEntriesOf lists the links sorted by namespace and identifier.
+func txtEntriesOf(links map[string]NamespaceEntries) []TxtEntry {
+	namespaces := make([]string, 0, len(links))
+	for ns := range links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	txtEntries := []TxtEntry{}
+	for _, ns := range namespaces {
+		for _, entry := range links[ns] {
+			txtEntries = append(txtEntries, TxtEntry{Value: "/" + ns + "/" + entry.Identifier, Ttl: entry.Ttl, Source: entry.Source})
+		}
+	}
+	return txtEntries
+}
+
+// ResultNoTtl is a Result without ttls, with only the values of the
+// TxtEntries and the identifiers of the Links, like the json output of the
+// dnslink command without --ttl.
 type ResultNoTtl struct {
 	TxtEntries []string            `json:"txtEntries"`
 	Links      map[string][]string `json:"links"`
 	Log        []LogStatement      `json:"log"`
 }
 
-func (result *Result) NoTtl() ResultNoTtl {
-	ttlRes := ResultNoTtl{}
-	ttlRes.TxtEntries = []string{}
-	ttlRes.Links = map[string][]string{}
+// Values returns only the values of the TxtEntries and the identifiers of
+// the Links. TxtEntries and Links are never nil. The returned result doesn't
+// share memory with the result, so either can be changed without affecting
+// the other.
+func (result *Result) Values() ResultNoTtl {
+	values := ResultNoTtl{}
+	values.TxtEntries = []string{}
+	values.Links = map[string][]string{}
 	for _, txtEntryTtl := range result.TxtEntries {
-		ttlRes.TxtEntries = append(ttlRes.TxtEntries, txtEntryTtl.Value)
+		values.TxtEntries = append(values.TxtEntries, txtEntryTtl.Value)
 	}
 	for ns, identifiersTtl := range result.Links {
 		list := []string{}
 		for _, identifierTtl := range identifiersTtl {
 			list = append(list, identifierTtl.Identifier)
 		}
+		values.Links[ns] = list
+	}
+	if result.Log != nil {
+		values.Log = append([]LogStatement{}, result.Log...)
+	}
+	return values
+}
+
+// NoTtl returns a copy of the result with the ttls of all TxtEntries and
+// Links set to 0. TxtEntries and Links are never nil. The returned result
+// doesn't share memory with the result, so either can be changed without
+// affecting the other.
+func (result *Result) NoTtl() Result {
+	return result.WithTtl(0)
+}
+
+// WithTtl returns a copy of the result with the same ttl for all TxtEntries
+// and Links, e.g. to restore results that were stored without ttls. Like
+// NoTtl, the returned result doesn't share memory with the result.
+func (result *Result) WithTtl(ttl uint32) Result {
+	ttlRes := *result
+	ttlRes.TxtEntries = make([]TxtEntry, len(result.TxtEntries))
+	for index, entry := range result.TxtEntries {
+		entry.Ttl = ttl
+		ttlRes.TxtEntries[index] = entry
+	}
+	ttlRes.Links = make(map[string]NamespaceEntries, len(result.Links))
+	for ns, entries := range result.Links {
+		list := make(NamespaceEntries, len(entries))
+		for index, entry := range entries {
+			entry.Ttl = ttl
+			list[index] = entry
+		}
 		ttlRes.Links[ns] = list
 	}
-	ttlRes.Log = result.Log
+	if result.Log != nil {
+		ttlRes.Log = append([]LogStatement{}, result.Log...)
+	}
+	if result.Provenance != nil {
+		ttlRes.Provenance = append([]EntryProvenance{}, result.Provenance...)
+	}
+	if result.namespaces != nil {
+		ttlRes.namespaces = append([]string{}, result.namespaces...)
+	}
 	return ttlRes
 }
 
 type TxtEntry struct {
-	Value string `json:"value"`
-	Ttl   uint32 `json:"ttl"`
+	Value  string      `json:"value"`
+	Ttl    uint32      `json:"ttl"`
+	Source EntrySource `json:"-"`
 }
 
 type NamespaceEntry struct {
-	Identifier string `json:"identifier"`
-	Ttl        uint32 `json:"ttl"`
+	Identifier string      `json:"identifier"`
+	Ttl        uint32      `json:"ttl"`
+	Source     EntrySource `json:"-"`
+}
+
+// LookupMode selects the names that are queried for a domain, see
+// Resolver.LookupMode.
+type LookupMode int
+
+const (
+	// PrefixThenBare queries the _dnslink. prefixed domain and falls back to
+	// the bare domain if it doesn't exist, as the DNSLink specification
+	// describes. It is the default.
+	PrefixThenBare LookupMode = iota
+	// PrefixOnly only queries the _dnslink. prefixed domain.
+	PrefixOnly
+	// BareOnly only queries the bare domain, for deployments that publish
+	// the entries at the apex.
+	BareOnly
+)
+
+func (mode LookupMode) String() string {
+	switch mode {
+	case PrefixOnly:
+		return "prefix-only"
+	case BareOnly:
+		return "bare-only"
+	}
+	return "prefix-then-bare"
+}
+
+// EntrySource tells which name an entry was found at. It is not part of the
+// JSON form as that is defined by the DNSLink specification.
+type EntrySource string
+
+const (
+	// SourcePrefixed marks entries found at the _dnslink. prefixed domain.
+	SourcePrefixed EntrySource = "prefixed"
+	// SourceBare marks entries found at the domain itself, after a fallback.
+	SourceBare EntrySource = "bare"
+)
+
+// DisplayIdentifier returns the identifier with punycode encoded domain
+// labels (xn--) converted to unicode, as found in ipns identifiers that point
+// to internationalized domains. Identifier stays untouched; identifiers that
+// don't contain punycode or fail to decode are returned as-is.
+func (entry NamespaceEntry) DisplayIdentifier() string {
+	host := entry.Identifier
+	rest := ""
+	if index := strings.Index(host, "/"); index != -1 {
+		host, rest = host[:index], host[index:]
+	}
+	if !hasPunycodeLabel(host) {
+		return entry.Identifier
+	}
+	display, err := idna.Display.ToUnicode(host)
+	if err != nil {
+		return entry.Identifier
+	}
+	return display + rest
+}
+
+func hasPunycodeLabel(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if strings.HasPrefix(strings.ToLower(label), "xn--") {
+			return true
+		}
+	}
+	return false
 }
 
 type Resolver struct {
 	LookupTXT LookupTXTFunc
+	// LookupTXTContext is used instead of LookupTXT if set. Context-aware
+	// lookups are aborted when a batch resolution times out or is cancelled.
+	LookupTXTContext LookupTXTContextFunc
+	// DomainTimeout limits the time spent resolving a single domain in batch
+	// resolutions. Zero means no limit.
+	DomainTimeout time.Duration
+	// FallbackOnServFail also falls back to the bare domain if the lookup of
+	// the _dnslink. prefixed domain fails with SERVFAIL.
+	FallbackOnServFail bool
+	// FallbackOnNoData also falls back to the bare domain if the _dnslink.
+	// prefixed domain exists but has no TXT records (NODATA), which many
+	// zones answer instead of NXDOMAIN.
+	FallbackOnNoData bool
+	// LookupMode selects whether the _dnslink. prefixed domain, the bare
+	// domain or both are queried, defaults to PrefixThenBare. The fallback
+	// options only apply to PrefixThenBare.
+	LookupMode LookupMode
+	// Diagnostics adds log statements about the layout of the TXT records
+	// that are not part of the DNSLink specification.
+	Diagnostics bool
+	// MaxIdentifierLength drops entries with longer identifiers with an
+	// IDENTIFIER_TOO_LONG log statement. Zero means no limit.
+	MaxIdentifierLength int
+	// NormalizeDomain is applied to every domain after the _dnslink. prefix
+	// and trailing dot were removed and before it is validated, e.g. to strip
+	// "www." or to map aliases.
+	NormalizeDomain func(domain string) string
+	// FollowIndex merges the entries of the domains listed in
+	// /dnslink-index/<domain> entries into the result, see followIndex.
+	FollowIndex bool
+	// FastParse skips sorting the entries of a namespace by identifier and
+	// keeps them, and the TxtEntries, in the order of the TXT answer, also
+	// for publishers that intend the first entry to win. This saves
+	// allocations for crawlers, but the order of the output is then up to
+	// the name server and may change between resolutions.
+	FastParse bool
+	// ComputeRegistrable sets Result.RegistrableDomain using the public
+	// suffix list, including its private section (e.g. github.io).
+	ComputeRegistrable bool
+	// MaxInvalidRatio fails the resolution with an InvalidRatioError if the
+	// share of invalid dnslink entries is higher, e.g. 0.5 fails if more than
+	// half of the entries are invalid. Zero, like 1, never fails.
+	MaxInvalidRatio float64
+	// TraceDecoding adds a DECODED_ENTRY log statement for every TXT entry
+	// with the character-strings as received and the decoded value as hex,
+	// to debug the decoding of escapes like \226\130\172.
+	TraceDecoding bool
+	// CaseInsensitiveNamespaces lowercases the namespaces of the entries,
+	// so that /IPFS/ and /ipfs/ entries are merged, with a NAMESPACE_CASE
+	// log statement for every changed entry. The DNSLink specification
+	// treats namespaces as case-sensitive.
+	CaseInsensitiveNamespaces bool
+	// StripComments removes trailing comments, like in
+	// "dnslink=/ipfs/Qm... # main site", and trailing spaces from the
+	// entries before they are parsed, with a COMMENT_STRIPPED log statement
+	// for every changed entry. A comment starts with a # after a space, so
+	// that identifiers like /https/example.com/#top are kept.
+	StripComments bool
+	// WarnNoPrefix adds a NO_PREFIXED_RECORD log statement if the entries
+	// were only found at the bare domain, to point publishers to the
+	// _dnslink. prefixed form.
+	WarnNoPrefix bool
+	// RequirePrefix fails the resolution with a NoPrefixedRecordError if the
+	// entries were only found at the bare domain.
+	RequirePrefix bool
+	// Provenance sets Result.Provenance with the origin of every entry.
+	Provenance bool
+	// FollowRedirects merges the links of the domains of /dnslink/<domain>
+	// entries into the result, see followRedirects.
+	FollowRedirects bool
+	// MaxDepth limits how many /dnslink/ redirects are followed in a row with
+	// FollowRedirects, defaults to 32.
+	MaxDepth int
+	// KeepDuplicateEntries keeps dnslink entries that repeat the namespace
+	// and identifier of an earlier entry, like the DNSLink specification.
+	// By default they are dropped, the earlier entry gets the larger ttl of
+	// both and a DUPLICATE_ENTRY log statement reports every dropped entry.
+	KeepDuplicateEntries bool
+	// OnQuery is called after every lookup of TXT records for a domain,
+	// including the fallback to the bare domain, e.g. to collect metrics.
+	// It may be called concurrently by batch resolutions. A
+	// CachingResolver answers cached results without lookups, so they
+	// don't cause events.
+	OnQuery func(event QueryEvent)
 }
 
 func (r *Resolver) Resolve(domain string) (Result, error) {
-	return resolve(r, domain)
+	return r.ResolveContext(context.Background(), domain)
+}
+
+// ResolveContext works like Resolve, but stops once ctx is done and returns
+// ctx.Err(). The fallback query to the bare domain isn't sent anymore after
+// a cancellation. Queries of a plain LookupTXT keep running in the
+// background, see ResolveAllContext.
+func (r *Resolver) ResolveContext(ctx context.Context, domain string) (Result, error) {
+	return resolveContext(ctx, r, domain)
 }
 
 type LookupEntry struct {
 	Value string
 	Ttl   uint32
+	// Chunks holds the character-strings of the TXT record in their escaped
+	// presentation form, if the lookup has access to them.
+	Chunks []string
 }
 type NamespaceEntries []NamespaceEntry
 
@@ -97,34 +573,81 @@ func (l NamespaceEntries) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 
 type ByValue struct{ NamespaceEntries }
 
+// Less sorts by identifier and, for duplicate identifiers, by ttl so that
+// the order doesn't depend on the order of the TXT answer.
 func (s ByValue) Less(i, j int) bool {
-	return s.NamespaceEntries[i].Identifier < s.NamespaceEntries[j].Identifier
+	a, b := s.NamespaceEntries[i], s.NamespaceEntries[j]
+	if a.Identifier != b.Identifier {
+		return a.Identifier < b.Identifier
+	}
+	return a.Ttl < b.Ttl
 }
 
 type LookupTXTFunc func(name string) (txt []LookupEntry, err error)
 
-var utf8CharReplace = regexp.MustCompile(`\\.`)
-
-func utf8CharReplaceFunc(input []byte) (result []byte) {
-	return input[1:]
-}
-
-var utf8DigitReplace = regexp.MustCompile(`\\\d{3}`)
+type LookupTXTContextFunc func(ctx context.Context, name string) (txt []LookupEntry, err error)
 
-func utf8DigitReplaceFunc(input []byte) (result []byte) {
-	result = make([]byte, 1)
-	num, _ := strconv.ParseUint(string(input[1:]), 10, 9)
-	result[0] = byte(num)
-	return result
+// withContext turns a lookup into a context-aware lookup that returns as soon
+// as the context is done. As a LookupTXTFunc can not be cancelled, the
+// query itself keeps running in the background until it finishes.
+func (lookupTXT LookupTXTFunc) withContext() LookupTXTContextFunc {
+	return func(ctx context.Context, name string) ([]LookupEntry, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		type lookupResult struct {
+			entries []LookupEntry
+			err     error
+		}
+		done := make(chan lookupResult, 1)
+		go func() {
+			entries, err := lookupTXT(name)
+			done <- lookupResult{entries, err}
+		}()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-done:
+			return res.entries, res.err
+		}
+	}
 }
 
+// utf8Value joins the character-strings of a TXT record, which miekg/dns
+// escapes in presentation format (\" \\ \DDD), and unescapes them. The
+// escapes are decoded in a single pass, so that an escaped backslash
+// followed by digits stays as it is and the value has the same bytes as the
+// one of net.LookupTXT, which joins the raw character-strings.
 func utf8Value(input []string) string {
-	bytes := []byte(strings.Join(input, ""))
-	bytes = utf8DigitReplace.ReplaceAllFunc(bytes, utf8DigitReplaceFunc)
-	bytes = utf8CharReplace.ReplaceAllFunc(bytes, utf8CharReplaceFunc)
+	escaped := strings.Join(input, "")
+	bytes := make([]byte, 0, len(escaped))
+	for index := 0; index < len(escaped); index++ {
+		char := escaped[index]
+		if char != '\\' || index+1 == len(escaped) {
+			bytes = append(bytes, char)
+			continue
+		}
+		if index+4 <= len(escaped) && isDecimal(escaped[index+1:index+4]) {
+			num, _ := strconv.ParseUint(escaped[index+1:index+4], 10, 9)
+			bytes = append(bytes, byte(num))
+			index += 3
+			continue
+		}
+		bytes = append(bytes, escaped[index+1])
+		index++
+	}
 	return string(bytes)
 }
 
+func isDecimal(input string) bool {
+	for index := 0; index < len(input); index++ {
+		if input[index] < '0' || input[index] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 type DNSRCode int
 
 const (
@@ -220,47 +743,502 @@ func (e DNSRCodeError) Error() string {
 	return fmt.Sprintf("%s (rcode=%d, %sdomain=%s)", e.DNSRCode.Detail(), int(e.DNSRCode), name, e.Domain)
 }
 
+// InvalidRatioError is returned if more dnslink entries are invalid than
+// Resolver.MaxInvalidRatio allows.
+type InvalidRatioError struct {
+	Domain  string `json:"domain"`
+	Invalid int    `json:"invalid"`
+	Total   int    `json:"total"`
+}
+
+func (e InvalidRatioError) Error() string {
+	return fmt.Sprintf("TOO_MANY_INVALID_ENTRIES (invalid=%d, total=%d, domain=%s)", e.Invalid, e.Total, e.Domain)
+}
+
+// NoPrefixedRecordError is returned with Resolver.RequirePrefix if the
+// entries were only found at the bare domain.
+type NoPrefixedRecordError struct {
+	Domain string `json:"domain"`
+}
+
+func (e NoPrefixedRecordError) Error() string {
+	return fmt.Sprintf("NO_PREFIXED_RECORD (domain=%s)", e.Domain)
+}
+
+// TimeoutError is returned by the lookups of NewUDPLookupWithOptions if the
+// server didn't answer in time, see UDPLookupOptions.Timeout. The query may
+// succeed if it is retried.
+type TimeoutError struct {
+	Domain string `json:"domain"`
+	Server string `json:"server"`
+	Err    error  `json:"-"`
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("TIMEOUT (server=%s, domain=%s)", e.Server, e.Domain)
+}
+
+func (e TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout and Temporary make TimeoutError a net.Error, so it can be handled
+// like other network timeouts.
+func (e TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e TimeoutError) Temporary() bool {
+	return true
+}
+
+func checkInvalidRatio(domain string, input []LookupEntry, log []LogStatement, maxRatio float64) error {
+	total := 0
+	for _, entry := range input {
+		if strings.HasPrefix(entry.Value, txtPrefix) {
+			total++
+		}
+	}
+	invalid := 0
+	for _, statement := range log {
+		if statement.Code == "INVALID_ENTRY" {
+			invalid++
+		}
+	}
+	if total > 0 && float64(invalid)/float64(total) > maxRatio {
+		return InvalidRatioError{Domain: domain, Invalid: invalid, Total: total}
+	}
+	return nil
+}
+
+// NewUDPLookup returns a lookup that queries TXT records of the servers over
+// UDP. Servers without a port, like 1.1.1.1 or 2606:4700:4700::1111, use
+// port 53.
 func NewUDPLookup(servers []string, udpSize uint16) LookupTXTFunc {
+	lookupTXT := NewUDPLookupContext(servers, udpSize)
+	return func(domain string) ([]LookupEntry, error) {
+		return lookupTXT(context.Background(), domain)
+	}
+}
+
+// NewUDPLookupContext works like NewUDPLookup, but the returned lookup aborts
+// the query once the context is done. Used as Resolver.LookupTXTContext, the
+// lookup also adds log statements about the DNS answer (see LogLookup) to
+// the result, which the context-free NewUDPLookup can't.
+func NewUDPLookupContext(servers []string, udpSize uint16) LookupTXTContextFunc {
+	return NewUDPLookupWithOptions(servers, UDPLookupOptions{UDPSize: udpSize})
+}
+
+type UDPLookupOptions struct {
+	// UDPSize is the buffer size for responses, defaults to 4096.
+	UDPSize uint16
+	// Class of the query, defaults to dns.ClassINET.
+	Class uint16
+	// ReportSizes adds a SIZES log statement with the wire sizes of the
+	// query and response, e.g. "req=40 res=1400", to spot responses that
+	// come close to the UDPSize and could be truncated or fragmented.
+	ReportSizes bool
+	// ID generates the query ids, defaults to dns.Id. It is called for every
+	// query, possibly concurrently.
+	ID func() uint16
+	// DNSSEC sets the DO bit on queries, so that the name server reports if
+	// it validated the answer, see Result.Authenticated.
+	DNSSEC bool
+	// Network restricts the transport to "udp4" or "udp6", by default both
+	// are used.
+	Network string
+	// Rand picks the server for every query, defaults to the global source
+	// of math/rand. A seeded source makes the selection reproducible, e.g.
+	// in tests. Its use is serialized, as a rand.Rand is not safe for
+	// concurrent use.
+	Rand *rand.Rand
+	// MaxAttempts tries up to that many of the servers, in random order,
+	// until one answers without a network error or SERVFAIL. The error of
+	// the last attempt is returned if all fail. Zero, like 1, sends a single
+	// query to a random server.
+	MaxAttempts int
+	// Timeout limits every query to a server, including the TCP retry of a
+	// truncated answer. Queries that run into it return a TimeoutError. Zero
+	// uses the defaults of miekg/dns, 2 seconds each to connect, send and
+	// receive.
+	Timeout time.Duration
+	// Validate verifies the signatures of the answer and the keys of the
+	// zones up to the TrustAnchors, querying the DNSKEY and DS records from
+	// the same server. Answers that are unsigned or fail the verification
+	// return a DNSSECError, validated answers are Result.Authenticated.
+	// Answers without records, like NXDOMAIN, are not verified.
+	Validate bool
+	// TrustAnchors are the DS records of the root zone for Validate,
+	// defaults to RootTrustAnchors.
+	TrustAnchors []*dns.DS
+	// RequireAuthenticated returns a DNSSECError for answers without the
+	// Authenticated Data flag. Unlike Validate, this trusts the name server
+	// to validate the answer and the connection to it.
+	RequireAuthenticated bool
+	// DisableTCPRetry keeps truncated answers instead of repeating the query
+	// over TCP, e.g. where TCP is blocked. The possibly incomplete answer is
+	// reported with a TRUNCATED_ANSWER log statement.
+	DisableTCPRetry bool
+	// ClientSubnet adds an EDNS0 Client Subnet option (RFC 7871) with the
+	// network to the queries, including their TCP retry, so that name
+	// servers that serve records by location answer for that network
+	// instead of the one of the resolver. It only affects servers that
+	// honor the option. Nil, the default, sends no subnet, which reveals
+	// less about the client.
+	ClientSubnet *net.IPNet
+}
+
+// NewUDPLookupWithOptions works like NewUDPLookupContext, with additional
+// options for the queries.
+func NewUDPLookupWithOptions(servers []string, options UDPLookupOptions) LookupTXTContextFunc {
 	client := new(dns.Client)
-	if udpSize == 0 {
+	client.Net = options.Network
+	client.Timeout = options.Timeout
+	return newClientLookup(client, withDefaultPorts(servers, "53"), options)
+}
+
+// newClientLookup returns a lookup that sends the queries with the client,
+// whichever transport it is configured for.
+func newClientLookup(client *dns.Client, servers []string, options UDPLookupOptions) LookupTXTContextFunc {
+	if len(servers) == 0 {
+		return func(ctx context.Context, domain string) ([]LookupEntry, error) {
+			return nil, errors.New("no DNS servers configured")
+		}
+	}
+	if options.UDPSize == 0 {
 		// Running into issues with too small buffer size of dns library in some cases
 		client.UDPSize = 4096
 	} else {
-		client.UDPSize = udpSize
+		client.UDPSize = options.UDPSize
+	}
+	class := options.Class
+	if class == 0 {
+		class = dns.ClassINET
 	}
-	return func(domain string) (entries []LookupEntry, err error) {
+	id := options.ID
+	if id == nil {
+		id = dns.Id
+	}
+	tcpClient := truncationClient(client)
+	if options.DisableTCPRetry {
+		tcpClient = nil
+	}
+	dnssec := options.DNSSEC || options.Validate || options.RequireAuthenticated
+	var subnet *dns.EDNS0_SUBNET
+	if options.ClientSubnet != nil {
+		subnet = clientSubnet(options.ClientSubnet)
+	}
+	pick := rand.Intn
+	if options.Rand != nil {
+		var mutex sync.Mutex
+		pick = func(n int) int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return options.Rand.Intn(n)
+		}
+	}
+	var lookup LookupTXTContextFunc
+	lookup = func(ctx context.Context, domain string) (entries []LookupEntry, err error) {
 		if !strings.HasSuffix(domain, ".") {
 			domain += "."
 		}
 		req := new(dns.Msg)
-		req.Id = dns.Id()
+		req.Id = id()
 		req.RecursionDesired = true
 		req.Question = make([]dns.Question, 1)
 		req.Question[0] = dns.Question{
 			Name:   domain,
 			Qtype:  dns.TypeTXT,
-			Qclass: dns.ClassINET,
+			Qclass: class,
 		}
-		server := servers[rand.Intn(len(servers))]
-		res, _, err := client.Exchange(req, server)
-		if err != nil {
-			return nil, err
+		if dnssec || subnet != nil {
+			req.SetEdns0(client.UDPSize, dnssec)
 		}
-		if res.Rcode != 0 {
-			return nil, NewDNSRCodeError(res.Rcode, domain)
+		if subnet != nil {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
 		}
-		entries = make([]LookupEntry, len(res.Answer))
-		for index, answer := range res.Answer {
-			if answer.Header().Rrtype == dns.TypeTXT {
-				txtAnswer := answer.(*dns.TXT)
-				entries[index] = LookupEntry{
-					Value: utf8Value(txtAnswer.Txt),
-					Ttl:   txtAnswer.Header().Ttl,
+		for index, server := range serverOrder(servers, options.MaxAttempts, pick) {
+			if index > 0 {
+				// Report the cancellation, not the failure of the previous
+				// server, once the context is done.
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				req.Id = id()
+			}
+			var res, truncated *dns.Msg
+			res, truncated, err = exchange(ctx, client, tcpClient, req, server)
+			if truncated != nil {
+				reason := fmt.Sprintf("udp=%d", len(truncated.Answer))
+				if err == nil {
+					reason += fmt.Sprintf(" tcp=%d", len(res.Answer))
+				}
+				LogLookup(ctx, LogStatement{Code: "TRUNCATED", Entry: server, Reason: reason})
+			}
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					err = TimeoutError{Domain: domain, Server: server, Err: err}
 				}
+				continue
+			}
+			LogLookupServer(ctx, server)
+			if options.ReportSizes {
+				LogLookup(ctx, LogStatement{Code: "SIZES", Entry: fmt.Sprintf("req=%d res=%d", req.Len(), res.Len())})
+			}
+			if res.Rcode == dns.RcodeServerFailure {
+				err = NewDNSRCodeError(res.Rcode, domain)
+				continue
+			}
+			if res.Rcode != 0 {
+				return nil, NewDNSRCodeError(res.Rcode, domain)
+			}
+			if res.Truncated {
+				LogLookup(ctx, LogStatement{Code: "TRUNCATED_ANSWER", Entry: server, Reason: fmt.Sprintf("answers=%d", len(res.Answer))})
+			}
+			if options.RequireAuthenticated && !res.AuthenticatedData {
+				return nil, DNSSECError{Domain: domain, Reason: "NOT_AUTHENTICATED"}
+			}
+			if options.Validate {
+				validator := newValidator(options.TrustAnchors, func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+					keyReq := new(dns.Msg)
+					keyReq.SetQuestion(name, qtype)
+					keyReq.Id = id()
+					keyReq.SetEdns0(client.UDPSize, true)
+					keyRes, _, err := exchange(ctx, client, tcpClient, keyReq, server)
+					return keyRes, err
+				})
+				if err = validator.validateAnswer(ctx, res); err != nil {
+					return nil, err
+				}
+				markAuthenticated(ctx)
+			} else if dnssec && res.AuthenticatedData {
+				markAuthenticated(ctx)
+			}
+			return followCNAME(ctx, lookup, domain, res)
+		}
+		return nil, err
+	}
+	return lookup
+}
+
+// exchange sends the query to the server and repeats it with the tcpClient
+// if the answer was truncated. The truncated answer is returned as well, to
+// report the retry.
+func exchange(ctx context.Context, client *dns.Client, tcpClient *dns.Client, req *dns.Msg, server string) (res *dns.Msg, truncated *dns.Msg, err error) {
+	res, _, err = client.ExchangeContext(ctx, req, server)
+	if err == nil && res.Truncated && tcpClient != nil {
+		truncated = res
+		res, _, err = tcpClient.ExchangeContext(ctx, req, server)
+	}
+	return
+}
+
+// truncationClient returns the client to repeat truncated UDP queries with,
+// over TCP of the same address family. Clients of other transports never
+// receive truncated answers and get nil.
+func truncationClient(client *dns.Client) *dns.Client {
+	tcpClient := &dns.Client{Dialer: client.Dialer, Timeout: client.Timeout}
+	switch client.Net {
+	case "", "udp":
+		tcpClient.Net = "tcp"
+	case "udp4":
+		tcpClient.Net = "tcp4"
+	case "udp6":
+		tcpClient.Net = "tcp6"
+	default:
+		return nil
+	}
+	return tcpClient
+}
+
+// clientSubnet returns the EDNS0 option for the network, with the address
+// reduced to its prefix.
+func clientSubnet(network *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := network.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       network.IP.Mask(network.Mask),
+	}
+	if ip4 := subnet.Address.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.Address = ip4
+	} else {
+		subnet.Family = 2
+	}
+	return subnet
+}
+
+// serverOrder returns the servers to try for a query: a random one for a
+// single attempt, or up to maxAttempts servers in random order.
+func serverOrder(servers []string, maxAttempts int, pick func(n int) int) []string {
+	if maxAttempts <= 1 {
+		return []string{servers[pick(len(servers))]}
+	}
+	order := append([]string{}, servers...)
+	for index := len(order) - 1; index > 0; index-- {
+		other := pick(index + 1)
+		order[index], order[other] = order[other], order[index]
+	}
+	if maxAttempts < len(order) {
+		order = order[:maxAttempts]
+	}
+	return order
+}
+
+// answerEntries returns the TXT records of the answer that belong to the
+// queried domain, directly or through a CNAME chain. TXT records for other
+// names are dropped with an OFF_DOMAIN_ANSWER log statement, DNAME records are
+// reported with a DNAME log statement.
+func answerEntries(ctx context.Context, domain string, res *dns.Msg) []LookupEntry {
+	names, _ := cnameChain(domain, res)
+	for _, answer := range res.Answer {
+		// A DNAME in a parent zone redirects the whole subtree, the server
+		// synthesizes a CNAME next to it which is followed above.
+		if dname, ok := answer.(*dns.DNAME); ok {
+			LogLookup(ctx, LogStatement{Code: "DNAME", Entry: dname.String()})
+		}
+	}
+	entries := []LookupEntry{}
+	for _, answer := range res.Answer {
+		txtAnswer, ok := answer.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		if !names[strings.ToLower(txtAnswer.Hdr.Name)] {
+			LogLookup(ctx, LogStatement{Code: "OFF_DOMAIN_ANSWER", Entry: txtAnswer.String()})
+			continue
+		}
+		entries = append(entries, LookupEntry{
+			Value:  utf8Value(txtAnswer.Txt),
+			Ttl:    txtAnswer.Hdr.Ttl,
+			Chunks: txtAnswer.Txt,
+		})
+	}
+	return entries
+}
+
+// cnameChain returns the names of the answer that belong to the domain,
+// directly or through a CNAME chain, and the last target of the chain, which
+// is empty if the domain has no CNAME.
+func cnameChain(domain string, res *dns.Msg) (names map[string]bool, target string) {
+	names = map[string]bool{
+		strings.ToLower(domain): true,
+	}
+	for added := true; added; {
+		added = false
+		for _, answer := range res.Answer {
+			if cname, ok := answer.(*dns.CNAME); ok && names[strings.ToLower(cname.Hdr.Name)] && !names[strings.ToLower(cname.Target)] {
+				names[strings.ToLower(cname.Target)] = true
+				target = cname.Target
+				added = true
 			}
 		}
+	}
+	return names, target
+}
+
+// maxCNAMEFollows limits how often CNAME-only answers are followed by a
+// single lookup, which ends CNAME loops.
+const maxCNAMEFollows = 8
+
+type cnameFollowsKey struct{}
+
+// followCNAME returns the entries of the answer. If the answer only has the
+// CNAME chain of the domain, because the name server didn't follow it, the
+// target is queried with the lookup and a CNAME_FOLLOWED log statement is
+// added. Once maxCNAMEFollows is reached, no entries are returned with a
+// CNAME_LOOP log statement.
+func followCNAME(ctx context.Context, lookup LookupTXTContextFunc, domain string, res *dns.Msg) ([]LookupEntry, error) {
+	entries := answerEntries(ctx, domain, res)
+	if len(entries) > 0 {
+		return entries, nil
+	}
+	_, target := cnameChain(domain, res)
+	if target == "" {
+		return entries, nil
+	}
+	follows, _ := ctx.Value(cnameFollowsKey{}).(int)
+	if follows >= maxCNAMEFollows {
+		LogLookup(ctx, LogStatement{Code: "CNAME_LOOP", Entry: domain})
 		return entries, nil
 	}
+	LogLookup(ctx, LogStatement{Code: "CNAME_FOLLOWED", Entry: domain, Reason: "target=" + target})
+	return lookup(context.WithValue(ctx, cnameFollowsKey{}, follows+1), target)
+}
+
+type lookupLogKey struct{}
+
+type lookupLog struct {
+	mutex      sync.Mutex
+	statements []LogStatement
+	// authenticated is set if the answer had the AD flag, see
+	// Result.Authenticated.
+	authenticated bool
+	// server is the name server that answered the last lookup, see
+	// EntryProvenance.Server.
+	server string
+}
+
+func withLookupLog(ctx context.Context) (context.Context, *lookupLog) {
+	log := &lookupLog{statements: []LogStatement{}}
+	return context.WithValue(ctx, lookupLogKey{}, log), log
+}
+
+func (log *lookupLog) all() []LogStatement {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return append([]LogStatement{}, log.statements...)
+}
+
+func (log *lookupLog) isAuthenticated() bool {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.authenticated
+}
+
+// markAuthenticated notes that the answer of the lookup had the AD flag.
+func markAuthenticated(ctx context.Context) {
+	log, ok := ctx.Value(lookupLogKey{}).(*lookupLog)
+	if !ok {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.authenticated = true
+}
+
+func (log *lookupLog) lastServer() string {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.server
+}
+
+// LogLookupServer allows a LookupTXTContextFunc to report the name server
+// that answered, for Resolver.Provenance. It does nothing if ctx doesn't
+// belong to a resolution.
+func LogLookupServer(ctx context.Context, server string) {
+	log, ok := ctx.Value(lookupLogKey{}).(*lookupLog)
+	if !ok {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.server = server
+}
+
+// LogLookup allows a LookupTXTContextFunc to add log statements to the result
+// of the resolution it is part of. It does nothing if ctx doesn't belong to
+// a resolution.
+func LogLookup(ctx context.Context, statements ...LogStatement) {
+	log, ok := ctx.Value(lookupLogKey{}).(*lookupLog)
+	if !ok {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.statements = append(log.statements, statements...)
 }
 
 const Version = "v0.6.0"
@@ -273,75 +1251,262 @@ func Resolve(domain string) (Result, error) {
 	return defaultResolver.Resolve(domain)
 }
 
-func wrapLookup(r *net.Resolver, ttl uint32) LookupTXTFunc {
-	return func(domain string) (res []LookupEntry, err error) {
-		txt, err := r.LookupTXT(context.Background(), domain)
-		if err != nil {
-			if strings.Contains(err.Error(), "no such host") {
-				err = NewDNSRCodeError(3, domain)
-			}
-			return nil, err
+func ResolveContext(ctx context.Context, domain string) (Result, error) {
+	return defaultResolver.ResolveContext(ctx, domain)
+}
+
+// wrapLookupContext adapts a net.Resolver, like the system resolver. The
+// resolver passes deadlines on to its queries but doesn't abort a pending
+// query when the context is cancelled, so the lookup returns as soon as the
+// context is done and leaves the query to finish with its own timeout.
+func wrapLookupContext(r *net.Resolver, ttl uint32) LookupTXTContextFunc {
+	return func(ctx context.Context, domain string) ([]LookupEntry, error) {
+		lookupTXT := LookupTXTFunc(func(domain string) ([]LookupEntry, error) {
+			return lookupNet(ctx, r, domain, ttl)
+		})
+		return lookupTXT.withContext()(ctx, domain)
+	}
+}
+
+func lookupNet(ctx context.Context, r *net.Resolver, domain string, ttl uint32) ([]LookupEntry, error) {
+	txt, err := r.LookupTXT(ctx, domain)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such host") {
+			err = NewDNSRCodeError(3, domain)
+		} else if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == "server misbehaving" {
+			// net reports SERVFAIL answers as "server misbehaving"
+			err = NewDNSRCodeError(2, domain)
 		}
-		res = make([]LookupEntry, len(txt))
-		for index, txt := range txt {
-			res[index] = LookupEntry{
-				Value: txt,
-				// net.LookupTXT doesn't support ttl :-(
-				Ttl: ttl,
-			}
+		return nil, err
+	}
+	res := make([]LookupEntry, len(txt))
+	for index, txt := range txt {
+		res[index] = LookupEntry{
+			Value: txt,
+			// net.LookupTXT doesn't support ttl :-(
+			Ttl: ttl,
 		}
-		return res, nil
 	}
+	return res, nil
 }
 
-var defaultLookupTXT = wrapLookup(net.DefaultResolver, 0)
+var defaultLookupTXT = wrapLookupContext(net.DefaultResolver, 0)
 
 const MAX_UINT_32 uint32 = 4294967295
 
-func resolve(r *Resolver, domain string) (result Result, err error) {
-	lookupTXT := r.LookupTXT
-	if lookupTXT == nil {
-		lookupTXT = defaultLookupTXT
+func (r *Resolver) lookupTXT() LookupTXTContextFunc {
+	if r.LookupTXTContext != nil {
+		return r.LookupTXTContext
+	}
+	if r.LookupTXT != nil {
+		return r.LookupTXT.withContext()
 	}
+	return defaultLookupTXT
+}
+
+// trimDomain removes the _dnslink. prefix and trailing dot of a domain.
+func trimDomain(domain string) string {
 	domain = strings.TrimPrefix(domain, dnsPrefix)
-	domain = strings.TrimSuffix(domain, ".")
-	err = testFqnd(domain)
+	return strings.TrimSuffix(domain, ".")
+}
+
+// normalize removes the _dnslink. prefix and trailing dot of a domain,
+// applies the NormalizeDomain hook and converts internationalized domains to
+// punycode.
+func (r *Resolver) normalize(domain string) string {
+	domain = trimDomain(domain)
+	if r.NormalizeDomain != nil {
+		domain = r.NormalizeDomain(domain)
+	}
+	return toASCII(domain)
+}
+
+// toASCII converts an internationalized domain, e.g. bücher.example, to the
+// punycode form that is used in queries (xn--bcher-kva.example). ASCII
+// domains are returned as-is, to not apply the stricter IDNA rules to names
+// like _service.example. Domains that fail to convert are returned as-is too
+// and rejected by testFqnd with INVALID_IDN.
+func toASCII(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+	return ascii
+}
+
+func isASCII(domain string) bool {
+	for index := 0; index < len(domain); index++ {
+		if domain[index] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func resolveContext(ctx context.Context, r *Resolver, domain string) (result Result, err error) {
+	return resolveNormalized(ctx, r, r.normalize(domain))
+}
+
+// resolveNormalized is resolveContext for a domain that was normalized
+// already, so that Resolver.NormalizeDomain runs once per resolution.
+func resolveNormalized(ctx context.Context, r *Resolver, domain string) (result Result, err error) {
+	result, err = resolveNormalizedDomain(ctx, r, domain)
 	if err != nil {
 		return
 	}
-	fallback := false
-	input, err := lookupTXT(dnsPrefix + domain)
+	if r.FollowIndex {
+		visited := map[string]bool{indexKey(domain): true}
+		result.Log = append(result.Log, followIndex(ctx, r, &result, visited, 1)...)
+	}
+	if r.FollowRedirects {
+		visited := map[string]bool{indexKey(domain): true}
+		var log []LogStatement
+		log, err = followRedirects(ctx, r, &result, visited, 1)
+		result.Log = append(result.Log, log...)
+	}
+	return
+}
+
+// resolveDomain resolves the entries of a single domain.
+func resolveDomain(ctx context.Context, r *Resolver, domain string) (result Result, err error) {
+	return resolveNormalizedDomain(ctx, r, r.normalize(domain))
+}
+
+// resolveNormalizedDomain is resolveDomain for a normalized domain.
+func resolveNormalizedDomain(ctx context.Context, r *Resolver, domain string) (result Result, err error) {
+	lookupTXT := r.lookupTXT()
+	err = testFqnd(domain)
 	if err != nil {
-		if isNotFoundError(err) {
-			input, err = lookupTXT(domain)
-			if err != nil {
-				return
-			}
-			fallback = true
+		return
+	}
+	ctx, lookupLog := withLookupLog(ctx)
+	var fallback *LogStatement
+	query := dnsPrefix + domain
+	source := SourcePrefixed
+	if r.LookupMode == BareOnly {
+		query = domain
+		source = SourceBare
+	}
+	input, err := r.queryTXT(ctx, lookupTXT, query, source)
+	if r.LookupMode != PrefixThenBare {
+		if err != nil {
+			return
+		}
+	} else if err != nil {
+		if IsNXDomain(err) {
+			fallback = &LogStatement{Code: "FALLBACK"}
+		} else if r.FallbackOnServFail && IsServFail(err) {
+			fallback = &LogStatement{Code: "FALLBACK", Reason: "SERVFAIL"}
 		} else {
 			return
 		}
+	} else if r.FallbackOnNoData && len(input) == 0 {
+		fallback = &LogStatement{Code: "FALLBACK", Reason: "NODATA"}
+	}
+	if fallback != nil {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		query = domain
+		source = SourceBare
+		input, err = r.queryTXT(ctx, lookupTXT, query, source)
+		if err != nil {
+			return
+		}
+	}
+	accepted, prepareLog := r.prepareEntries(input)
+	process := processEntries
+	if r.FastParse {
+		process = processEntriesFast
+	}
+	links, txtEntries, log, namespaces := process(accepted)
+	if r.MaxInvalidRatio > 0 {
+		if err = checkInvalidRatio(domain, accepted, log, r.MaxInvalidRatio); err != nil {
+			return
+		}
 	}
-	links, txtEntries, log := processEntries(input)
-	if fallback {
-		log = append([]LogStatement{{Code: "FALLBACK"}}, log...)
+	log = append(append(lookupLog.all(), prepareLog...), log...)
+	if fallback != nil {
+		log = append([]LogStatement{*fallback}, log...)
+		if len(links) > 0 {
+			if r.RequirePrefix {
+				err = NoPrefixedRecordError{Domain: domain}
+				return
+			}
+			if r.WarnNoPrefix {
+				log = append(log, LogStatement{Code: "NO_PREFIXED_RECORD", Entry: domain})
+			}
+		}
+	}
+	for _, entries := range links {
+		for index := range entries {
+			entries[index].Source = source
+		}
+	}
+	for index := range txtEntries {
+		txtEntries[index].Source = source
+	}
+	if r.Diagnostics {
+		log = append(log, diagnoseEntries(input)...)
+	}
+	if r.TraceDecoding {
+		log = append(log, traceEntries(input)...)
 	}
 	result.Log = log
 	result.Links = links
 	result.TxtEntries = txtEntries
+	result.namespaces = namespaces
+	result.Authenticated = lookupLog.isAuthenticated()
+	result.Query = query
+	if r.Provenance {
+		result.Provenance = r.provenance(input, query, source, lookupLog.lastServer())
+	}
+	if r.ComputeRegistrable {
+		result.RegistrableDomain, _ = publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	}
 	return
 }
 
-func isNotFoundError(err error) bool {
-	switch e := err.(type) {
-	default:
-		return false
-	case DNSRCodeError:
-		return e.DNSRCode == 3
+// AsDNSRCodeError returns the DNSRCodeError in the chain of err, also if it
+// was wrapped by a custom lookup.
+func AsDNSRCodeError(err error) (DNSRCodeError, bool) {
+	var rcodeErr DNSRCodeError
+	if errors.As(err, &rcodeErr) {
+		return rcodeErr, true
 	}
+	return DNSRCodeError{}, false
+}
+
+// IsNXDomain reports whether the lookup failed because the domain doesn't
+// exist.
+func IsNXDomain(err error) bool {
+	rcodeErr, ok := AsDNSRCodeError(err)
+	return ok && rcodeErr.DNSRCode == dns.RcodeNameError
+}
+
+// IsServFail reports whether the lookup failed because the name server
+// couldn't process the query.
+func IsServFail(err error) bool {
+	rcodeErr, ok := AsDNSRCodeError(err)
+	return ok && rcodeErr.DNSRCode == dns.RcodeServerFailure
+}
+
+// ValidateDomain checks if the domain could be resolved, without looking it
+// up. The _dnslink. prefix and a trailing dot are ignored, like in Resolve.
+// The error is the same that Resolve returns for the domain, e.g. TOO_LONG,
+// EMPTY_PART or INVALID_IDN. Internationalized domains are validated in their
+// punycode form.
+func ValidateDomain(domain string) error {
+	return testFqnd(toASCII(trimDomain(domain)))
 }
 
 func testFqnd(domain string) error {
+	if !isASCII(domain) {
+		return errors.New("INVALID_IDN")
+	}
 	if len(domain) > 253-9 /* len("_dnslink.") */ {
 		return errors.New("TOO_LONG")
 	}
@@ -359,9 +1524,10 @@ func testFqnd(domain string) error {
 	return nil
 }
 
-func processEntries(input []LookupEntry) (map[string]NamespaceEntries, []TxtEntry, []LogStatement) {
+func processEntries(input []LookupEntry) (map[string]NamespaceEntries, []TxtEntry, []LogStatement, []string) {
 	log := []LogStatement{}[:]
 	found := make(map[string]NamespaceEntries)
+	order := []string{}[:]
 	for _, entry := range input {
 		if !strings.HasPrefix(entry.Value, txtPrefix) {
 			continue
@@ -373,9 +1539,10 @@ func processEntries(input []LookupEntry) (map[string]NamespaceEntries, []TxtEntr
 			continue
 		}
 		list, hasList := found[key]
-		processed := NamespaceEntry{value, entry.Ttl}
+		processed := NamespaceEntry{Identifier: value, Ttl: entry.Ttl}
 		if !hasList {
 			found[key] = []NamespaceEntry{processed}
+			order = append(order, key)
 		} else {
 			found[key] = append(list, processed)
 		}
@@ -395,34 +1562,248 @@ func processEntries(input []LookupEntry) (map[string]NamespaceEntries, []TxtEntr
 		}
 	}
 
-	return found, txtEntries, log
+	return found, txtEntries, log, order
+}
+
+// processEntriesFast is processEntries without sorting, see
+// Resolver.FastParse.
+func processEntriesFast(input []LookupEntry) (map[string]NamespaceEntries, []TxtEntry, []LogStatement, []string) {
+	log := []LogStatement{}
+	found := make(map[string]NamespaceEntries, 1)
+	order := make([]string, 0, 1)
+	txtEntries := make([]TxtEntry, 0, len(input))
+	for _, entry := range input {
+		if !strings.HasPrefix(entry.Value, txtPrefix) {
+			continue
+		}
+		key, value, reason := validateDNSLinkEntry(entry.Value)
+		if reason != "" {
+			log = append(log, LogStatement{Code: "INVALID_ENTRY", Entry: entry.Value, Reason: reason})
+			continue
+		}
+		list, hasList := found[key]
+		if !hasList {
+			order = append(order, key)
+		}
+		found[key] = append(list, NamespaceEntry{Identifier: value, Ttl: entry.Ttl})
+		// The entry already has the /<ns>/<identifier> form.
+		txtEntries = append(txtEntries, TxtEntry{Value: entry.Value[len(txtPrefix):], Ttl: entry.Ttl})
+	}
+	return found, txtEntries, log, order
+}
+
+// Values longer than this are unusual for dnslink entries and likely indicate
+// a problem with the publishing tooling.
+const longEntryLength = 1024
+
+// diagnoseEntries notes dnslink entries that are split into multiple
+// character-strings or that are unusually long.
+func diagnoseEntries(input []LookupEntry) []LogStatement {
+	log := []LogStatement{}
+	for _, entry := range input {
+		if !strings.HasPrefix(entry.Value, txtPrefix) {
+			continue
+		}
+		if len(entry.Chunks) > 1 {
+			log = append(log, LogStatement{Code: "CHUNKED_ENTRY", Entry: entry.Value})
+		}
+		if len(entry.Value) > longEntryLength {
+			log = append(log, LogStatement{Code: "LONG_ENTRY", Entry: entry.Value})
+		}
+	}
+	return log
+}
+
+// traceEntries describes how the entries were decoded. The entry holds the
+// decoded value, the reason the received character-strings and the hex
+// bytes of the value, e.g. `chunks="a\032b" hex=612062`.
+func traceEntries(input []LookupEntry) []LogStatement {
+	log := []LogStatement{}
+	for _, entry := range input {
+		chunks := entry.Chunks
+		if chunks == nil {
+			chunks = []string{entry.Value}
+		}
+		quoted := make([]string, len(chunks))
+		for index, chunk := range chunks {
+			quoted[index] = `"` + chunk + `"`
+		}
+		log = append(log, LogStatement{
+			Code:   "DECODED_ENTRY",
+			Entry:  entry.Value,
+			Reason: "chunks=" + strings.Join(quoted, " ") + " hex=" + hex.EncodeToString([]byte(entry.Value)),
+		})
+	}
+	return log
+}
+
+// limitIdentifiers drops the dnslink entries with identifiers longer than max
+// bytes. A max of zero keeps all entries.
+func limitIdentifiers(input []LookupEntry, max int) ([]LookupEntry, []LogStatement) {
+	log := []LogStatement{}
+	if max <= 0 {
+		return input, log
+	}
+	accepted := []LookupEntry{}
+	for _, entry := range input {
+		if strings.HasPrefix(entry.Value, txtPrefix) {
+			_, identifier, reason := validateDNSLinkEntry(entry.Value)
+			if reason == "" && len(identifier) > max {
+				log = append(log, LogStatement{Code: "IDENTIFIER_TOO_LONG", Entry: entry.Value})
+				continue
+			}
+		}
+		accepted = append(accepted, entry)
+	}
+	return accepted, log
+}
+
+// prepareEntries applies the options that change or drop entries before they
+// are parsed.
+func (r *Resolver) prepareEntries(input []LookupEntry) ([]LookupEntry, []LogStatement) {
+	log := []LogStatement{}
+	var stepLog []LogStatement
+	if r.StripComments {
+		input, stepLog = stripComments(input)
+		log = append(log, stepLog...)
+	}
+	input, stepLog = limitIdentifiers(input, r.MaxIdentifierLength)
+	log = append(log, stepLog...)
+	if r.CaseInsensitiveNamespaces {
+		input, stepLog = lowerNamespaces(input)
+		log = append(log, stepLog...)
+	}
+	if !r.KeepDuplicateEntries {
+		input, stepLog = dedupeEntries(input)
+		log = append(log, stepLog...)
+	}
+	return input, log
+}
+
+// dedupeEntries drops valid dnslink entries that are equal to an earlier
+// entry, which gets the larger ttl of both, and logs a DUPLICATE_ENTRY
+// statement for every dropped entry. It runs after the other steps, so that
+// entries that only differed in their namespace case or comment are merged.
+func dedupeEntries(input []LookupEntry) ([]LookupEntry, []LogStatement) {
+	log := []LogStatement{}
+	result := make([]LookupEntry, 0, len(input))
+	seen := map[string]int{}
+	for _, entry := range input {
+		if strings.HasPrefix(entry.Value, txtPrefix) {
+			if _, _, reason := validateDNSLinkEntry(entry.Value); reason == "" {
+				if index, ok := seen[entry.Value]; ok {
+					if entry.Ttl > result[index].Ttl {
+						result[index].Ttl = entry.Ttl
+					}
+					log = append(log, LogStatement{Code: "DUPLICATE_ENTRY", Entry: entry.Value})
+					continue
+				}
+				seen[entry.Value] = len(result)
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, log
+}
+
+// stripComments removes trailing " #" comments and spaces from the dnslink
+// entries and logs a COMMENT_STRIPPED statement with the original entry for
+// every change.
+func stripComments(input []LookupEntry) ([]LookupEntry, []LogStatement) {
+	log := []LogStatement{}
+	result := make([]LookupEntry, len(input))
+	for index, entry := range input {
+		result[index] = entry
+		if !strings.HasPrefix(entry.Value, txtPrefix) {
+			continue
+		}
+		value := entry.Value
+		if comment := strings.Index(value, " #"); comment != -1 {
+			value = value[:comment]
+		}
+		value = strings.TrimRight(value, " ")
+		if value == entry.Value {
+			continue
+		}
+		log = append(log, LogStatement{Code: "COMMENT_STRIPPED", Entry: entry.Value})
+		result[index].Value = value
+	}
+	return result, log
+}
+
+// lowerNamespaces lowercases the namespace of the valid dnslink entries and
+// logs a NAMESPACE_CASE statement with the original entry for every change.
+func lowerNamespaces(input []LookupEntry) ([]LookupEntry, []LogStatement) {
+	log := []LogStatement{}
+	result := make([]LookupEntry, len(input))
+	for index, entry := range input {
+		result[index] = entry
+		if !strings.HasPrefix(entry.Value, txtPrefix) {
+			continue
+		}
+		namespace, identifier, reason := validateDNSLinkEntry(entry.Value)
+		lower := strings.ToLower(namespace)
+		if reason != "" || lower == namespace {
+			continue
+		}
+		log = append(log, LogStatement{Code: "NAMESPACE_CASE", Entry: entry.Value})
+		result[index].Value = txtPrefix + "/" + lower + "/" + identifier
+	}
+	return result, log
 }
 
 // https://datatracker.ietf.org/doc/html/rfc4343#section-2.1
 var entryCharset = regexp.MustCompile("^[\u0020-\u007e]+$")
 
-func validateDNSLinkEntry(entry string) (namespace string, identifier string, reason string) {
-	entry = entry[len(txtPrefix):]
+// InvalidEntryError is returned by ParseDNSLinkEntry for values that are not
+// valid DNSLink entries. The Reason is one of the codes of INVALID_ENTRY log
+// statements: WRONG_START, INVALID_CHARACTER, NAMESPACE_MISSING or
+// NO_IDENTIFIER.
+type InvalidEntryError struct {
+	Entry  string `json:"entry"`
+	Reason string `json:"reason"`
+}
+
+func (e InvalidEntryError) Error() string {
+	return fmt.Sprintf("INVALID_ENTRY (reason=%s, entry=%s)", e.Reason, e.Entry)
+}
+
+// ParseDNSLinkEntry parses a DNSLink entry like the resolver does, without a
+// DNS query, e.g. to check the entries of a zone file. The value may start
+// with dnslink=, like a TXT record, or with the path, like TxtEntry.Value.
+// Invalid entries return an InvalidEntryError.
+func ParseDNSLinkEntry(value string) (namespace string, identifier string, err error) {
+	entry := strings.TrimPrefix(value, txtPrefix)
+	fail := func(reason string) (string, string, error) {
+		return "", "", InvalidEntryError{Entry: value, Reason: reason}
+	}
 	if !strings.HasPrefix(entry, "/") {
-		return "", "", "WRONG_START"
+		return fail("WRONG_START")
 	}
 	if !entryCharset.MatchString(entry) {
-		return "", "", "INVALID_CHARACTER"
+		return fail("INVALID_CHARACTER")
 	}
 	parts := strings.Split(entry, "/")[1:]
-	if len(parts) == 0 {
-		return "", "", "NAMESPACE_MISSING"
-	}
 	namespace = parts[0]
 	if namespace == "" {
-		return "", "", "NAMESPACE_MISSING"
+		return fail("NAMESPACE_MISSING")
 	}
 	if len(parts) == 1 {
-		return "", "", "NO_IDENTIFIER"
+		return fail("NO_IDENTIFIER")
 	}
 	identifier = strings.Join(parts[1:], "/")
 	if identifier == "" {
-		return "", "", "NO_IDENTIFIER"
+		return fail("NO_IDENTIFIER")
+	}
+	return namespace, identifier, nil
+}
+
+// validateDNSLinkEntry parses a TXT entry that starts with dnslink= and
+// returns the reason of an InvalidEntryError instead of the error.
+func validateDNSLinkEntry(entry string) (namespace string, identifier string, reason string) {
+	namespace, identifier, err := ParseDNSLinkEntry(entry)
+	if err != nil {
+		return "", "", err.(InvalidEntryError).Reason
 	}
 	return namespace, identifier, ""
 }
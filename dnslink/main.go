@@ -1,327 +1,1795 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf16"
 
 	dnslink "github.com/dnslink-std/go"
+	dns "github.com/miekg/dns"
 )
 
 type WriteOptions struct {
-	domains  []string
-	debug    bool
-	err      *log.Logger
-	out      *log.Logger
-	firstNS  interface{}
-	searchNS interface{}
-	ttl      bool
+	domains []string
+	debug   bool
+	err     io.Writer
+	out     io.Writer
+	// namespace only renders the links of that namespace if set, from --ns
+	// or --first=<ns>.
+	namespace string
+	// first only renders the first entry of every rendered namespace.
+	first bool
+	ttl   bool
+	// delimiter separates the fields of csv output, defaults to ","
+	delimiter string
+	// timestamp is rendered with every result if set
+	timestamp time.Time
+	// stripNS renders identifiers without their /<ns>/ path. The json output
+	// then is an object of the identifiers keyed by namespace, the txt output
+	// only the identifiers, which can't be told apart with multiple
+	// namespaces.
+	stripNS bool
+	// pretty indents the json output, which is rendered with one line per
+	// lookup otherwise.
+	pretty bool
+	// includeEmpty renders a csv row without namespace and identifier for
+	// lookups without links. The json output always has an object per lookup.
+	includeEmpty bool
+	// humanTtl renders ttls as durations like 1h30m instead of seconds.
+	humanTtl bool
+	// stdin is set if the domains are read from stdin, their number is
+	// unknown while the output is rendered.
+	stdin bool
+}
+
+// includes reports whether the links of the namespace are rendered.
+func (options *WriteOptions) includes(ns string) bool {
+	return options.namespace == "" || options.namespace == ns
+}
+
+// entries returns the entries of a namespace that are rendered.
+func (options *WriteOptions) entries(entries []dnslink.NamespaceEntry) []dnslink.NamespaceEntry {
+	if options.first && len(entries) > 1 {
+		return entries[:1]
+	}
+	return entries
+}
+
+// multiple reports whether the output contains several lookups, which are
+// then rendered with their domain.
+func (options *WriteOptions) multiple() bool {
+	return options.stdin || len(options.domains) > 1
+}
+
+func (options *WriteOptions) time() string {
+	return options.timestamp.Format(time.RFC3339)
+}
+
+// formatTtl returns the ttl in seconds or, with humanTtl, as a duration
+// string without trailing zero units.
+func (options *WriteOptions) formatTtl(ttl uint32) interface{} {
+	if !options.humanTtl {
+		return ttl
+	}
+	return humanDuration(time.Duration(ttl) * time.Second)
+}
+
+// humanDuration formats the duration like time.Duration but drops trailing
+// zero units: 1h30m instead of 1h30m0s.
+func humanDuration(duration time.Duration) string {
+	text := duration.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = text[:len(text)-2]
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = text[:len(text)-2]
+	}
+	return text
+}
+
+type humanNamespaceEntry struct {
+	Identifier string `json:"identifier"`
+	Ttl        string `json:"ttl"`
+}
+
+type humanTxtEntry struct {
+	Value string `json:"value"`
+	Ttl   string `json:"ttl"`
+}
+
+// humanLinks returns the links with their ttls formatted as durations.
+func humanLinks(links map[string]dnslink.NamespaceEntries) map[string][]humanNamespaceEntry {
+	result := map[string][]humanNamespaceEntry{}
+	for ns, entries := range links {
+		human := make([]humanNamespaceEntry, len(entries))
+		for index, entry := range entries {
+			human[index] = humanNamespaceEntry{entry.Identifier, humanDuration(time.Duration(entry.Ttl) * time.Second)}
+		}
+		result[ns] = human
+	}
+	return result
+}
+
+// humanTxtEntries returns the txt entries with their ttls formatted as
+// durations.
+func humanTxtEntries(entries []dnslink.TxtEntry) []humanTxtEntry {
+	result := make([]humanTxtEntry, len(entries))
+	for index, entry := range entries {
+		result[index] = humanTxtEntry{entry.Value, humanDuration(time.Duration(entry.Ttl) * time.Second)}
+	}
+	return result
+}
+
+type flusher interface {
+	Flush() error
+}
+
+type httpFlusher interface {
+	Flush()
+}
+
+func flush(writer io.Writer) {
+	switch f := writer.(type) {
+	case flusher:
+		if err := f.Flush(); err != nil {
+			// The consumer went away (e.g. `dnslink ... | head -1`), there is
+			// no point in writing anything else.
+			os.Exit(1)
+		}
+	case httpFlusher:
+		f.Flush()
+	}
+}
+
+// flush passes everything written so far on to the consumer, so results
+// are streamed per record rather than at the end of the run.
+func (options *WriteOptions) flush() {
+	flush(options.out)
+	flush(options.err)
 }
 
 type Writer interface {
 	write(lookup string, result dnslink.Result)
+	// fail reports a lookup that could not be resolved on the err output,
+	// also without debug.
+	fail(lookup string, err error)
 	end()
 }
 
-type WriteJSON struct {
-	firstOut bool
-	firstErr bool
-	options  WriteOptions
-}
+// failure is the log statement that reports a failed lookup.
+func failure(lookup string, err error) dnslink.LogStatement {
+	return dnslink.LogStatement{Code: "ERROR", Entry: lookup, Reason: err.Error()}
+}
+
+type WriteJSON struct {
+	firstOut bool
+	firstErr bool
+	options  WriteOptions
+	outJSON  *json.Encoder
+	errJSON  *json.Encoder
+}
+
+func NewWriteJSON(options WriteOptions) *WriteJSON {
+	write := WriteJSON{
+		firstOut: true,
+		firstErr: true,
+		options:  options,
+		outJSON:  json.NewEncoder(options.out),
+		errJSON:  json.NewEncoder(options.err),
+	}
+	if options.pretty {
+		write.outJSON.SetIndent("", "  ")
+		write.errJSON.SetIndent("", "  ")
+	}
+	if options.multiple() {
+		fmt.Fprintln(options.out, "[")
+	}
+	if options.debug {
+		fmt.Fprintln(options.err, "[")
+	}
+	options.flush()
+	return &write
+}
+
+func (write *WriteJSON) write(lookup string, result dnslink.Result) {
+	out := write.options.out
+	prefix := ""
+	if write.firstOut {
+		write.firstOut = false
+	} else {
+		prefix = ","
+	}
+
+	outLine := jsonResult(write.options, result)
+	if write.options.multiple() {
+		outLine["lookup"] = lookup
+	}
+
+	io.WriteString(out, prefix)
+	if error := write.outJSON.Encode(outLine); error != nil {
+		panic(error)
+	}
+	if write.options.debug {
+		for _, statement := range result.Log {
+			write.writeLog(lookup, statement)
+		}
+	}
+	write.options.flush()
+}
+
+// jsonResult is the json object of a result, without the lookup. With
+// stripNS the links are the object itself, keyed by namespace, e.g.
+// {"ipfs":["Qm..."]}, without the txtEntries.
+func jsonResult(options WriteOptions, result dnslink.Result) map[string]interface{} {
+	links := map[string]interface{}{}
+	var txtEntries interface{}
+	if options.ttl && options.humanTtl {
+		for ns, entries := range humanLinks(result.Links) {
+			links[ns] = entries
+		}
+		txtEntries = humanTxtEntries(result.TxtEntries)
+	} else if options.ttl {
+		for ns, entries := range result.Links {
+			links[ns] = entries
+		}
+		txtEntries = result.TxtEntries
+	} else {
+		values := result.Values()
+		for ns, identifiers := range values.Links {
+			links[ns] = identifiers
+		}
+		txtEntries = values.TxtEntries
+	}
+	outLine := links
+	if !options.stripNS {
+		outLine = map[string]interface{}{
+			"links":      links,
+			"txtEntries": txtEntries,
+		}
+	}
+	if !options.timestamp.IsZero() {
+		outLine["time"] = options.time()
+	}
+	return outLine
+}
+
+// jsonLog is the json object of a log statement, without the lookup.
+func jsonLog(statement dnslink.LogStatement) map[string]interface{} {
+	errLine := map[string]interface{}{
+		"code": statement.Code,
+	}
+	if statement.Entry != "" {
+		errLine["entry"] = statement.Entry
+	}
+	if statement.Reason != "" {
+		errLine["reason"] = statement.Reason
+	}
+	return errLine
+}
+
+func (write *WriteJSON) writeLog(lookup string, statement dnslink.LogStatement) {
+	prefix := ""
+	if write.firstErr {
+		write.firstErr = false
+	} else {
+		prefix = ","
+	}
+	errLine := jsonLog(statement)
+	if write.options.multiple() {
+		errLine["lookup"] = lookup
+	}
+	io.WriteString(write.options.err, prefix)
+	if error := write.errJSON.Encode(errLine); error != nil {
+		panic(error)
+	}
+}
+
+// fail renders the failure like a log statement. Without debug the err
+// output isn't a json array, every failure is a line of json.
+func (write *WriteJSON) fail(lookup string, err error) {
+	if !write.options.debug {
+		write.firstErr = true
+	}
+	write.writeLog(lookup, failure(lookup, err))
+	write.options.flush()
+}
+
+func (write *WriteJSON) end() {
+	if write.options.multiple() {
+		fmt.Fprintln(write.options.out, "]")
+	}
+	if write.options.debug {
+		fmt.Fprintln(write.options.err, "]")
+	}
+	write.options.flush()
+}
+
+// WriteJSONLines renders every result as a compact json object on its own
+// line (ndjson), without framing, so that the output can be processed line
+// by line. Every object contains its lookup, also for a single domain. The
+// log statements are rendered the same way.
+type WriteJSONLines struct {
+	options WriteOptions
+	outJSON *json.Encoder
+	errJSON *json.Encoder
+}
+
+func NewWriteJSONLines(options WriteOptions) *WriteJSONLines {
+	return &WriteJSONLines{
+		options: options,
+		outJSON: json.NewEncoder(options.out),
+		errJSON: json.NewEncoder(options.err),
+	}
+}
+
+func (write *WriteJSONLines) write(lookup string, result dnslink.Result) {
+	outLine := jsonResult(write.options, result)
+	outLine["lookup"] = lookup
+	if error := write.outJSON.Encode(outLine); error != nil {
+		panic(error)
+	}
+	if write.options.debug {
+		for _, statement := range result.Log {
+			write.writeLog(lookup, statement)
+		}
+	}
+	write.options.flush()
+}
+
+func (write *WriteJSONLines) writeLog(lookup string, statement dnslink.LogStatement) {
+	errLine := jsonLog(statement)
+	errLine["lookup"] = lookup
+	if error := write.errJSON.Encode(errLine); error != nil {
+		panic(error)
+	}
+}
+
+func (write *WriteJSONLines) fail(lookup string, err error) {
+	write.writeLog(lookup, failure(lookup, err))
+	write.options.flush()
+}
+
+func (write *WriteJSONLines) end() {
+	write.options.flush()
+}
+
+type WriteTXT struct {
+	firstOut bool
+	firstErr bool
+	options  WriteOptions
+}
+
+func NewWriteTXT(options WriteOptions) *WriteTXT {
+	return &WriteTXT{
+		firstOut: true,
+		firstErr: true,
+		options:  options,
+	}
+}
+
+func (write *WriteTXT) write(lookup string, result dnslink.Result) {
+	out := write.options.out
+	prefix := ""
+	if write.options.multiple() {
+		prefix = lookup + ": "
+	}
+	if !write.options.timestamp.IsZero() {
+		prefix = write.options.time() + " " + prefix
+	}
+	for ns, values := range result.Links {
+		if !write.options.includes(ns) {
+			continue
+		}
+		for _, entry := range write.options.entries(values) {
+			identifier := entry.Identifier
+			if write.options.ttl {
+				identifier += " [ttl=" + fmt.Sprint(write.options.formatTtl(entry.Ttl)) + "]"
+			}
+
+			if write.options.namespace != "" || write.options.stripNS {
+				fmt.Fprintln(out, prefix+identifier)
+			} else {
+				fmt.Fprintln(out, prefix+"/"+ns+"/"+identifier)
+			}
+		}
+	}
+	if write.options.debug {
+		for _, logEntry := range result.Log {
+			writeTXTLog(write.options.err, logEntry)
+		}
+	}
+	write.options.flush()
+}
+
+// writeTXTLog renders a log statement as a line like
+// [CODE] Description. entry=... reason=...
+func writeTXTLog(err io.Writer, logEntry dnslink.LogStatement) {
+	optional := ""
+	if logEntry.Entry != "" {
+		optional += " entry=" + logEntry.Entry
+	}
+	if logEntry.Reason != "" {
+		optional += " reason=" + logEntry.Reason
+	}
+	description := dnslink.DescribeLogCode(logEntry.Reason)
+	if description == "" {
+		description = dnslink.DescribeLogCode(logEntry.Code)
+	}
+	if description != "" {
+		description = " " + description
+	}
+	fmt.Fprintln(err, "["+logEntry.Code+"]"+description+optional)
+}
+
+func (write *WriteTXT) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+func (write *WriteTXT) end() {}
+
+type WriteCSV struct {
+	firstOut bool
+	firstErr bool
+	options  WriteOptions
+}
+
+func NewWriteCSV(options WriteOptions) *WriteCSV {
+	return &WriteCSV{
+		firstOut: true,
+		firstErr: true,
+		options:  options,
+	}
+}
+
+func (write *WriteCSV) write(lookup string, result dnslink.Result) {
+	out := write.options.out
+	if write.firstOut {
+		write.firstOut = false
+		header := []string{"lookup", "namespace", "identifier"}
+		if !write.options.timestamp.IsZero() {
+			header = append([]string{"time"}, header...)
+		}
+		if write.options.ttl {
+			header = append(header, "ttl")
+		}
+		fmt.Fprintln(out, strings.Join(header, write.delimiter()))
+	}
+	rows := 0
+	for ns, values := range result.Links {
+		if !write.options.includes(ns) {
+			continue
+		}
+		for _, value := range write.options.entries(values) {
+			fields := []interface{}{lookup, ns, value.Identifier}
+			if !write.options.timestamp.IsZero() {
+				fields = append([]interface{}{write.options.time()}, fields...)
+			}
+			if write.options.ttl {
+				fields = append(fields, write.options.formatTtl(value.Ttl))
+			}
+			line := csvDelimited(write.delimiter(), fields...)
+			fmt.Fprintln(out, line)
+			rows++
+		}
+	}
+	if rows == 0 && write.options.includeEmpty {
+		fields := []interface{}{lookup, nil, nil}
+		if !write.options.timestamp.IsZero() {
+			fields = append([]interface{}{write.options.time()}, fields...)
+		}
+		if write.options.ttl {
+			fields = append(fields, nil)
+		}
+		fmt.Fprintln(out, csvDelimited(write.delimiter(), fields...))
+	}
+	if write.options.debug {
+		for _, logEntry := range result.Log {
+			write.writeLog(logEntry)
+		}
+	}
+	write.options.flush()
+}
+
+func (write *WriteCSV) writeLog(logEntry dnslink.LogStatement) {
+	err := write.options.err
+	if write.firstErr {
+		write.firstErr = false
+		fmt.Fprintln(err, strings.Join([]string{"code", "entry", "reason"}, write.delimiter()))
+	}
+	fmt.Fprintln(err, csvDelimited(write.delimiter(), logEntry.Code, logEntry.Entry, logEntry.Reason))
+}
+
+func (write *WriteCSV) fail(lookup string, err error) {
+	write.writeLog(failure(lookup, err))
+	write.options.flush()
+}
+
+func (write *WriteCSV) delimiter() string {
+	if write.options.delimiter == "" {
+		return ","
+	}
+	return write.options.delimiter
+}
+
+func csv(rest ...interface{}) string {
+	return csvDelimited(",", rest...)
+}
+
+// csvDelimited renders one csv line. Strings are always quoted, so they may
+// contain the delimiter.
+func csvDelimited(delimiter string, rest ...interface{}) string {
+	result := ""
+	prefix := ""
+	for _, entry := range rest {
+		value := ""
+		switch v := entry.(type) {
+		case int, uint32:
+			value = fmt.Sprint(v)
+		case bool:
+			if v {
+				value = "true"
+			} else {
+				value = "false"
+			}
+		case string:
+			value = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		result += prefix + value
+		prefix = delimiter
+	}
+	return result
+}
+
+func (write *WriteCSV) end() {}
+
+type WriteFingerprint struct {
+	options WriteOptions
+}
+
+func NewWriteFingerprint(options WriteOptions) *WriteFingerprint {
+	return &WriteFingerprint{
+		options: options,
+	}
+}
+
+func (write *WriteFingerprint) write(lookup string, result dnslink.Result) {
+	prefix := ""
+	if write.options.multiple() {
+		prefix = lookup + ": "
+	}
+	if !write.options.timestamp.IsZero() {
+		prefix = write.options.time() + " " + prefix
+	}
+	fmt.Fprintln(write.options.out, prefix+result.Fingerprint())
+	write.options.flush()
+}
+
+func (write *WriteFingerprint) end() {}
+
+func (write *WriteFingerprint) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+// WriteEnv renders the links as shell variable assignments that can be
+// evaluated, like DNSLINK_IPFS='QmXNosdf...'. Names that were already used,
+// by further entries of a namespace or by other lookups, get an index suffix.
+type WriteEnv struct {
+	used    map[string]bool
+	options WriteOptions
+}
+
+func NewWriteEnv(options WriteOptions) *WriteEnv {
+	return &WriteEnv{
+		used:    map[string]bool{},
+		options: options,
+	}
+}
+
+var envInvalid = regexp.MustCompile("[^A-Z0-9_]")
+
+func (write *WriteEnv) name(ns string) string {
+	base := "DNSLINK_" + envInvalid.ReplaceAllString(strings.ToUpper(ns), "_")
+	name := base
+	for index := 1; write.used[name]; index++ {
+		name = base + "_" + fmt.Sprint(index)
+	}
+	write.used[name] = true
+	return name
+}
+
+func (write *WriteEnv) write(lookup string, result dnslink.Result) {
+	for _, ns := range result.OrderedNamespaces() {
+		if !write.options.includes(ns) {
+			continue
+		}
+		for _, entry := range write.options.entries(result.Links[ns]) {
+			fmt.Fprintln(write.options.out, write.name(ns)+"="+shellQuote(entry.Identifier))
+		}
+	}
+	write.options.flush()
+}
+
+func (write *WriteEnv) end() {}
+
+func (write *WriteEnv) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+// shellQuote wraps the value in single quotes for POSIX shells.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// WriteIPFS renders the links as ipfs commands that can be piped to a shell:
+// ipfs pin add for /ipfs/ entries and ipfs name resolve for /ipns/ entries.
+// Entries of other namespaces are listed as comments.
+type WriteIPFS struct {
+	options WriteOptions
+}
+
+func NewWriteIPFS(options WriteOptions) *WriteIPFS {
+	return &WriteIPFS{
+		options: options,
+	}
+}
+
+func (write *WriteIPFS) write(lookup string, result dnslink.Result) {
+	for _, ns := range result.OrderedNamespaces() {
+		if !write.options.includes(ns) {
+			continue
+		}
+		for _, entry := range write.options.entries(result.Links[ns]) {
+			path := "/" + ns + "/" + entry.Identifier
+			switch ns {
+			case "ipfs":
+				fmt.Fprintln(write.options.out, "ipfs pin add "+shellQuote(path))
+			case "ipns":
+				fmt.Fprintln(write.options.out, "ipfs name resolve "+shellQuote(path))
+			default:
+				fmt.Fprintln(write.options.out, "# skipped "+path+" of "+lookup)
+			}
+		}
+	}
+	write.options.flush()
+}
+
+func (write *WriteIPFS) end() {}
+
+func (write *WriteIPFS) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+// WriteProperties renders the links as java properties, like
+// dnslink.dev.ipfs=QmXNosdf... Namespaces with several entries get an index
+// suffix: dnslink.dev.ipfs.0=..., dnslink.dev.ipfs.1=...
+type WriteProperties struct {
+	options WriteOptions
+}
+
+func NewWriteProperties(options WriteOptions) *WriteProperties {
+	return &WriteProperties{
+		options: options,
+	}
+}
+
+func (write *WriteProperties) write(lookup string, result dnslink.Result) {
+	for _, ns := range result.OrderedNamespaces() {
+		if !write.options.includes(ns) {
+			continue
+		}
+		entries := write.options.entries(result.Links[ns])
+		for index, entry := range entries {
+			key := lookup + "." + ns
+			if len(entries) > 1 {
+				key += "." + fmt.Sprint(index)
+			}
+			fmt.Fprintln(write.options.out, propertiesEscape(key, true)+"="+propertiesEscape(entry.Identifier, false))
+		}
+	}
+	write.options.flush()
+}
+
+func (write *WriteProperties) end() {}
+
+func (write *WriteProperties) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+// propertiesEscape escapes the characters that have a meaning in java
+// properties files. Spaces only need to be escaped in keys and at the start
+// of values.
+func propertiesEscape(value string, key bool) string {
+	escaped := strings.Builder{}
+	for index, char := range value {
+		switch char {
+		case '\\', '=', ':', '#', '!':
+			escaped.WriteString("\\" + string(char))
+		case ' ':
+			if key || index == 0 {
+				escaped.WriteString("\\ ")
+			} else {
+				escaped.WriteRune(char)
+			}
+		default:
+			if char > 0xffff {
+				high, low := utf16.EncodeRune(char)
+				escaped.WriteString(fmt.Sprintf("\\u%04x\\u%04x", high, low))
+			} else if char < 0x20 || char > 0x7e {
+				escaped.WriteString(fmt.Sprintf("\\u%04x", char))
+			} else {
+				escaped.WriteRune(char)
+			}
+		}
+	}
+	return escaped.String()
+}
+
+// ChangeFilter remembers the last result per lookup to tell if the links of
+// a lookup changed between repeated resolutions.
+type ChangeFilter struct {
+	previous map[string]dnslink.Result
+}
+
+func NewChangeFilter() *ChangeFilter {
+	return &ChangeFilter{
+		previous: map[string]dnslink.Result{},
+	}
+}
+
+// changed reports whether the links of a lookup differ from the result it
+// was last called with. The first result of a lookup counts as a change.
+func (filter *ChangeFilter) changed(lookup string, result dnslink.Result) bool {
+	previous, hasPrevious := filter.previous[lookup]
+	filter.previous[lookup] = result
+	if !hasPrevious {
+		return true
+	}
+	diff := dnslink.DiffResults(previous, result)
+	return diff.Changed()
+}
+
+// preferred reduces the result to the first namespace of the order that has
+// entries.
+func preferred(result dnslink.Result, order []string) dnslink.Result {
+	reduced := dnslink.Result{
+		TxtEntries: []dnslink.TxtEntry{},
+		Links:      map[string]dnslink.NamespaceEntries{},
+		Log:        result.Log,
+	}
+	ns, entries, ok := result.PreferNamespaces(order...)
+	if !ok {
+		return reduced
+	}
+	reduced.Links[ns] = entries
+	for _, txtEntry := range result.TxtEntries {
+		if strings.HasPrefix(txtEntry.Value, "/"+ns+"/") {
+			reduced.TxtEntries = append(reduced.TxtEntries, txtEntry)
+		}
+	}
+	return reduced
+}
+
+var formats []interface{} = []interface{}{"json", "ndjson", "txt", "csv", "env", "dig", "properties", "ipfs"}
+
+func newWriter(format string, options WriteOptions) Writer {
+	if format == "txt" {
+		return NewWriteTXT(options)
+	} else if format == "csv" {
+		return NewWriteCSV(options)
+	} else if format == "env" {
+		return NewWriteEnv(options)
+	} else if format == "dig" {
+		return NewWriteDig(options)
+	} else if format == "properties" {
+		return NewWriteProperties(options)
+	} else if format == "ipfs" {
+		return NewWriteIPFS(options)
+	} else if format == "ndjson" {
+		return NewWriteJSONLines(options)
+	}
+	return NewWriteJSON(options)
+}
+
+// multiWriter passes all results on to several writers.
+type multiWriter []Writer
+
+func (writers multiWriter) write(lookup string, result dnslink.Result) {
+	for _, writer := range writers {
+		writer.write(lookup, result)
+	}
+}
+
+// fail only reports the failure with the first writer, as they share the
+// err output.
+func (writers multiWriter) fail(lookup string, err error) {
+	writers[0].fail(lookup, err)
+}
+
+func (writers multiWriter) end() {
+	for _, writer := range writers {
+		writer.end()
+	}
+}
+
+// outputTarget is the destination of one output format.
+type outputTarget struct {
+	format string
+	out    io.Writer
+}
+
+// newMultiWriter creates a writer for each target. Only the first target
+// renders the debug log, to not repeat it on stderr.
+func newMultiWriter(targets []outputTarget, options WriteOptions) Writer {
+	writers := multiWriter{}
+	for index, target := range targets {
+		targetOptions := options
+		targetOptions.out = target.out
+		if index > 0 {
+			targetOptions.debug = false
+		}
+		writers = append(writers, newWriter(target.format, targetOptions))
+	}
+	if len(writers) == 1 {
+		return writers[0]
+	}
+	return writers
+}
+
+// getFormats returns the known formats of all --format options, which may
+// contain comma separated lists like --format=txt,csv.
+func getFormats(raw []interface{}) []string {
+	list := []string{}
+	for _, format := range getList(raw) {
+		for _, known := range formats {
+			if format == known {
+				list = append(list, format)
+				break
+			}
+		}
+	}
+	if len(list) == 0 {
+		return []string{"txt"}
+	}
+	return list
+}
+
+// openTargets opens the files given with --out-<format>=<path>, formats
+// without such an option are rendered to stdout.
+func openTargets(formats []string, options *Options, stdout io.Writer) ([]outputTarget, func() error, error) {
+	targets := []outputTarget{}
+	files := []*os.File{}
+	closeFiles := func() error {
+		var err error
+		for _, file := range files {
+			if closeErr := file.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	for _, format := range formats {
+		switch path := options.first("out-" + format).(type) {
+		case string:
+			file, err := os.Create(path)
+			if err != nil {
+				closeFiles()
+				return nil, nil, err
+			}
+			files = append(files, file)
+			targets = append(targets, outputTarget{format, bufio.NewWriter(file)})
+		default:
+			targets = append(targets, outputTarget{format, stdout})
+		}
+	}
+	return targets, closeFiles, nil
+}
+
+func main() {
+	options, lookups := getOptions(os.Args[1:])
+	if options.has("help", "h") {
+		showHelp("dnslink")
+		return
+	}
+	if options.has("version", "v") {
+		showVersion()
+		return
+	}
+	if len(lookups) == 0 && !options.has("from-response") {
+		showHelp("dnslink")
+		os.Exit(1)
+		return
+	}
+	stdout := bufio.NewWriter(os.Stdout)
+	targets, closeTargets, err := openTargets(getFormats(options.get("format", "f")), &options, stdout)
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	defer closeTargets()
+	delimiter, err := getDelimiter(options.first("delimiter"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	stdin, err := getStdin(lookups)
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	namespace, first, err := getNamespace(options.first("first"), options.first("ns", "n"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	writeOpts := WriteOptions{
+		domains:      lookups,
+		namespace:    namespace,
+		first:        first,
+		debug:        options.has("debug") || options.has("d") || options.has("trace"),
+		err:          bufio.NewWriter(os.Stderr),
+		out:          stdout,
+		ttl:          options.has("ttl"),
+		delimiter:    delimiter,
+		stripNS:      options.has("strip-namespace"),
+		includeEmpty: options.has("include-empty"),
+		pretty:       options.has("pretty"),
+		stdin:        stdin,
+	}
+	writeOpts.humanTtl, err = getTtlFormat(options.first("ttl-format"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	if options.has("ttl-format") && !writeOpts.ttl {
+		exitWithUsageError(fmt.Errorf("--ttl-format requires --ttl"))
+	}
+	if options.has("pretty") && options.has("compact") {
+		exitWithUsageError(fmt.Errorf("--pretty can not be combined with --compact"))
+	}
+	interval, err := getInterval(options.first("interval"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	onlyChanged := options.has("only-changed")
+	if onlyChanged && interval == 0 {
+		exitWithUsageError(fmt.Errorf("--only-changed requires --interval"))
+	}
+	identifierFilter, err := getFilter(options.first("filter-identifier"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	newOutput := func(writeOpts WriteOptions) Writer {
+		var output Writer
+		if options.has("fingerprint") {
+			output = NewWriteFingerprint(writeOpts)
+		} else {
+			output = newMultiWriter(targets, writeOpts)
+		}
+		if identifierFilter != nil {
+			output = &filterWriter{output, identifierFilter}
+		}
+		return newSyncWriter(output)
+	}
+	network, err := getNetwork(options.has("ip4"), options.has("ip6"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	timeout, err := getTimeout(options.first("timeout"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	resolver := dnslink.Resolver{
+		TraceDecoding: options.has("trace"),
+	}
+	if options.has("doh") && len(getList(options.get("doh"))) == 0 {
+		exitWithUsageError(fmt.Errorf("--doh requires a value, e.g. --doh=https://cloudflare-dns.com/dns-query"))
+	}
+	doh := []string{}
+	servers := getServers(options.get("dns"))
+	if options.has("dns") {
+		if options.has("doh") {
+			exitWithUsageError(fmt.Errorf("--dns can not be combined with --doh"))
+		}
+		// A --dns without server uses the system dns service.
+		if len(servers) > 0 {
+			resolver.LookupTXTContext = dnslink.NewUDPLookupWithOptions(servers, dnslink.UDPLookupOptions{Network: network, Timeout: timeout})
+		} else if network != "" {
+			exitWithUsageError(fmt.Errorf("--ip4 and --ip6 require a --dns server"))
+		} else if timeout != 0 {
+			exitWithUsageError(fmt.Errorf("--timeout requires a --dns server"))
+		}
+	} else if network != "" {
+		exitWithUsageError(fmt.Errorf("--ip4 and --ip6 require --dns"))
+	} else if timeout != 0 {
+		exitWithUsageError(fmt.Errorf("--timeout requires --dns"))
+	} else {
+		doh = getDoHEndpoints(options.get("doh"), os.Getenv("DNSLINK_DOH"))
+		if len(doh) > 0 {
+			resolver.LookupTXTContext = newDoHLookup(doh)
+		}
+	}
+	if resolver.LookupTXTContext == nil && !options.has("dns") {
+		// Like dig, the name servers of resolv.conf are queried directly,
+		// which also reports the ttls that the system dns service doesn't.
+		resolver.LookupTXTContext = dnslink.NewResolvConfLookup("/etc/resolv.conf")
+	}
+	if options.has("show-config") {
+		if err := showConfig(&resolver, servers, doh, writeOpts.out); err != nil {
+			exitWithUsageError(err)
+		}
+		flush(writeOpts.out)
+		return
+	}
+	resolve := resolver.Resolve
+	if path, ok := options.first("from-cache").(string); ok {
+		cache, err := loadCacheFile(path)
+		if err != nil {
+			exitWithUsageError(err)
+		}
+		resolve = cache.resolve
+	} else if options.has("from-cache") {
+		exitWithUsageError(fmt.Errorf("--from-cache requires a path"))
+	}
+	if options.has("from-response") {
+		path, ok := options.first("from-response").(string)
+		if !ok {
+			exitWithUsageError(fmt.Errorf("--from-response requires a path"))
+		}
+		lookup, result, err := resolveResponse(&resolver, path)
+		if err != nil {
+			exitWithUsageError(err)
+		}
+		output := newOutput(writeOpts)
+		output.write(lookup, result)
+		output.end()
+		return
+	}
+	if stdin && (options.has("graph") || options.has("audit")) {
+		exitWithUsageError(fmt.Errorf("domains from stdin can not be combined with --graph or --audit"))
+	}
+	if options.has("graph") {
+		if code := graph(resolve, lookups, maxGraphDepth, writeOpts.out); code != 0 {
+			closeTargets()
+			os.Exit(code)
+		}
+		return
+	}
+	if options.has("audit") {
+		if options.has("from-cache") {
+			exitWithUsageError(fmt.Errorf("--audit can not be combined with --from-cache"))
+		}
+		// The reports are rendered as json lines, only the failures are
+		// rendered in the --format, on the err output.
+		failOpts := writeOpts
+		failOpts.out = ioutil.Discard
+		failures := newOutput(failOpts)
+		code := audit(&resolver, lookups, writeOpts.out, failures)
+		failures.end()
+		flush(writeOpts.out)
+		if code != 0 {
+			closeTargets()
+			os.Exit(code)
+		}
+		return
+	}
+	prefer := getList(options.get("prefer"))
+	parallel, err := getParallel(options.first("parallel"))
+	if err != nil {
+		exitWithUsageError(err)
+	}
+	if parallel > 0 && options.has("from-cache") {
+		exitWithUsageError(fmt.Errorf("--parallel can not be combined with --from-cache"))
+	}
+	finish := func(outcome dnslink.ResultOrError) dnslink.ResultOrError {
+		if outcome.Err == nil && len(prefer) > 0 {
+			outcome.Result = preferred(outcome.Result, prefer)
+		}
+		return outcome
+	}
+	// code is the exit code of the first lookup that failed.
+	code := 0
+	report := func(output Writer, lookup string, outcome dnslink.ResultOrError) {
+		if outcome.Err == nil {
+			output.write(lookup, outcome.Result)
+			return
+		}
+		output.fail(lookup, outcome.Err)
+		if code == 0 {
+			code = exitCode(outcome.Err)
+		}
+	}
+	exit := func() {
+		if code != 0 {
+			closeTargets()
+			os.Exit(code)
+		}
+	}
+	if stdin {
+		if interval > 0 {
+			exitWithUsageError(fmt.Errorf("domains from stdin can not be combined with --interval"))
+		}
+		output := newOutput(writeOpts)
+		var err error
+		if parallel > 0 {
+			// The results are rendered as they arrive, while stdin is read.
+			domains := make(chan string)
+			go func() {
+				err = scanDomains(os.Stdin, func(lookup string) {
+					domains <- lookup
+				})
+				close(domains)
+			}()
+			for event := range resolver.ResolveStream(context.Background(), domains, parallel) {
+				report(output, event.Domain, finish(dnslink.ResultOrError{Result: event.Result, Err: event.Err}))
+			}
+		} else {
+			err = scanDomains(os.Stdin, func(lookup string) {
+				result, err := resolve(lookup)
+				report(output, lookup, finish(dnslink.ResultOrError{Result: result, Err: err}))
+			})
+		}
+		output.end()
+		if err != nil {
+			closeTargets()
+			exitWithUsageError(err)
+		}
+		exit()
+		return
+	}
+	resolveAll := func() []dnslink.ResultOrError {
+		outcomes := make([]dnslink.ResultOrError, len(lookups))
+		var many map[string]dnslink.ResultOrError
+		if parallel > 0 {
+			many = resolver.ResolveMany(context.Background(), lookups, parallel)
+		}
+		for index, lookup := range lookups {
+			if many != nil {
+				outcomes[index] = finish(many[lookup])
+			} else {
+				result, err := resolve(lookup)
+				outcomes[index] = finish(dnslink.ResultOrError{Result: result, Err: err})
+			}
+		}
+		return outcomes
+	}
+	if interval == 0 {
+		output := newOutput(writeOpts)
+		for index, outcome := range resolveAll() {
+			report(output, lookups[index], outcome)
+		}
+		output.end()
+		exit()
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	filter := NewChangeFilter()
+	watch(ctx, interval, time.After, func() {
+		writeOpts.timestamp = time.Now()
+		outcomes := resolveAll()
+		var output Writer
+		for index, outcome := range outcomes {
+			if outcome.Err == nil && onlyChanged && !filter.changed(lookups[index], outcome.Result) {
+				continue
+			}
+			if output == nil {
+				output = newOutput(writeOpts)
+			}
+			report(output, lookups[index], outcome)
+		}
+		if output != nil {
+			output.end()
+		}
+	})
+}
+
+// Exit codes of the command, scripts can tell by them why lookups failed.
+const (
+	exitUsage    = 1
+	exitNotFound = 2
+	exitNetwork  = 3
+	exitFailed   = 4
+)
 
-func NewWriteJSON(options WriteOptions) *WriteJSON {
-	write := WriteJSON{
-		firstOut: true,
-		firstErr: true,
-		options:  options,
+// exitCode returns the exit code for a failed lookup: exitNotFound for
+// NXDOMAIN, exitNetwork if the name server couldn't be reached or failed
+// to answer and exitFailed for other errors, like invalid domains.
+func exitCode(err error) int {
+	if dnslink.IsNXDomain(err) {
+		return exitNotFound
 	}
-	if len(options.domains) > 1 {
-		options.out.Println("[")
+	if _, ok := dnslink.AsDNSRCodeError(err); ok {
+		return exitNetwork
 	}
-	if options.debug {
-		options.err.Println("[")
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitNetwork
 	}
-	return &write
+	return exitFailed
 }
 
-func (write *WriteJSON) write(lookup string, result dnslink.Result) {
-	out := write.options.out
-	err := write.options.err
-	prefix := ""
-	if write.firstOut {
-		write.firstOut = false
-	} else {
-		prefix = ","
+// WriteDig renders the entries like the answer section of dig, e.g.:
+// _dnslink.dnslink.dev.	60	IN	TXT	"dnslink=/ipfs/QmXNosdf..."
+type WriteDig struct {
+	first   bool
+	options WriteOptions
+}
+
+func NewWriteDig(options WriteOptions) *WriteDig {
+	return &WriteDig{
+		first:   true,
+		options: options,
 	}
+}
 
-	outLine := map[string]interface{}{}
-	if write.options.ttl {
-		outLine["links"] = result.Links
-		outLine["txtEntries"] = result.TxtEntries
+func (write *WriteDig) write(lookup string, result dnslink.Result) {
+	out := write.options.out
+	if write.first {
+		write.first = false
 	} else {
-		noTtl := result.NoTtl()
-		outLine["links"] = noTtl.Links
-		outLine["txtEntries"] = noTtl.TxtEntries
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintln(out, ";; ANSWER SECTION:")
+	for _, entry := range result.TxtEntries {
+		name := lookup
+		if entry.Source != dnslink.SourceBare {
+			name = "_dnslink." + name
+		}
+		record := &dns.TXT{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: entry.Ttl},
+			Txt: txtChunks("dnslink=" + entry.Value),
+		}
+		fmt.Fprintln(out, record.String())
 	}
+	write.options.flush()
+}
 
-	if len(write.options.domains) > 1 {
-		outLine["lookup"] = lookup
+func (write *WriteDig) end() {}
+
+func (write *WriteDig) fail(lookup string, err error) {
+	writeTXTLog(write.options.err, failure(lookup, err))
+	write.options.flush()
+}
+
+// txtChunks splits a value into the 255 byte character-strings of a TXT
+// record.
+func txtChunks(value string) []string {
+	chunks := []string{}
+	for len(value) > 255 {
+		chunks = append(chunks, value[:255])
+		value = value[255:]
 	}
+	return append(chunks, value)
+}
 
-	jsonOutline, error := json.Marshal(outLine)
-	if error != nil {
-		panic(error)
+// syncWriter serializes the calls to a writer, so results that are resolved
+// in parallel can be written as they arrive. Every result is rendered as a
+// whole, but in the order the calls come in.
+type syncWriter struct {
+	mutex  sync.Mutex
+	writer Writer
+}
+
+func newSyncWriter(writer Writer) *syncWriter {
+	return &syncWriter{writer: writer}
+}
+
+func (writer *syncWriter) write(lookup string, result dnslink.Result) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.writer.write(lookup, result)
+}
+
+func (writer *syncWriter) fail(lookup string, err error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.writer.fail(lookup, err)
+}
+
+func (writer *syncWriter) end() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.writer.end()
+}
+
+// filterWriter passes results on with only the entries whose identifier
+// matches the pattern, the resolution itself stays untouched.
+type filterWriter struct {
+	Writer
+	pattern *regexp.Regexp
+}
+
+func (writer *filterWriter) write(lookup string, result dnslink.Result) {
+	writer.Writer.write(lookup, filterIdentifiers(result, writer.pattern))
+}
+
+func filterIdentifiers(result dnslink.Result, pattern *regexp.Regexp) dnslink.Result {
+	filtered := dnslink.Result{
+		TxtEntries:        []dnslink.TxtEntry{},
+		Links:             map[string]dnslink.NamespaceEntries{},
+		Log:               result.Log,
+		RegistrableDomain: result.RegistrableDomain,
 	}
-	out.Print(prefix + string(jsonOutline))
-	if write.options.debug {
-		for _, statement := range result.Log {
-			prefix := ""
-			if write.firstErr {
-				write.firstErr = true
-			} else {
-				prefix = "\n,"
-			}
-			errLine := map[string]interface{}{
-				"code": statement.Code,
-			}
-			if statement.Entry != "" {
-				errLine["entry"] = statement.Entry
-			}
-			if statement.Reason != "" {
-				errLine["reason"] = statement.Reason
+	for ns, entries := range result.Links {
+		matching := dnslink.NamespaceEntries{}
+		for _, entry := range entries {
+			if pattern.MatchString(entry.Identifier) {
+				matching = append(matching, entry)
 			}
-			if len(write.options.domains) > 1 {
-				errLine["lookup"] = lookup
-			}
-			jsonErrline, error := json.Marshal(errLine)
-			if error != nil {
-				panic(error)
-			}
-			err.Print(prefix + string(jsonErrline))
+		}
+		if len(matching) > 0 {
+			filtered.Links[ns] = matching
+		}
+	}
+	for _, txtEntry := range result.TxtEntries {
+		// TxtEntries have the form /<ns>/<identifier>
+		parts := strings.SplitN(txtEntry.Value, "/", 3)
+		if len(parts) == 3 && pattern.MatchString(parts[2]) {
+			filtered.TxtEntries = append(filtered.TxtEntries, txtEntry)
 		}
 	}
+	return filtered
 }
 
-func (write *WriteJSON) end() {
-	if len(write.options.domains) > 1 {
-		write.options.out.Print("]")
+// showConfig renders the resolver configuration and the dns servers as json.
+func showConfig(resolver *dnslink.Resolver, servers []string, doh []string, out io.Writer) error {
+	config, err := resolver.ConfigJSON()
+	if err != nil {
+		return err
 	}
-	if write.options.debug {
-		write.options.err.Print("]")
+	return json.NewEncoder(out).Encode(map[string]interface{}{
+		"resolver": json.RawMessage(config),
+		"dns":      servers,
+		"doh":      doh,
+	})
+}
+
+// getDoHEndpoints returns the DoH endpoints of the --doh option or, if it
+// isn't given, of the comma separated DNSLINK_DOH environment variable.
+func getDoHEndpoints(raw []interface{}, env string) []string {
+	endpoints := getList(raw)
+	if len(endpoints) > 0 {
+		return endpoints
+	}
+	for _, part := range strings.Split(env, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			endpoints = append(endpoints, part)
+		}
 	}
+	return endpoints
 }
 
-type WriteTXT struct {
-	firstOut bool
-	firstErr bool
-	options  WriteOptions
+// newDoHLookup queries a random one of the DoH endpoints for every lookup,
+// like the udp lookup does with several --dns servers.
+func newDoHLookup(endpoints []string) dnslink.LookupTXTContextFunc {
+	lookups := make([]dnslink.LookupTXTContextFunc, len(endpoints))
+	for index, endpoint := range endpoints {
+		lookups[index] = dnslink.NewDoHLookupContext(endpoint, nil)
+	}
+	return func(ctx context.Context, domain string) ([]dnslink.LookupEntry, error) {
+		return lookups[rand.Intn(len(lookups))](ctx, domain)
+	}
 }
 
-func NewWriteTXT(options WriteOptions) *WriteTXT {
-	return &WriteTXT{
-		firstOut: true,
-		firstErr: true,
-		options:  options,
+// resolveResponse resolves the dns response in wire format that is stored at
+// the path.
+func resolveResponse(resolver *dnslink.Resolver, path string) (string, dnslink.Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", dnslink.Result{}, err
 	}
+	defer file.Close()
+	result, lookup, err := resolver.ResolveResponse(file)
+	return lookup, result, err
 }
 
-func (write *WriteTXT) write(lookup string, result dnslink.Result) {
-	out := write.options.out
-	err := write.options.err
-	prefix := ""
-	if len(write.options.domains) > 1 {
-		prefix = lookup + ": "
+// cacheFile holds previously resolved results by domain, as loaded with
+// --from-cache to answer lookups without network access.
+type cacheFile map[string]dnslink.Result
+
+func cacheKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// loadCacheFile reads a json object that maps domains to results, like:
+// {"dnslink.dev": {"links": {"ipfs": [{"identifier": "Qm...", "ttl": 60}]}}}
+func loadCacheFile(path string) (cacheFile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	for ns, values := range result.Links {
-		if write.options.searchNS != false && write.options.searchNS != ns {
-			continue
+	parsed := map[string]dnslink.Result{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %v", path, err)
+	}
+	cache := cacheFile{}
+	for domain, result := range parsed {
+		cache[cacheKey(domain)] = result
+	}
+	return cache, nil
+}
+
+func (cache cacheFile) resolve(domain string) (dnslink.Result, error) {
+	result, ok := cache[cacheKey(domain)]
+	if !ok {
+		return dnslink.Result{}, fmt.Errorf("%s is not in the cache file", domain)
+	}
+	if result.Links == nil {
+		result.Links = map[string]dnslink.NamespaceEntries{}
+	}
+	if result.TxtEntries == nil {
+		result.TxtEntries = []dnslink.TxtEntry{}
+	}
+	if result.Log == nil {
+		result.Log = []dnslink.LogStatement{}
+	}
+	return result, nil
+}
+
+// audit renders the audit report of every lookup as a line of json.
+// Lookups that can't be audited, like invalid domains, are reported with
+// failures.fail. The returned exit code is the one of the first failure, or
+// 0 if all lookups were audited.
+func audit(resolver *dnslink.Resolver, lookups []string, out io.Writer, failures Writer) int {
+	encoder := json.NewEncoder(out)
+	code := 0
+	for _, lookup := range lookups {
+		report, err := resolver.Audit(lookup)
+		if err == nil {
+			err = encoder.Encode(report)
 		}
-		for _, entry := range values {
-			identifier := entry.Identifier
-			if write.options.ttl {
-				identifier += " [ttl=" + fmt.Sprint(entry.Ttl) + "]"
+		if err != nil {
+			failures.fail(lookup, err)
+			if code == 0 {
+				code = exitCode(err)
 			}
+			continue
+		}
+		flush(out)
+	}
+	return code
+}
+
+// graphEdge is a link of a domain, with the domain it points to if the link
+// is a /dnslink/ or /ipns/ link to a domain. Edges without From are the
+// domains that the graph starts with.
+type graphEdge struct {
+	From  string `json:"from,omitempty"`
+	Link  string `json:"link,omitempty"`
+	To    string `json:"to,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// maxGraphDepth limits how many links are followed from the given domains.
+const maxGraphDepth = 8
+
+// linkTarget returns the domain that a link points to, if any.
+func linkTarget(ns string, identifier string) string {
+	domain := strings.SplitN(identifier, "/", 2)[0]
+	if ns == "dnslink" || (ns == "ipns" && strings.Contains(domain, ".")) {
+		return strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+	return ""
+}
 
-			if write.options.searchNS != false {
-				if write.options.searchNS != ns {
+// graph resolves the lookups and the domains their links point to and
+// renders every link as a line of json. Domains are only resolved once, the
+// edge that leads to a domain is rendered after it was resolved, with the
+// error if that failed. The returned exit code is the one of the first of the
+// lookups that couldn't be resolved, or 0. Links to domains that can't be
+// resolved are part of the graph and don't change the exit code.
+func graph(resolve func(string) (dnslink.Result, error), lookups []string, maxDepth int, out io.Writer) int {
+	encoder := json.NewEncoder(out)
+	type node struct {
+		domain string
+		depth  int
+		edge   graphEdge
+	}
+	visited := map[string]bool{}
+	queue := []node{}
+	for _, lookup := range lookups {
+		visited[strings.ToLower(strings.TrimSuffix(lookup, "."))] = true
+		queue = append(queue, node{lookup, 0, graphEdge{To: lookup}})
+	}
+	code := 0
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		result, err := resolve(next.domain)
+		if err != nil {
+			next.edge.Error = err.Error()
+			if next.edge.From == "" && code == 0 {
+				code = exitCode(err)
+			}
+		}
+		if err := encoder.Encode(next.edge); err != nil {
+			panic(err)
+		}
+		if err != nil {
+			flush(out)
+			continue
+		}
+		for _, list := range result.AsList() {
+			for _, entry := range list.Entries {
+				edge := graphEdge{From: next.domain, Link: "/" + list.Namespace + "/" + entry.Identifier}
+				target := linkTarget(list.Namespace, entry.Identifier)
+				if target != "" {
+					edge.To = target
+				}
+				if target == "" || visited[target] || next.depth >= maxDepth {
+					if err := encoder.Encode(edge); err != nil {
+						panic(err)
+					}
 					continue
 				}
-				out.Println(prefix + identifier)
-			} else {
-				out.Println(prefix + "/" + ns + "/" + identifier)
-			}
-			if write.options.firstNS != false {
-				break
+				visited[target] = true
+				queue = append(queue, node{target, next.depth + 1, edge})
 			}
 		}
+		flush(out)
 	}
-	if write.options.debug {
-		for _, logEntry := range result.Log {
-			optional := ""
-			if logEntry.Entry != "" {
-				optional += " entry=" + logEntry.Entry
-			}
-			if logEntry.Reason != "" {
-				optional += " reason=" + logEntry.Reason
-			}
-			err.Println("[" + logEntry.Code + "]" + optional)
+	flush(out)
+	return code
+}
+
+// watch calls poll right away and then every interval until ctx is done.
+func watch(ctx context.Context, interval time.Duration, after func(time.Duration) <-chan time.Time, poll func()) {
+	for {
+		poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-after(interval):
 		}
 	}
 }
 
-func (write *WriteTXT) end() {}
-
-type WriteCSV struct {
-	firstOut bool
-	firstErr bool
-	options  WriteOptions
+func getInterval(raw interface{}) (time.Duration, error) {
+	switch value := raw.(type) {
+	case string:
+		if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return time.Duration(seconds) * time.Second, nil
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return 0, fmt.Errorf("invalid --interval=%s, use a duration like 60s or 5m", value)
+		}
+		return interval, nil
+	case bool:
+		if value {
+			return 0, fmt.Errorf("--interval requires a value, e.g. --interval=60s")
+		}
+	}
+	return 0, nil
 }
 
-func NewWriteCSV(options WriteOptions) *WriteCSV {
-	return &WriteCSV{
-		firstOut: true,
-		firstErr: true,
-		options:  options,
+// getStdin reports whether the domains are read from stdin, which is
+// requested with a single - instead of hostnames.
+func getStdin(lookups []string) (bool, error) {
+	for _, lookup := range lookups {
+		if lookup == "-" {
+			if len(lookups) > 1 {
+				return false, fmt.Errorf("- reads the hostnames from stdin and can not be combined with other hostnames")
+			}
+			return true, nil
+		}
 	}
+	return false, nil
 }
 
-func (write *WriteCSV) write(lookup string, result dnslink.Result) {
-	out := write.options.out
-	err := write.options.err
-	if write.firstOut {
-		write.firstOut = false
-		line := "lookup,namespace,identifier"
-		if write.options.ttl {
-			line += ",ttl"
+// scanDomains calls each for every domain in the input, one per line. Blank
+// lines and comments starting with # are skipped. Lines are read as they
+// come, so the domains are resolved while the input is still written.
+func scanDomains(input io.Reader, each func(domain string)) error {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		out.Println(line)
+		each(line)
 	}
-	for ns, values := range result.Links {
-		if write.options.searchNS != false && write.options.searchNS != ns {
-			continue
+	return scanner.Err()
+}
+
+// getTimeout returns the timeout for the queries to the --dns server, 0 for
+// the default.
+func getTimeout(raw interface{}) (time.Duration, error) {
+	switch value := raw.(type) {
+	case string:
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("invalid --timeout=%s, use a duration like 500ms or 5s", value)
 		}
-		for _, value := range values {
-			var line string
-			if write.options.ttl {
-				line = csv(lookup, ns, value.Identifier, value.Ttl)
-			} else {
-				line = csv(lookup, ns, value.Identifier)
-			}
-			out.Println(line)
-			if write.options.firstNS != false {
-				break
-			}
+		return timeout, nil
+	case bool:
+		if value {
+			return 0, fmt.Errorf("--timeout requires a value, e.g. --timeout=5s")
 		}
 	}
-	if write.options.debug {
-		for _, logEntry := range result.Log {
-			if write.firstErr {
-				write.firstErr = false
-				err.Println("code,entry,reason")
-			}
-			err.Println(csv(logEntry.Code, logEntry.Entry, logEntry.Reason))
+	return 0, nil
+}
+
+// getParallel returns the number of concurrent lookups, 0 to resolve the
+// domains one after another.
+func getParallel(raw interface{}) (int, error) {
+	switch value := raw.(type) {
+	case string:
+		parallel, err := strconv.Atoi(value)
+		if err != nil || parallel < 1 {
+			return 0, fmt.Errorf("invalid --parallel=%s, use a number of concurrent lookups like 8", value)
+		}
+		return parallel, nil
+	case bool:
+		if value {
+			return 0, fmt.Errorf("--parallel requires a value, e.g. --parallel=8")
 		}
 	}
+	return 0, nil
 }
 
-func csv(rest ...interface{}) string {
-	result := ""
-	prefix := ""
-	for _, entry := range rest {
-		value := ""
-		switch v := entry.(type) {
-		case int:
-		case uint32:
-			value = fmt.Sprint(v)
-		case bool:
-			if v {
-				value = "true"
-			} else {
-				value = "false"
-			}
-		case string:
-			value = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+func getDelimiter(raw interface{}) (string, error) {
+	switch value := raw.(type) {
+	case string:
+		if value == "tab" {
+			return "\t", nil
+		}
+		if len(value) != 1 || value == `"` || value == "\n" || value == "\r" {
+			return "", fmt.Errorf("invalid --delimiter=%s, use a single character or tab", value)
+		}
+		return value, nil
+	case bool:
+		if value {
+			return "", fmt.Errorf("--delimiter requires a value, e.g. --delimiter=;")
 		}
-		result += prefix + value
-		prefix = ","
 	}
-	return result
+	return ",", nil
 }
 
-func (write *WriteCSV) end() {}
-
-var formats []interface{} = []interface{}{"json", "txt", "csv"}
-
-func main() {
-	options, lookups := getOptions(os.Args[1:])
-	if options.has("help", "h") {
-		showHelp("dnslink")
-		return
+// getNamespace returns the namespace to render and whether only the first
+// entry of a namespace is rendered. --first alone renders the first entry of
+// every namespace, --first=<ns> the first entry of that namespace, which
+// --ns=<ns> may repeat but not contradict.
+func getNamespace(rawFirst interface{}, rawNS interface{}) (namespace string, first bool, err error) {
+	switch value := rawFirst.(type) {
+	case string:
+		namespace = value
+		first = true
+	case bool:
+		first = value
 	}
-	if options.has("version", "v") {
-		showVersion()
-		return
+	switch value := rawNS.(type) {
+	case string:
+		if value == "" {
+			return "", false, fmt.Errorf("--ns requires a namespace, e.g. --ns=ipfs")
+		}
+		if namespace != "" && namespace != value {
+			return "", false, fmt.Errorf("--first=%s can not be combined with --ns=%s", namespace, value)
+		}
+		namespace = value
+	case bool:
+		if value {
+			return "", false, fmt.Errorf("--ns requires a namespace, e.g. --ns=ipfs")
+		}
 	}
-	if len(lookups) == 0 {
-		showHelp("dnslink")
-		os.Exit(1)
-		return
+	return namespace, first, nil
+}
+
+// getTtlFormat returns true if the ttls should be rendered as durations
+// rather than seconds.
+func getTtlFormat(raw interface{}) (bool, error) {
+	switch value := raw.(type) {
+	case string:
+		switch value {
+		case "seconds":
+			return false, nil
+		case "human":
+			return true, nil
+		}
+		return false, fmt.Errorf("invalid --ttl-format=%s, use seconds or human", value)
+	case bool:
+		if value {
+			return false, fmt.Errorf("--ttl-format requires a value, e.g. --ttl-format=human")
+		}
 	}
-	format := options.firstMatch(formats, "format", "f")
-	if format == false {
-		format = "txt"
+	return false, nil
+}
+
+// getNetwork returns the network for the dns queries, empty for both ip
+// versions.
+func getNetwork(ip4 bool, ip6 bool) (string, error) {
+	if ip4 && ip6 {
+		return "", fmt.Errorf("--ip4 and --ip6 can not be combined")
 	}
-	writeOpts := WriteOptions{
-		domains:  lookups,
-		firstNS:  options.first("first"),
-		searchNS: options.first("first", "ns", "n"),
-		debug:    options.has("debug") || options.has("d"),
-		err:      log.New(os.Stderr, "", 0),
-		out:      log.New(os.Stdout, "", 0),
-		ttl:      options.has("ttl"),
-	}
-	var output Writer
-	if format == "txt" {
-		output = NewWriteTXT(writeOpts)
-	} else if format == "csv" {
-		output = NewWriteCSV(writeOpts)
-	} else {
-		output = NewWriteJSON(writeOpts)
+	if ip4 {
+		return "udp4", nil
 	}
-	resolver := dnslink.Resolver{}
-	if options.has("dns") {
-		resolver.LookupTXT = dnslink.NewUDPLookup(getServers(options.get("dns")), 0)
+	if ip6 {
+		return "udp6", nil
 	}
-	for _, lookup := range lookups {
-		result, err := resolver.Resolve(lookup)
+	return "", nil
+}
+
+// getFilter compiles the --filter-identifier pattern, nil means no filter.
+func getFilter(raw interface{}) (*regexp.Regexp, error) {
+	switch pattern := raw.(type) {
+	case string:
+		filter, err := regexp.Compile(pattern)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid --filter-identifier pattern: %v", err)
+		}
+		return filter, nil
+	case bool:
+		if pattern {
+			return nil, fmt.Errorf("--filter-identifier requires a pattern, e.g. --filter-identifier=^bafy")
 		}
-		output.write(lookup, result)
 	}
-	output.end()
+	return nil, nil
+}
+
+func exitWithUsageError(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(exitUsage)
 }
 
 func getServers(raw []interface{}) []string {
 	servers := []string{}
 	for _, entry := range raw {
-		switch string := entry.(type) {
+		switch server := entry.(type) {
 		case string:
-			servers = append(servers, string)
+			// Like the udp lookup, so that --show-config reports the
+			// server that is queried.
+			servers = append(servers, dnslink.WithDefaultPort(server, "53"))
 		}
 	}
 	return servers
 }
 
+func getList(raw []interface{}) []string {
+	list := []string{}
+	for _, entry := range raw {
+		switch value := entry.(type) {
+		case string:
+			for _, part := range strings.Split(value, ",") {
+				if part != "" {
+					list = append(list, part)
+				}
+			}
+		}
+	}
+	return list
+}
+
 func showHelp(command string) int {
 	fmt.Printf(command + ` - resolve dns links in TXT records
 
 USAGE
-    ` + command + ` [--help] [--format=json|text|csv] [--ns=<ns>] \
-        [--first=<ns>] [--dns=server] [--debug] \
+    ` + command + ` [--help] [--format=json|ndjson|txt|csv|env|dig|properties|ipfs,...] \
+        [--out-<format>=<path>] [--compact|--pretty] [--ttl [--ttl-format=seconds|human]] \
+        [--ns=<ns>] [--strip-namespace] \
+        [--filter-identifier=<regexp>] [--first[=<ns>]] [--prefer=<ns>,...] \
+        [--dns=server [--ip4|--ip6] [--timeout=<duration>]|--doh=<url>,...] \
+        [--debug] [--trace] [--delimiter=<char>|tab] [--include-empty] [--fingerprint] \
+        [--interval=<duration> [--only-changed]] [--audit] [--graph] \
+        [--from-cache=<path>|--parallel=<n>] [--show-config] \
         <hostname> [...<hostname>]
+    ` + command + ` [...options] -
+    ` + command + ` [...options] --from-response=<path>
 
 EXAMPLE
     # Receive the dnslink entries for the dnslink.io domain.
@@ -340,7 +1808,7 @@ EXAMPLE
     > ` + command + ` --ttl dnslink.dev
     /ipfs/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF  [ttl=53]
 
-    # Receive the dnslink entries using the system DNS.
+    # Receive the dnslink entries using the system DNS service.
     > ` + command + ` --dns dnslink.dev
     /ipfs/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF
 
@@ -357,6 +1825,26 @@ EXAMPLE
     ,{"lookup":"dnslink.dev","txtEntries":["/ipfs/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF"],"links":{"ipfs":["QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF"]}}
     ]
 
+    # Print a line whenever the ipfs link of dnslink.dev changes.
+    > ` + command + ` --interval=60s --only-changed --ns=ipfs dnslink.dev
+    2021-07-01T10:00:00Z QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF
+
+    # Show the links and store them as csv at the same time.
+    > ` + command + ` --format=txt,csv --out-csv=links.csv dnslink.dev
+    /ipfs/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF
+
+    # Set shell variables like DNSLINK_IPFS for the entries of each namespace.
+    > eval "$(` + command + ` --format=env dnslink.dev)"
+
+    # Pin the /ipfs/ entries with the ipfs cli.
+    > ` + command + ` --format=ipfs dnslink.dev | sh
+
+    # Store the links as java properties like dnslink.dev.ipfs=Qm...
+    > ` + command + ` --format=properties --out-properties=dnslink.properties dnslink.dev
+
+    # Resolve the hostnames listed in a file, one per line, as csv.
+    > ` + command + ` --format=csv - <domains.txt
+
     # Receive both the result and log as csv and redirect each to files.
     > ` + command + ` --format=csv --debug dnslink.io \
         >dnslink-io.csv \
@@ -365,14 +1853,93 @@ EXAMPLE
 OPTIONS
     --help, -h             Show this help.
     --version, -v          Show the version of this command.
-    --format, -f           Output format json, text or csv (default=text)
-    --ttl                  Include ttl in output (any format)
-    --dns=<server>         Specify a dns server to use. If you don't specify a
-                           server it will use the system dns service. As server you
-                           can specify a domain with port: 1.1.1.1:53
+    --format, -f           Output format json, ndjson, txt, csv, env, dig,
+                           properties or ipfs (default=txt). ndjson renders every
+                           domain as a line of json, e.g. to process it with jq.
+                           Multiple formats can be combined: --format=txt,csv
+    --out-<format>=<path>  Write the output of a format to a file instead of
+                           stdout, e.g. --out-csv=links.csv
+    --compact              Render the json output with one line per domain
+                           (default).
+    --pretty               Render the json output indented.
+    --ttl                  Include ttl in output (any format). The system dns
+                           service of --dns without server reports a ttl of 0.
+    --ttl-format=<format>  Format of the --ttl: seconds (default) or human for
+                           durations like 1h30m.
+    --dns=<server>         Specify a dns server to use. As server you can specify
+                           an ip or domain with optional port: 1.1.1.1:53,
+                           1.1.1.1 or 2606:4700:4700::1111, the port defaults
+                           to 53. --dns without server uses the system dns
+                           service. Without --dns or --doh, the name servers
+                           of /etc/resolv.conf are queried directly, like dig
+                           does, or the system dns service if there is no
+                           such file.
+    --doh=<url>            Use DNS-over-HTTPS with the endpoint, e.g.
+                           https://cloudflare-dns.com/dns-query. Several
+                           endpoints can be separated by commas. Defaults to
+                           the comma separated DNSLINK_DOH environment variable.
+    --show-config          Render the effective resolver configuration as json
+                           and exit, e.g. for bug reports.
+    --from-response=<path> Resolve the dns response in wire format that is stored
+                           at the path, e.g. a capture, instead of a hostname.
+    --ip4, --ip6           Only use IPv4 or IPv6 to reach the --dns server.
+    --timeout=<duration>   Give up on a query to the --dns server after the
+                           duration, e.g. 500ms or 5s (default=2s each to
+                           connect, send and receive).
+    --parallel=<n>         Resolve up to n of the hostnames at the same time.
+                           The output keeps the order of the hostnames, except
+                           for hostnames from stdin, which are rendered as they
+                           are resolved.
+    --from-cache=<path>    Answer from a json file of previously resolved results
+                           instead of the dns, e.g. {"dnslink.dev": {"links":
+                           {"ipfs": [{"identifier": "Qm...", "ttl": 60}]}}}.
+                           Domains missing in the file are an error.
     --debug, -d            Render log output to stderr in the specified format.
-    --ns, -n               Only render one particular DNSLink namespace.
-    --first                Only render the first of the defined DNSLink namespace.
+    --trace                Like --debug, additionally renders how every TXT entry
+                           was decoded, with the received strings and hex bytes.
+    --delimiter=<char>     Field delimiter for csv output, e.g. ; or tab
+                           (default=,)
+    --ns=<ns>, -n=<ns>     Only render one particular DNSLink namespace.
+    --filter-identifier=<regexp>
+                           Only render entries with an identifier that matches
+                           the regular expression, e.g. ^bafy
+    --include-empty        Render a csv row with empty namespace and identifier
+                           for domains without links, e.g. "example.com",,
+    --strip-namespace      Render identifiers without the /<ns>/ path. The json
+                           output is an object of the identifiers by namespace,
+                           e.g. {"ipfs":["Qm..."]}, with the "lookup" and
+                           "time" next to the namespaces if given. The txt
+                           output only has the identifiers, so combine it with
+                           --ns if a domain has several namespaces. The csv and env
+                           output already have the namespace in separate fields.
+    --first[=<ns>]         Only render the first entry of every namespace, or
+                           with a namespace only its first entry, like
+                           --first --ns=<ns>.
+    --graph                Follow /dnslink/ and /ipns/ links to other domains and
+                           render every link as a line of json, like
+                           {"from":"a.com","link":"/dnslink/b.com","to":"b.com"}
+    --audit                Render a json health report for the dnslink setup of
+                           each domain instead of the links.
+    --fingerprint          Only render a sha256 fingerprint of the links (without
+                           ttl) to verify that a domain didn't change.
+    --interval=<duration>  Resolve the domains again every interval (e.g. 60s)
+                           until interrupted; results are rendered with a time.
+    --only-changed         Together with --interval: only render a result if its
+                           links changed since the previous resolution.
+    --prefer=<ns>,...      Only render the first namespace of the given list
+                           that has entries, e.g. --prefer=ipns,ipfs
+    -                      Read the hostnames from stdin, one per line, instead
+                           of the arguments. Blank lines and lines starting
+                           with # are skipped.
+
+EXIT CODES
+    Failed lookups are reported on stderr in the output format, the other
+    hostnames are still resolved. The exit code is that of the first failed
+    lookup:
+    1                      Invalid usage.
+    2                      The domain doesn't exist (NXDOMAIN).
+    3                      The name server couldn't be reached or failed.
+    4                      Other errors, e.g. an invalid domain.
 
 Read more about DNSLink at https://dnslink.dev.
 
@@ -455,6 +2022,11 @@ func getOptions(args []string) (Options, []string) {
 	options := Options{}
 	rest := []string{}[:]
 	for _, arg := range args {
+		if arg == "-" {
+			// Reads the domains from stdin.
+			rest = append(rest, arg)
+			continue
+		}
 		if strings.HasPrefix(arg, "--") {
 			arg = arg[2:]
 		} else if strings.HasPrefix(arg, "-") {
@@ -1,8 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	dnslink "github.com/dnslink-std/go"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,3 +34,1177 @@ func TestOptions(t *testing.T) {
 	options, _ = getOptions([]string{"-hello", "--hello=world"})
 	a.EqualValues(options.get("hello"), []interface{}{true, "world"})
 }
+
+type mockDNS struct {
+	entries map[string][]string
+}
+
+func (m *mockDNS) lookupTXT(name string) (res []dnslink.LookupEntry, err error) {
+	txt, ok := m.entries[name]
+	if !ok {
+		return nil, dnslink.NewDNSRCodeError(3, name)
+	}
+	res = make([]dnslink.LookupEntry, len(txt))
+	for index, entry := range txt {
+		res[index] = dnslink.LookupEntry{
+			Value: entry,
+			Ttl:   100,
+		}
+	}
+	return res, nil
+}
+
+func TestChangeFilter(t *testing.T) {
+	a := assert.New(t)
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.foo.com": {"dnslink=/ipfs/a"},
+	}}
+	resolver := dnslink.Resolver{LookupTXT: mock.lookupTXT}
+	filter := NewChangeFilter()
+	poll := func() bool {
+		result, err := resolver.Resolve("foo.com")
+		a.NoError(err)
+		return filter.changed("foo.com", result)
+	}
+	a.True(poll())
+	a.False(poll())
+	mock.entries["_dnslink.foo.com"] = []string{"dnslink=/ipfs/a", "dnslink=/ipfs/b"}
+	a.True(poll())
+	a.False(poll())
+	mock.entries["_dnslink.foo.com"] = []string{"dnslink=/ipfs/b"}
+	a.True(poll())
+	a.False(poll())
+}
+
+func TestPreferred(t *testing.T) {
+	a := assert.New(t)
+	result := dnslink.Result{
+		TxtEntries: []dnslink.TxtEntry{
+			{Value: "/ipfs/a", Ttl: 100},
+			{Value: "/ipns/b", Ttl: 100},
+		},
+		Links: map[string]dnslink.NamespaceEntries{
+			"ipfs": {{Identifier: "a", Ttl: 100}},
+			"ipns": {{Identifier: "b", Ttl: 100}},
+		},
+		Log: []dnslink.LogStatement{},
+	}
+	reduced := preferred(result, []string{"ipns", "ipfs"})
+	a.EqualValues(reduced.Links, map[string]dnslink.NamespaceEntries{"ipns": {{Identifier: "b", Ttl: 100}}})
+	a.EqualValues(reduced.TxtEntries, []dnslink.TxtEntry{{Value: "/ipns/b", Ttl: 100}})
+	reduced = preferred(result, []string{"foo", "ipfs"})
+	a.EqualValues(reduced.Links, map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	reduced = preferred(result, []string{"foo"})
+	a.Empty(reduced.Links)
+	a.Empty(reduced.TxtEntries)
+	options, _ := getOptions([]string{"--prefer=ipns,ipfs", "--prefer=foo"})
+	a.EqualValues(getList(options.get("prefer")), []string{"ipns", "ipfs", "foo"})
+}
+
+func testResult(links map[string]dnslink.NamespaceEntries) dnslink.Result {
+	result := dnslink.Result{
+		TxtEntries: []dnslink.TxtEntry{},
+		Links:      links,
+		Log:        []dnslink.LogStatement{},
+	}
+	for _, list := range result.AsList() {
+		for _, entry := range list.Entries {
+			result.TxtEntries = append(result.TxtEntries, dnslink.TxtEntry{Value: "/" + list.Namespace + "/" + entry.Identifier, Ttl: entry.Ttl})
+		}
+	}
+	return result
+}
+
+func TestWriteJSONStream(t *testing.T) {
+	a := assert.New(t)
+	reader, writer := io.Pipe()
+	lines := bufio.NewReader(reader)
+	readLine := func() string {
+		line, err := lines.ReadString('\n')
+		a.NoError(err)
+		return line
+	}
+	go func() {
+		// Every write blocks until it is read, the writer needs to run
+		// next to the reader.
+		output := NewWriteJSON(WriteOptions{
+			domains: []string{"a.com", "b.com"},
+			out:     writer,
+			err:     ioutil.Discard,
+		})
+		output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}}))
+		output.write("b.com", testResult(map[string]dnslink.NamespaceEntries{"ipns": {{Identifier: "b", Ttl: 100}}}))
+		output.end()
+		writer.Close()
+	}()
+	a.Equal("[\n", readLine())
+	a.Equal(`{"links":{"ipfs":["a"]},"lookup":"a.com","txtEntries":["/ipfs/a"]}`+"\n", readLine())
+	a.Equal(`,{"links":{"ipns":["b"]},"lookup":"b.com","txtEntries":["/ipns/b"]}`+"\n", readLine())
+	a.Equal("]\n", readLine())
+	_, err := lines.ReadString('\n')
+	a.Equal(io.EOF, err)
+}
+
+func TestWriteJSONDebug(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	result.Log = []dnslink.LogStatement{
+		{Code: "FALLBACK"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=", Reason: "WRONG_START"},
+	}
+	output := NewWriteJSON(WriteOptions{domains: []string{"a.com", "b.com"}, out: out, err: errOut, debug: true})
+	output.write("a.com", result)
+	output.write("b.com", result)
+	output.end()
+
+	parsed := []map[string]string{}
+	a.NoError(json.Unmarshal(errOut.Bytes(), &parsed))
+	a.Equal([]map[string]string{
+		{"code": "FALLBACK", "lookup": "a.com"},
+		{"code": "INVALID_ENTRY", "entry": "dnslink=", "reason": "WRONG_START", "lookup": "a.com"},
+		{"code": "FALLBACK", "lookup": "b.com"},
+		{"code": "INVALID_ENTRY", "entry": "dnslink=", "reason": "WRONG_START", "lookup": "b.com"},
+	}, parsed)
+	a.NoError(json.Unmarshal(out.Bytes(), &[]interface{}{}))
+}
+
+func TestWriteFail(t *testing.T) {
+	a := assert.New(t)
+	failed := dnslink.NewDNSRCodeError(3, "b.com")
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	result.Log = []dnslink.LogStatement{{Code: "FALLBACK"}}
+
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	output := NewWriteJSON(WriteOptions{domains: []string{"a.com", "b.com"}, out: out, err: errOut, debug: true})
+	output.write("a.com", result)
+	output.fail("b.com", failed)
+	output.end()
+	parsed := []map[string]string{}
+	a.NoError(json.Unmarshal(errOut.Bytes(), &parsed))
+	a.Equal([]map[string]string{
+		{"code": "FALLBACK", "lookup": "a.com"},
+		{"code": "ERROR", "entry": "b.com", "reason": failed.Error(), "lookup": "b.com"},
+	}, parsed)
+	a.NoError(json.Unmarshal(out.Bytes(), &[]interface{}{}))
+
+	// Without debug every failure is a line of json.
+	errOut.Reset()
+	output = NewWriteJSON(WriteOptions{domains: []string{"a.com", "b.com"}, out: &bytes.Buffer{}, err: errOut})
+	output.fail("a.com", failed)
+	output.fail("b.com", failed)
+	a.Equal(2, strings.Count(errOut.String(), "\n"))
+	a.NotContains(errOut.String(), "[")
+
+	errOut.Reset()
+	NewWriteTXT(WriteOptions{domains: []string{"b.com"}, err: errOut}).fail("b.com", failed)
+	a.Equal("[ERROR] entry=b.com reason="+failed.Error()+"\n", errOut.String())
+
+	errOut.Reset()
+	NewWriteCSV(WriteOptions{domains: []string{"b.com"}, out: &bytes.Buffer{}, err: errOut}).fail("b.com", failed)
+	a.Equal("code,entry,reason\n"+csv("ERROR", "b.com", failed.Error())+"\n", errOut.String())
+
+	// Only the first of several formats reports the failure.
+	errOut.Reset()
+	targets := []outputTarget{{"txt", &bytes.Buffer{}}, {"csv", &bytes.Buffer{}}}
+	newMultiWriter(targets, WriteOptions{domains: []string{"b.com"}, err: errOut}).fail("b.com", failed)
+	a.Equal(1, strings.Count(errOut.String(), "\n"))
+}
+
+func TestExitCode(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(exitNotFound, exitCode(dnslink.NewDNSRCodeError(3, "a.com")))
+	a.Equal(exitNetwork, exitCode(dnslink.NewDNSRCodeError(2, "a.com")))
+	a.Equal(exitNetwork, exitCode(dnslink.TimeoutError{Domain: "a.com", Server: "1.1.1.1:53"}))
+	a.Equal(exitNetwork, exitCode(&net.OpError{Op: "read", Net: "udp", Err: errors.New("connection refused")}))
+	a.Equal(exitFailed, exitCode(errors.New("EMPTY_PART")))
+	a.Equal(exitFailed, exitCode(dnslink.RecursiveLoopError{Domain: "a.com", Reason: "CYCLE"}))
+}
+
+func TestWriteFlush(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	buffered := bufio.NewWriter(out)
+	output := NewWriteTXT(WriteOptions{
+		domains: []string{"a.com"},
+		out:     buffered,
+		err:     ioutil.Discard,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}}))
+	a.Equal("/ipfs/a\n", out.String())
+}
+
+func TestWriteCSVDelimiter(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a,b;c\td", Ttl: 100}}})
+	for _, test := range []struct {
+		delimiter string
+		expected  string
+	}{
+		{"", "lookup,namespace,identifier,ttl\n\"a.com\",\"ipfs\",\"a,b;c\td\",100\n"},
+		{",", "lookup,namespace,identifier,ttl\n\"a.com\",\"ipfs\",\"a,b;c\td\",100\n"},
+		{";", "lookup;namespace;identifier;ttl\n\"a.com\";\"ipfs\";\"a,b;c\td\";100\n"},
+		{"\t", "lookup\tnamespace\tidentifier\tttl\n\"a.com\"\t\"ipfs\"\t\"a,b;c\td\"\t100\n"},
+	} {
+		out := &bytes.Buffer{}
+		output := NewWriteCSV(WriteOptions{
+			domains:   []string{"a.com"},
+			out:       out,
+			err:       ioutil.Discard,
+			ttl:       true,
+			delimiter: test.delimiter,
+		})
+		output.write("a.com", result)
+		output.end()
+		a.Equal(test.expected, out.String())
+	}
+}
+
+func TestGetParallel(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getParallel(false)), arr(0, nil))
+	a.EqualValues(arr(getParallel("8")), arr(8, nil))
+	for _, invalid := range []interface{}{true, "", "0", "-1", "x"} {
+		_, err := getParallel(invalid)
+		a.Error(err)
+	}
+}
+
+func TestGetStdin(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getStdin([]string{"a.com", "b.com"})), arr(false, nil))
+	a.EqualValues(arr(getStdin([]string{"-"})), arr(true, nil))
+	_, err := getStdin([]string{"a.com", "-"})
+	a.Error(err)
+
+	options, lookups := getOptions([]string{"--ttl", "-"})
+	a.True(options.has("ttl"))
+	a.Equal([]string{"-"}, lookups)
+}
+
+func TestScanDomains(t *testing.T) {
+	input := strings.NewReader("a.com\n\n  b.com  \r\n# comment\n\t#indented comment\nc.com")
+	domains := []string{}
+	err := scanDomains(input, func(domain string) {
+		domains = append(domains, domain)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.com", "b.com", "c.com"}, domains)
+}
+
+func TestWriteJSONStdin(t *testing.T) {
+	out := &strings.Builder{}
+	// A single domain from stdin is framed like several.
+	output := NewWriteJSON(WriteOptions{stdin: true, out: out, err: &strings.Builder{}})
+	output.write("a.com", dnslink.Result{Links: map[string]dnslink.NamespaceEntries{}})
+	output.end()
+	assert.Equal(t, "[\n{\"links\":{},\"lookup\":\"a.com\",\"txtEntries\":[]}\n]\n", out.String())
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	a := assert.New(t)
+	out := &strings.Builder{}
+	errOut := &strings.Builder{}
+	output := newWriter("ndjson", WriteOptions{domains: []string{"a.com"}, out: out, err: errOut, debug: true, pretty: true})
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	result.Log = []dnslink.LogStatement{{Code: "FALLBACK"}}
+	output.write("a.com", result)
+	output.fail("b.com", errors.New("EMPTY_PART"))
+	output.end()
+	a.Equal(`{"links":{"ipfs":["a"]},"lookup":"a.com","txtEntries":["/ipfs/a"]}`+"\n", out.String())
+	a.Equal(`{"code":"FALLBACK","lookup":"a.com"}`+"\n"+
+		`{"code":"ERROR","entry":"b.com","lookup":"b.com","reason":"EMPTY_PART"}`+"\n", errOut.String())
+}
+
+func TestGetTimeout(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getTimeout(false)), arr(time.Duration(0), nil))
+	a.EqualValues(arr(getTimeout("500ms")), arr(500*time.Millisecond, nil))
+	for _, invalid := range []interface{}{true, "", "0s", "-1s", "5"} {
+		_, err := getTimeout(invalid)
+		a.Error(err)
+	}
+}
+
+func TestGetServers(t *testing.T) {
+	assert.Equal(t, []string{}, getServers([]interface{}{true}))
+	assert.Equal(t, []string{"1.1.1.1:53"}, getServers([]interface{}{"1.1.1.1"}))
+	assert.Equal(t, []string{"1.1.1.1:5353"}, getServers([]interface{}{"1.1.1.1:5353"}))
+	assert.Equal(t, []string{"[2606:4700:4700::1111]:53"}, getServers([]interface{}{"2606:4700:4700::1111"}))
+	assert.Equal(t, []string{"[2606:4700:4700::1111]:5353"}, getServers([]interface{}{"[2606:4700:4700::1111]:5353"}))
+	assert.Equal(t, []string{"dns.example:53", "[::1]:53"}, getServers([]interface{}{"dns.example", "[::1]"}))
+}
+
+func TestCSVDelimited(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(`"a",42,100,true,,"b""c"`, csvDelimited(",", "a", 42, uint32(100), true, nil, `b"c`))
+	a.Equal("-1;0", csvDelimited(";", -1, 0))
+}
+
+func TestGetDelimiter(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getDelimiter(false)), arr(",", nil))
+	a.EqualValues(arr(getDelimiter(";")), arr(";", nil))
+	a.EqualValues(arr(getDelimiter("tab")), arr("\t", nil))
+	for _, invalid := range []interface{}{true, "", ";;", `"`, "\n"} {
+		_, err := getDelimiter(invalid)
+		a.Error(err)
+	}
+}
+
+func TestGetTtlFormat(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getTtlFormat(false)), arr(false, nil))
+	a.EqualValues(arr(getTtlFormat("seconds")), arr(false, nil))
+	a.EqualValues(arr(getTtlFormat("human")), arr(true, nil))
+	for _, invalid := range []interface{}{true, "", "minutes"} {
+		_, err := getTtlFormat(invalid)
+		a.Error(err)
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	a := assert.New(t)
+	for seconds, expected := range map[uint32]string{0: "0s", 53: "53s", 60: "1m", 90: "1m30s", 3600: "1h", 5400: "1h30m", 86401: "24h0m1s"} {
+		a.Equal(expected, humanDuration(time.Duration(seconds)*time.Second))
+	}
+}
+
+func TestWriteTtlFormat(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 5400}}})
+	for _, test := range []struct {
+		humanTtl bool
+		txt      string
+		csv      string
+		json     string
+	}{
+		{
+			humanTtl: false,
+			txt:      "/ipfs/a [ttl=5400]\n",
+			csv:      "lookup,namespace,identifier,ttl\n\"a.com\",\"ipfs\",\"a\",5400\n",
+			json:     `{"links":{"ipfs":[{"identifier":"a","ttl":5400}]},"txtEntries":[{"value":"/ipfs/a","ttl":5400}]}` + "\n",
+		},
+		{
+			humanTtl: true,
+			txt:      "/ipfs/a [ttl=1h30m]\n",
+			csv:      "lookup,namespace,identifier,ttl\n\"a.com\",\"ipfs\",\"a\",\"1h30m\"\n",
+			json:     `{"links":{"ipfs":[{"identifier":"a","ttl":"1h30m"}]},"txtEntries":[{"value":"/ipfs/a","ttl":"1h30m"}]}` + "\n",
+		},
+	} {
+		options := WriteOptions{domains: []string{"a.com"}, err: ioutil.Discard, ttl: true, humanTtl: test.humanTtl}
+		out := &bytes.Buffer{}
+		options.out = out
+		NewWriteTXT(options).write("a.com", result)
+		a.Equal(test.txt, out.String())
+		out.Reset()
+		NewWriteCSV(options).write("a.com", result)
+		a.Equal(test.csv, out.String())
+		out.Reset()
+		NewWriteJSON(options).write("a.com", result)
+		a.Equal(test.json, out.String())
+	}
+}
+
+func TestWriteFingerprint(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	out := &bytes.Buffer{}
+	output := NewWriteFingerprint(WriteOptions{domains: []string{"a.com"}, out: out, err: ioutil.Discard})
+	output.write("a.com", result)
+	output.end()
+	a.Equal(result.Fingerprint()+"\n", out.String())
+
+	out.Reset()
+	output = NewWriteFingerprint(WriteOptions{domains: []string{"a.com", "b.com"}, out: out, err: ioutil.Discard})
+	output.write("a.com", result)
+	output.write("b.com", result)
+	a.Equal("a.com: "+result.Fingerprint()+"\nb.com: "+result.Fingerprint()+"\n", out.String())
+}
+
+func TestWatch(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan time.Time)
+	intervals := []time.Duration{}
+	after := func(interval time.Duration) <-chan time.Time {
+		intervals = append(intervals, interval)
+		return ticks
+	}
+	polls := 0
+	done := make(chan struct{})
+	go func() {
+		watch(ctx, time.Minute, after, func() {
+			polls++
+			if polls == 3 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watch didn't stop after cancel")
+	}
+	a.Equal(3, polls)
+	a.Equal([]time.Duration{time.Minute, time.Minute, time.Minute}, intervals)
+}
+
+func TestWatchShortInterval(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	polls := 0
+	watch(ctx, 10*time.Millisecond, time.After, func() { polls++ })
+	a.GreaterOrEqual(polls, 3)
+	a.LessOrEqual(polls, 12)
+}
+
+func TestGetInterval(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getInterval(false)), arr(time.Duration(0), nil))
+	a.EqualValues(arr(getInterval("60")), arr(time.Minute, nil))
+	a.EqualValues(arr(getInterval("1m30s")), arr(90*time.Second, nil))
+	for _, invalid := range []interface{}{true, "", "foo", "-1s", "0s"} {
+		_, err := getInterval(invalid)
+		a.Error(err)
+	}
+}
+
+func TestWriteTimestamp(t *testing.T) {
+	a := assert.New(t)
+	timestamp := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "a", Ttl: 100}}})
+	out := &bytes.Buffer{}
+	NewWriteTXT(WriteOptions{domains: []string{"a.com"}, out: out, err: ioutil.Discard, timestamp: timestamp}).write("a.com", result)
+	a.Equal("2021-07-01T10:00:00Z /ipfs/a\n", out.String())
+	out.Reset()
+	NewWriteCSV(WriteOptions{domains: []string{"a.com"}, out: out, err: ioutil.Discard, timestamp: timestamp}).write("a.com", result)
+	a.Equal("time,lookup,namespace,identifier\n\"2021-07-01T10:00:00Z\",\"a.com\",\"ipfs\",\"a\"\n", out.String())
+	out.Reset()
+	NewWriteJSON(WriteOptions{domains: []string{"a.com"}, out: out, err: ioutil.Discard, timestamp: timestamp}).write("a.com", result)
+	a.Equal(`{"links":{"ipfs":["a"]},"time":"2021-07-01T10:00:00Z","txtEntries":["/ipfs/a"]}`+"\n", out.String())
+}
+
+func TestAudit(t *testing.T) {
+	a := assert.New(t)
+	mock := &mockDNS{entries: map[string][]string{
+		"foo.com": {"dnslink=/ipfs/a"},
+	}}
+	out := &bytes.Buffer{}
+	failures := NewWriteTXT(WriteOptions{domains: []string{"foo.com"}, out: ioutil.Discard, err: ioutil.Discard})
+	a.Equal(0, audit(&dnslink.Resolver{LookupTXT: mock.lookupTXT}, []string{"foo.com"}, out, failures))
+	a.Equal(`{"domain":"foo.com","prefixed":{"name":"_dnslink.foo.com","exists":false,"entries":[]},"bare":{"name":"foo.com","exists":true,"entries":["dnslink=/ipfs/a"]},"conflict":false,"invalid":[],"duplicates":[],"longEntries":[],"recommendations":["Move the dnslink entries from foo.com to _dnslink.foo.com."]}`+"\n", out.String())
+}
+
+func TestAuditInvalidDomain(t *testing.T) {
+	a := assert.New(t)
+	mock := &mockDNS{entries: map[string][]string{
+		"foo.com": {"dnslink=/ipfs/a"},
+	}}
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	failures := NewWriteJSON(WriteOptions{domains: []string{"bar..com", "foo.com"}, out: ioutil.Discard, err: errOut})
+	code := audit(&dnslink.Resolver{LookupTXT: mock.lookupTXT}, []string{"bar..com", "foo.com"}, out, failures)
+	a.Equal(exitFailed, code)
+	a.Equal(`{"code":"ERROR","entry":"bar..com","lookup":"bar..com","reason":"EMPTY_PART"}`+"\n", errOut.String())
+	// The other domains are still audited.
+	a.Contains(out.String(), `{"domain":"foo.com",`)
+}
+
+func arr(input ...interface{}) []interface{} {
+	return input
+}
+
+func TestMultipleFormats(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+	txtPath := filepath.Join(dir, "links.txt")
+	csvPath := filepath.Join(dir, "links.csv")
+	options, _ := getOptions([]string{"--format=txt,csv", "--out-txt=" + txtPath, "--out-csv=" + csvPath, "a.com"})
+	formats := getFormats(options.get("format", "f"))
+	a.Equal([]string{"txt", "csv"}, formats)
+	stdout := &bytes.Buffer{}
+	targets, closeTargets, err := openTargets(formats, &options, stdout)
+	a.NoError(err)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "abcd", Ttl: 100}}})
+	writeOpts := WriteOptions{
+		domains: []string{"a.com"},
+		err:     ioutil.Discard,
+		ttl:     true,
+	}
+	output := newMultiWriter(targets, writeOpts)
+	output.write("a.com", result)
+	output.end()
+	a.NoError(closeTargets())
+	a.Equal("", stdout.String())
+
+	expected := func(format string) string {
+		out := &bytes.Buffer{}
+		single := writeOpts
+		single.out = out
+		output := newWriter(format, single)
+		output.write("a.com", result)
+		output.end()
+		return out.String()
+	}
+	txt, err := ioutil.ReadFile(txtPath)
+	a.NoError(err)
+	a.Equal(expected("txt"), string(txt))
+	csv, err := ioutil.ReadFile(csvPath)
+	a.NoError(err)
+	a.Equal(expected("csv"), string(csv))
+	a.Contains(string(csv), "\"a.com\",\"ipfs\",\"abcd\",100")
+}
+
+func TestGetFormats(t *testing.T) {
+	a := assert.New(t)
+	a.Equal([]string{"txt"}, getFormats([]interface{}{}))
+	a.Equal([]string{"txt"}, getFormats([]interface{}{"yaml"}))
+	a.Equal([]string{"json"}, getFormats([]interface{}{"json"}))
+	a.Equal([]string{"json", "csv"}, getFormats([]interface{}{"json,csv"}))
+	a.Equal([]string{"csv", "txt"}, getFormats([]interface{}{"csv", "txt"}))
+}
+
+func TestWriteTXTDebug(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{})
+	result.Log = []dnslink.LogStatement{
+		{Code: "INVALID_ENTRY", Entry: "dnslink=ipfs/abcd", Reason: "WRONG_START"},
+		{Code: "SOMETHING_NEW"},
+	}
+	errOut := &bytes.Buffer{}
+	output := NewWriteTXT(WriteOptions{
+		domains: []string{"a.com"},
+		out:     ioutil.Discard,
+		err:     errOut,
+		debug:   true,
+	})
+	output.write("a.com", result)
+	output.end()
+	a.Equal("[INVALID_ENTRY] DNSLink entry must start with a '/'. entry=dnslink=ipfs/abcd reason=WRONG_START\n[SOMETHING_NEW]\n", errOut.String())
+}
+
+func TestWriteEnv(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	output := NewWriteEnv(WriteOptions{
+		domains: []string{"a.com", "b.com"},
+		out:     out,
+		err:     ioutil.Discard,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs":  {{Identifier: "QmA", Ttl: 100}, {Identifier: "it's", Ttl: 100}},
+		"my-ns": {{Identifier: "x y", Ttl: 100}},
+		"my_ns": {{Identifier: "z", Ttl: 100}},
+		"$(rm)": {{Identifier: "$(rm -rf /)", Ttl: 100}},
+	}))
+	output.write("b.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmB", Ttl: 100}},
+	}))
+	output.end()
+	a.Equal(`DNSLINK___RM_='$(rm -rf /)'
+DNSLINK_IPFS='QmA'
+DNSLINK_IPFS_1='it'\''s'
+DNSLINK_MY_NS='x y'
+DNSLINK_MY_NS_1='z'
+DNSLINK_IPFS_2='QmB'
+`, out.String())
+
+	out.Reset()
+	output = NewWriteEnv(WriteOptions{
+		domains:   []string{"a.com"},
+		out:       out,
+		err:       ioutil.Discard,
+		namespace: "ipfs",
+		first:     true,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB", Ttl: 100}},
+		"dns":  {{Identifier: "b.com", Ttl: 100}},
+	}))
+	a.Equal("DNSLINK_IPFS='QmA'\n", out.String())
+}
+
+func TestGetNamespace(t *testing.T) {
+	for _, test := range []struct {
+		args      []string
+		namespace string
+		first     bool
+		err       string
+	}{
+		{args: []string{}},
+		{args: []string{"--first"}, first: true},
+		{args: []string{"--first=ipfs"}, namespace: "ipfs", first: true},
+		{args: []string{"--ns=ipfs"}, namespace: "ipfs"},
+		{args: []string{"-n=ipfs"}, namespace: "ipfs"},
+		{args: []string{"--first", "--ns=ipfs"}, namespace: "ipfs", first: true},
+		{args: []string{"--first=ipfs", "--ns=ipfs"}, namespace: "ipfs", first: true},
+		{args: []string{"--first=ipfs", "--ns=ipns"}, err: "--first=ipfs can not be combined with --ns=ipns"},
+		{args: []string{"--ns"}, err: "--ns requires a namespace, e.g. --ns=ipfs"},
+		{args: []string{"--ns="}, err: "--ns requires a namespace, e.g. --ns=ipfs"},
+	} {
+		options, _ := getOptions(test.args)
+		namespace, first, err := getNamespace(options.first("first"), options.first("ns", "n"))
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.args)
+			continue
+		}
+		assert.NoError(t, err, test.args)
+		assert.Equal(t, test.namespace, namespace, test.args)
+		assert.Equal(t, test.first, first, test.args)
+	}
+}
+
+func TestWriteFirst(t *testing.T) {
+	result := testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB", Ttl: 100}},
+		"ipns": {{Identifier: "a.com", Ttl: 100}, {Identifier: "b.com", Ttl: 100}},
+	})
+	for _, test := range []struct {
+		args []string
+		txt  []string
+		csv  []string
+	}{
+		{
+			args: []string{"--first"},
+			txt:  []string{"/ipfs/QmA", "/ipns/a.com"},
+			csv:  []string{`"a.com","ipfs","QmA"`, `"a.com","ipns","a.com"`},
+		},
+		{
+			args: []string{"--first=ipfs"},
+			txt:  []string{"QmA"},
+			csv:  []string{`"a.com","ipfs","QmA"`},
+		},
+		{
+			args: []string{"--ns=ipfs"},
+			txt:  []string{"QmA", "QmB"},
+			csv:  []string{`"a.com","ipfs","QmA"`, `"a.com","ipfs","QmB"`},
+		},
+		{
+			args: []string{"--first", "--ns=ipns"},
+			txt:  []string{"a.com"},
+			csv:  []string{`"a.com","ipns","a.com"`},
+		},
+	} {
+		options, _ := getOptions(test.args)
+		namespace, first, err := getNamespace(options.first("first"), options.first("ns", "n"))
+		assert.NoError(t, err, test.args)
+		for _, format := range []string{"txt", "csv"} {
+			out := &strings.Builder{}
+			output := newWriter(format, WriteOptions{domains: []string{"a.com"}, out: out, err: ioutil.Discard, namespace: namespace, first: first})
+			output.write("a.com", result)
+			output.end()
+			// The namespaces are rendered in random order.
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			expected := test.txt
+			if format == "csv" {
+				assert.Equal(t, "lookup,namespace,identifier", lines[0], test.args)
+				lines = lines[1:]
+				expected = test.csv
+			}
+			sort.Strings(lines)
+			assert.Equal(t, expected, lines, format, test.args)
+		}
+	}
+}
+
+func TestWriteProperties(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	output := NewWriteProperties(WriteOptions{
+		domains: []string{"a.com", "b.com"},
+		out:     out,
+		err:     ioutil.Discard,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs":  {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB", Ttl: 100}},
+		"my ns": {{Identifier: " a=b:c#d!e\\f g", Ttl: 100}},
+	}))
+	output.write("b.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmC", Ttl: 100}},
+	}))
+	output.end()
+	a.Equal(`a.com.ipfs.0=QmA
+a.com.ipfs.1=QmB
+a.com.my\ ns=\ a\=b\:c\#d\!e\\f g
+b.com.ipfs=QmC
+`, out.String())
+
+	out.Reset()
+	output = NewWriteProperties(WriteOptions{
+		domains:   []string{"a.com"},
+		out:       out,
+		err:       ioutil.Discard,
+		namespace: "ipfs",
+		first:     true,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB", Ttl: 100}},
+		"dns":  {{Identifier: "b.com", Ttl: 100}},
+	}))
+	a.Equal("a.com.ipfs=QmA\n", out.String())
+}
+
+func TestWriteIPFS(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	output := NewWriteIPFS(WriteOptions{
+		domains: []string{"a.com"},
+		out:     out,
+		err:     ioutil.Discard,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs":  {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB/it's", Ttl: 100}},
+		"ipns":  {{Identifier: "k51", Ttl: 100}},
+		"https": {{Identifier: "example.com", Ttl: 100}},
+	}))
+	output.end()
+	a.Equal(`# skipped /https/example.com of a.com
+ipfs pin add '/ipfs/QmA'
+ipfs pin add '/ipfs/QmB/it'\''s'
+ipfs name resolve '/ipns/k51'
+`, out.String())
+
+	out.Reset()
+	output = NewWriteIPFS(WriteOptions{
+		domains:   []string{"a.com"},
+		out:       out,
+		err:       ioutil.Discard,
+		namespace: "ipfs",
+		first:     true,
+	})
+	output.write("a.com", testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}, {Identifier: "QmB", Ttl: 100}},
+		"ipns": {{Identifier: "k51", Ttl: 100}},
+	}))
+	a.Equal("ipfs pin add '/ipfs/QmA'\n", out.String())
+}
+
+func TestPropertiesEscape(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("\\u00e9\\ud83d\\ude00\\u000a", propertiesEscape("é😀\n", false))
+}
+
+func TestWriteJSONDeterministic(t *testing.T) {
+	a := assert.New(t)
+	entries := []dnslink.LookupEntry{
+		{Value: "dnslink=/ipfs/b", Ttl: 100},
+		{Value: "dnslink=/ipfs/a", Ttl: 200},
+		{Value: "dnslink=/ipfs/a", Ttl: 100},
+		{Value: "dnslink=/ipns/c", Ttl: 100},
+		{Value: "dnslink=/dns/d", Ttl: 100},
+	}
+	golden := `[
+{"links":{"dns":[{"identifier":"d","ttl":100}],"ipfs":[{"identifier":"a","ttl":100},{"identifier":"a","ttl":200},{"identifier":"b","ttl":100}],"ipns":[{"identifier":"c","ttl":100}]},"lookup":"a.com","txtEntries":[{"value":"/dns/d","ttl":100},{"value":"/ipfs/a","ttl":100},{"value":"/ipfs/a","ttl":200},{"value":"/ipfs/b","ttl":100},{"value":"/ipns/c","ttl":100}]}
+,{"links":{"dns":[{"identifier":"d","ttl":100}],"ipfs":[{"identifier":"a","ttl":100},{"identifier":"a","ttl":200},{"identifier":"b","ttl":100}],"ipns":[{"identifier":"c","ttl":100}]},"lookup":"b.com","txtEntries":[{"value":"/dns/d","ttl":100},{"value":"/ipfs/a","ttl":100},{"value":"/ipfs/a","ttl":200},{"value":"/ipfs/b","ttl":100},{"value":"/ipns/c","ttl":100}]}
+]
+`
+	for round := 0; round < 20; round++ {
+		// Rotate the answer like a round-robin name server would.
+		shuffled := append(append([]dnslink.LookupEntry{}, entries[round%len(entries):]...), entries[:round%len(entries)]...)
+		if round%2 == 1 {
+			for i, j := 0, len(shuffled)-1; i < j; i, j = i+1, j-1 {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			}
+		}
+		// Duplicates are kept to check that they are sorted by ttl.
+		resolver := dnslink.Resolver{KeepDuplicateEntries: true, LookupTXT: func(name string) ([]dnslink.LookupEntry, error) {
+			return shuffled, nil
+		}}
+		out := &bytes.Buffer{}
+		output := NewWriteJSON(WriteOptions{
+			domains: []string{"a.com", "b.com"},
+			out:     out,
+			err:     ioutil.Discard,
+			ttl:     true,
+		})
+		for _, lookup := range []string{"a.com", "b.com"} {
+			result, err := resolver.Resolve(lookup)
+			a.NoError(err)
+			output.write(lookup, result)
+		}
+		output.end()
+		a.Equal(golden, out.String())
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "cache.json")
+	a.NoError(ioutil.WriteFile(path, []byte(`{
+		"dnslink.dev.": {"links": {"ipfs": [{"identifier": "QmA", "ttl": 60}]}, "txtEntries": [{"value": "/ipfs/QmA", "ttl": 60}]},
+		"Other.com": {"links": {}, "log": [{"code": "FALLBACK"}]}
+	}`), 0644))
+	cache, err := loadCacheFile(path)
+	a.NoError(err)
+
+	result, err := cache.resolve("dnslink.dev")
+	a.NoError(err)
+	a.Equal(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "QmA", Ttl: 60}}}, result.Links)
+	a.Equal([]dnslink.TxtEntry{{Value: "/ipfs/QmA", Ttl: 60}}, result.TxtEntries)
+	a.Equal([]dnslink.LogStatement{}, result.Log)
+
+	result, err = cache.resolve("other.com.")
+	a.NoError(err)
+	a.Equal([]dnslink.LogStatement{{Code: "FALLBACK"}}, result.Log)
+	a.Equal([]dnslink.TxtEntry{}, result.TxtEntries)
+
+	_, err = cache.resolve("missing.com")
+	a.EqualError(err, "missing.com is not in the cache file")
+
+	_, err = loadCacheFile(filepath.Join(t.TempDir(), "missing.json"))
+	a.Error(err)
+	a.NoError(ioutil.WriteFile(path, []byte(`[]`), 0644))
+	_, err = loadCacheFile(path)
+	a.Error(err)
+}
+
+func TestStripNamespace(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}},
+		"ipns": {{Identifier: "k51", Ttl: 100}},
+	})
+	render := func(format string, ttl bool) string {
+		out := &bytes.Buffer{}
+		output := newWriter(format, WriteOptions{
+			domains: []string{"a.com"},
+			out:     out,
+			err:     ioutil.Discard,
+			ttl:     ttl,
+			stripNS: true,
+		})
+		output.write("a.com", result)
+		output.end()
+		return out.String()
+	}
+	a.Equal(`{"ipfs":["QmA"],"ipns":["k51"]}`+"\n", render("json", false))
+	a.Equal(`{"ipfs":[{"identifier":"QmA","ttl":100}],"ipns":[{"identifier":"k51","ttl":100}]}`+"\n", render("json", true))
+	a.Equal(`{"ipfs":["QmA"],"ipns":["k51"],"lookup":"a.com"}`+"\n", render("ndjson", false))
+	out := &bytes.Buffer{}
+	output := NewWriteJSON(WriteOptions{domains: []string{"a.com", "b.com"}, out: out, err: ioutil.Discard, stripNS: true})
+	output.write("a.com", result)
+	output.write("b.com", result)
+	output.end()
+	a.Equal(`[
+{"ipfs":["QmA"],"ipns":["k51"],"lookup":"a.com"}
+,{"ipfs":["QmA"],"ipns":["k51"],"lookup":"b.com"}
+]
+`, out.String())
+	txt := render("txt", false)
+	a.Contains(txt, "QmA\n")
+	a.Contains(txt, "k51\n")
+	a.NotContains(txt, "/")
+	a.Equal("lookup,namespace,identifier\n\"a.com\",\"ipfs\",\"QmA\"\n\"a.com\",\"ipns\",\"k51\"\n", sortedCSV(render("csv", false)))
+	a.Equal("DNSLINK_IPFS='QmA'\nDNSLINK_IPNS='k51'\n", render("env", false))
+}
+
+// sortedCSV sorts the rows after the header, the csv writer renders the
+// namespaces in map order.
+func sortedCSV(csv string) string {
+	lines := strings.Split(strings.TrimSuffix(csv, "\n"), "\n")
+	sort.Strings(lines[1:])
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestFilterIdentifier(t *testing.T) {
+	a := assert.New(t)
+	filter, err := getFilter("^bafy")
+	a.NoError(err)
+	result := testResult(map[string]dnslink.NamespaceEntries{
+		"ipfs": {{Identifier: "QmA", Ttl: 100}, {Identifier: "bafyB", Ttl: 100}},
+		"ipns": {{Identifier: "k51", Ttl: 100}},
+	})
+	result.Log = []dnslink.LogStatement{{Code: "FALLBACK"}}
+	out := &bytes.Buffer{}
+	output := &filterWriter{NewWriteTXT(WriteOptions{
+		domains: []string{"a.com"},
+		out:     out,
+		err:     ioutil.Discard,
+	}), filter}
+	output.write("a.com", result)
+	output.end()
+	a.Equal("/ipfs/bafyB\n", out.String())
+
+	filtered := filterIdentifiers(result, filter)
+	a.Equal(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "bafyB", Ttl: 100}}}, filtered.Links)
+	a.Equal([]dnslink.TxtEntry{{Value: "/ipfs/bafyB", Ttl: 100}}, filtered.TxtEntries)
+	a.Equal(result.Log, filtered.Log)
+	// The original result is untouched.
+	a.Len(result.Links["ipfs"], 2)
+	a.Len(result.TxtEntries, 3)
+
+	filtered = filterIdentifiers(result, regexp.MustCompile("^nothing"))
+	a.Equal(map[string]dnslink.NamespaceEntries{}, filtered.Links)
+	a.Equal([]dnslink.TxtEntry{}, filtered.TxtEntries)
+}
+
+func TestGetFilter(t *testing.T) {
+	a := assert.New(t)
+	filter, err := getFilter(false)
+	a.Nil(filter)
+	a.NoError(err)
+	_, err = getFilter(true)
+	a.EqualError(err, "--filter-identifier requires a pattern, e.g. --filter-identifier=^bafy")
+	_, err = getFilter("[bafy")
+	a.EqualError(err, "invalid --filter-identifier pattern: error parsing regexp: missing closing ]: `[bafy`")
+}
+
+func TestSyncWriter(t *testing.T) {
+	a := assert.New(t)
+	lookups := []string{}
+	for index := 0; index < 50; index++ {
+		lookups = append(lookups, fmt.Sprintf("%d.com", index))
+	}
+	out := &bytes.Buffer{}
+	output := newSyncWriter(NewWriteJSON(WriteOptions{
+		domains: lookups,
+		out:     out,
+		err:     ioutil.Discard,
+	}))
+	var wg sync.WaitGroup
+	for _, lookup := range lookups {
+		wg.Add(1)
+		go func(lookup string) {
+			defer wg.Done()
+			output.write(lookup, testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: lookup, Ttl: 100}}}))
+		}(lookup)
+	}
+	wg.Wait()
+	output.end()
+
+	parsed := []struct {
+		Lookup string              `json:"lookup"`
+		Links  map[string][]string `json:"links"`
+	}{}
+	a.NoError(json.Unmarshal(out.Bytes(), &parsed))
+	found := []string{}
+	for _, entry := range parsed {
+		a.Equal([]string{entry.Lookup}, entry.Links["ipfs"])
+		found = append(found, entry.Lookup)
+	}
+	a.ElementsMatch(lookups, found)
+}
+
+func TestShowConfig(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	a.NoError(showConfig(&dnslink.Resolver{}, []string{"1.1.1.1:53"}, []string{}, out))
+	parsed := map[string]interface{}{}
+	a.NoError(json.Unmarshal(out.Bytes(), &parsed))
+	a.Equal([]interface{}{"1.1.1.1:53"}, parsed["dns"])
+	a.Equal([]interface{}{}, parsed["doh"])
+	a.Equal("system", parsed["resolver"].(map[string]interface{})["lookup"])
+}
+
+func TestGetDoHEndpoints(t *testing.T) {
+	a := assert.New(t)
+	a.Equal([]string{}, getDoHEndpoints(nil, ""))
+	a.Equal([]string{"https://a/dns-query", "https://b/dns-query"}, getDoHEndpoints(nil, " https://a/dns-query, ,https://b/dns-query"))
+	// The --doh option takes precedence over the environment.
+	a.Equal([]string{"https://c/dns-query", "https://d/dns-query"}, getDoHEndpoints([]interface{}{"https://c/dns-query,https://d/dns-query"}, "https://a/dns-query"))
+	a.Equal([]string{"https://a/dns-query"}, getDoHEndpoints([]interface{}{true}, "https://a/dns-query"))
+}
+
+func TestIncludeEmpty(t *testing.T) {
+	a := assert.New(t)
+	empty := testResult(map[string]dnslink.NamespaceEntries{})
+	links := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "QmA", Ttl: 100}}})
+	render := func(format string, ttl bool, includeEmpty bool) string {
+		out := &bytes.Buffer{}
+		output := newWriter(format, WriteOptions{
+			domains:      []string{"a.com", "b.com"},
+			out:          out,
+			err:          ioutil.Discard,
+			ttl:          ttl,
+			includeEmpty: includeEmpty,
+		})
+		output.write("a.com", empty)
+		output.write("b.com", links)
+		output.end()
+		return out.String()
+	}
+	a.Equal("lookup,namespace,identifier\n\"b.com\",\"ipfs\",\"QmA\"\n", render("csv", false, false))
+	a.Equal("lookup,namespace,identifier\n\"a.com\",,\n\"b.com\",\"ipfs\",\"QmA\"\n", render("csv", false, true))
+	a.Equal("lookup,namespace,identifier,ttl\n\"a.com\",,,\n\"b.com\",\"ipfs\",\"QmA\",100\n", render("csv", true, true))
+	json := "[\n{\"links\":{},\"lookup\":\"a.com\",\"txtEntries\":[]}\n,{\"links\":{\"ipfs\":[\"QmA\"]},\"lookup\":\"b.com\",\"txtEntries\":[\"/ipfs/QmA\"]}\n]\n"
+	a.Equal(json, render("json", false, true))
+	a.Equal(json, render("json", false, false))
+}
+
+func TestWriteDig(t *testing.T) {
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	output := NewWriteDig(WriteOptions{
+		domains: []string{"a.com", "b.com"},
+		out:     out,
+		err:     ioutil.Discard,
+	})
+	output.write("a.com", dnslink.Result{
+		TxtEntries: []dnslink.TxtEntry{
+			{Value: "/ipfs/QmA", Ttl: 100, Source: dnslink.SourcePrefixed},
+			{Value: "/ipns/with \"quote\"", Ttl: 30, Source: dnslink.SourcePrefixed},
+		},
+	})
+	output.write("b.com", dnslink.Result{
+		TxtEntries: []dnslink.TxtEntry{
+			{Value: "/ipfs/" + strings.Repeat("a", 260), Ttl: 60, Source: dnslink.SourceBare},
+		},
+	})
+	output.end()
+	a.Equal(`;; ANSWER SECTION:
+_dnslink.a.com.	100	IN	TXT	"dnslink=/ipfs/QmA"
+_dnslink.a.com.	30	IN	TXT	"dnslink=/ipns/with \"quote\""
+
+;; ANSWER SECTION:
+b.com.	60	IN	TXT	"dnslink=/ipfs/`+strings.Repeat("a", 241)+`" "`+strings.Repeat("a", 19)+`"
+`, out.String())
+}
+
+func TestGraph(t *testing.T) {
+	a := assert.New(t)
+	results := map[string]map[string]dnslink.NamespaceEntries{
+		"a.com": {
+			"dnslink": {{Identifier: "b.com/path", Ttl: 100}},
+			"ipfs":    {{Identifier: "QmA", Ttl: 100}},
+			"ipns":    {{Identifier: "c.com", Ttl: 100}, {Identifier: "k51", Ttl: 100}},
+		},
+		"b.com": {
+			"dnslink": {{Identifier: "a.com", Ttl: 100}, {Identifier: "missing.com", Ttl: 100}},
+		},
+		"c.com": {
+			"ipfs": {{Identifier: "QmC", Ttl: 100}},
+		},
+	}
+	resolve := func(domain string) (dnslink.Result, error) {
+		links, ok := results[domain]
+		if !ok {
+			return dnslink.Result{}, fmt.Errorf("no dnslink for %s", domain)
+		}
+		return testResult(links), nil
+	}
+	out := &bytes.Buffer{}
+	a.Equal(0, graph(resolve, []string{"a.com"}, maxGraphDepth, out))
+	a.Equal(`{"to":"a.com"}
+{"from":"a.com","link":"/ipfs/QmA"}
+{"from":"a.com","link":"/ipns/k51"}
+{"from":"a.com","link":"/dnslink/b.com/path","to":"b.com"}
+{"from":"b.com","link":"/dnslink/a.com","to":"a.com"}
+{"from":"a.com","link":"/ipns/c.com","to":"c.com"}
+{"from":"c.com","link":"/ipfs/QmC"}
+{"from":"b.com","link":"/dnslink/missing.com","to":"missing.com","error":"no dnslink for missing.com"}
+`, out.String())
+
+	out.Reset()
+	a.Equal(0, graph(resolve, []string{"a.com"}, 0, out))
+	a.Equal(`{"to":"a.com"}
+{"from":"a.com","link":"/dnslink/b.com/path","to":"b.com"}
+{"from":"a.com","link":"/ipfs/QmA"}
+{"from":"a.com","link":"/ipns/c.com","to":"c.com"}
+{"from":"a.com","link":"/ipns/k51"}
+`, out.String())
+}
+
+func TestGraphFailedRoots(t *testing.T) {
+	a := assert.New(t)
+	resolve := func(domain string) (dnslink.Result, error) {
+		return (&dnslink.Resolver{}).Resolve(domain)
+	}
+	buffer := &bytes.Buffer{}
+	out := bufio.NewWriter(buffer)
+	a.Equal(exitFailed, graph(resolve, []string{"a..com", "b..com"}, maxGraphDepth, out))
+	// The edges are flushed although no domain was resolved.
+	a.Equal(`{"to":"a..com","error":"EMPTY_PART"}
+{"to":"b..com","error":"EMPTY_PART"}
+`, buffer.String())
+}
+
+func TestGetNetwork(t *testing.T) {
+	a := assert.New(t)
+	a.EqualValues(arr(getNetwork(false, false)), arr("", nil))
+	a.EqualValues(arr(getNetwork(true, false)), arr("udp4", nil))
+	a.EqualValues(arr(getNetwork(false, true)), arr("udp6", nil))
+	_, err := getNetwork(true, true)
+	a.EqualError(err, "--ip4 and --ip6 can not be combined")
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	a := assert.New(t)
+	result := testResult(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "QmA", Ttl: 100}}})
+	render := func(pretty bool) string {
+		out := &bytes.Buffer{}
+		output := NewWriteJSON(WriteOptions{
+			domains: []string{"a.com", "b.com"},
+			out:     out,
+			err:     ioutil.Discard,
+			pretty:  pretty,
+		})
+		output.write("a.com", result)
+		output.write("b.com", result)
+		output.end()
+		return out.String()
+	}
+	a.Equal(`[
+{"links":{"ipfs":["QmA"]},"lookup":"a.com","txtEntries":["/ipfs/QmA"]}
+,{"links":{"ipfs":["QmA"]},"lookup":"b.com","txtEntries":["/ipfs/QmA"]}
+]
+`, render(false))
+	a.Equal(`[
+{
+  "links": {
+    "ipfs": [
+      "QmA"
+    ]
+  },
+  "lookup": "a.com",
+  "txtEntries": [
+    "/ipfs/QmA"
+  ]
+}
+,{
+  "links": {
+    "ipfs": [
+      "QmA"
+    ]
+  },
+  "lookup": "b.com",
+  "txtEntries": [
+    "/ipfs/QmA"
+  ]
+}
+]
+`, render(true))
+	parsed := []interface{}{}
+	a.NoError(json.Unmarshal([]byte(render(true)), &parsed))
+	a.Len(parsed, 2)
+}
+
+func TestResolveResponseFile(t *testing.T) {
+	a := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("_dnslink.dnslink.dev.", dns.TypeTXT)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: "_dnslink.dnslink.dev.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"dnslink=/ipfs/QmA"},
+	}}
+	raw, err := res.Pack()
+	a.NoError(err)
+	path := filepath.Join(t.TempDir(), "response.bin")
+	a.NoError(ioutil.WriteFile(path, raw, 0644))
+
+	lookup, result, err := resolveResponse(&dnslink.Resolver{}, path)
+	a.NoError(err)
+	a.Equal("dnslink.dev", lookup)
+	a.Equal(map[string]dnslink.NamespaceEntries{"ipfs": {{Identifier: "QmA", Ttl: 60, Source: dnslink.SourcePrefixed}}}, result.Links)
+
+	_, _, err = resolveResponse(&dnslink.Resolver{}, filepath.Join(t.TempDir(), "missing.bin"))
+	a.Error(err)
+}
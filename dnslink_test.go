@@ -1,11 +1,20 @@
 package dnslink
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/go-test/deep"
+	dns "github.com/miekg/dns"
 	assert "github.com/stretchr/testify/assert"
 )
 
@@ -43,6 +52,47 @@ func TestValidateDomain(t *testing.T) {
 	)
 }
 
+func TestValidateDomainExported(t *testing.T) {
+	assert.NoError(t, ValidateDomain("dnslink.dev"))
+	assert.NoError(t, ValidateDomain("_dnslink.dnslink.dev."))
+	assert.EqualError(t, ValidateDomain("hello..com"), "EMPTY_PART")
+	assert.EqualError(t, ValidateDomain(""), "EMPTY_PART")
+	assert.EqualError(t, ValidateDomain(strings.Repeat("a", 64)+".com"), "TOO_LONG")
+	assert.EqualError(t, ValidateDomain(strings.Repeat("a.", 130)+"com"), "TOO_LONG")
+}
+
+func TestInternationalizedDomain(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.xn--bcher-kva.example":  {"dnslink=/ipfs/books"},
+		"_dnslink.xn--r8jz45g.xn--zckzah": {"dnslink=/ipfs/example"},
+		"_dnslink._service.example":       {"dnslink=/ipfs/service"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	for domain, identifier := range map[string]string{
+		"bücher.example":           "books",
+		"BÜCHER.example":           "books",
+		"_dnslink.bücher.example.": "books",
+		"xn--bcher-kva.example":    "books",
+		"例え.テスト":                   "example",
+		"_service.example":         "service",
+	} {
+		result, err := r.Resolve(domain)
+		assert.NoError(t, err, domain)
+		assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+			"ipfs": {{Identifier: identifier, Ttl: 100, Source: SourcePrefixed}},
+		})
+	}
+
+	_, err := r.Resolve("ü_x.example")
+	assert.EqualError(t, err, "INVALID_IDN")
+	assert.EqualError(t, ValidateDomain("ü b.example"), "INVALID_IDN")
+	assert.NoError(t, ValidateDomain("bücher.example"))
+	// Labels are validated in their punycode form, which is shorter than the
+	// 80 bytes of UTF-8 here.
+	assert.NoError(t, ValidateDomain(strings.Repeat("ü", 40)+".example"))
+	assert.EqualError(t, ValidateDomain(strings.Repeat("ü", 30)+strings.Repeat("a", 30)+".example"), "TOO_LONG")
+}
+
 func TestValidateDNSLinkEntry(t *testing.T) {
 	assertResult(t, arr(validateDNSLinkEntry("dnslink=")), "", "", "WRONG_START")
 	assertResult(t, arr(validateDNSLinkEntry("dnslink=/")), "", "", "NAMESPACE_MISSING")
@@ -52,8 +102,18 @@ func TestValidateDNSLinkEntry(t *testing.T) {
 	assertResult(t, arr(validateDNSLinkEntry("dnslink=/ abcd /  efgh ")), " abcd ", "  efgh ", "")
 }
 
+func TestParseDNSLinkEntry(t *testing.T) {
+	assertResult(t, arr(ParseDNSLinkEntry("dnslink=/abcd/efgh/ijkl")), "abcd", "efgh/ijkl", nil)
+	assertResult(t, arr(ParseDNSLinkEntry("/abcd/efgh")), "abcd", "efgh", nil)
+	assertResult(t, arr(ParseDNSLinkEntry("dnslink=dnslink=/abcd/efgh")), "", "", InvalidEntryError{Entry: "dnslink=dnslink=/abcd/efgh", Reason: "WRONG_START"})
+	assertResult(t, arr(ParseDNSLinkEntry("/abcd/")), "", "", InvalidEntryError{Entry: "/abcd/", Reason: "NO_IDENTIFIER"})
+	assertResult(t, arr(ParseDNSLinkEntry("dnslink=/abcd/\tefgh")), "", "", InvalidEntryError{Entry: "dnslink=/abcd/\tefgh", Reason: "INVALID_CHARACTER"})
+	_, _, err := ParseDNSLinkEntry("//efgh")
+	assert.EqualError(t, err, "INVALID_ENTRY (reason=NAMESPACE_MISSING, entry=//efgh)")
+}
+
 func TestProcessEntries(t *testing.T) {
-	assertResult(t, arr(processEntries([]LookupEntry{})), map[string]NamespaceEntries{}, []TxtEntry{}, []LogStatement{})
+	assertResult(t, arr(processEntries([]LookupEntry{})), map[string]NamespaceEntries{}, []TxtEntry{}, []LogStatement{}, []string{})
 	assertResult(t,
 		arr(processEntries([]LookupEntry{
 			{Value: "foo", Ttl: 100},
@@ -63,7 +123,9 @@ func TestProcessEntries(t *testing.T) {
 		[]TxtEntry{},
 		[]LogStatement{
 			{Code: "INVALID_ENTRY", Entry: "dnslink=", Reason: "WRONG_START"},
-		})
+		},
+		[]string{},
+	)
 	assertResult(t,
 		arr(processEntries([]LookupEntry{
 			{Value: "dnslink=/foo/bar", Ttl: 100},
@@ -75,6 +137,7 @@ func TestProcessEntries(t *testing.T) {
 			{Value: "/foo/bar", Ttl: 100},
 		},
 		[]LogStatement{},
+		[]string{"foo"},
 	)
 	assertResult(t,
 		arr(processEntries([]LookupEntry{
@@ -90,6 +153,7 @@ func TestProcessEntries(t *testing.T) {
 			{Value: "/foo/baz", Ttl: 100},
 		},
 		[]LogStatement{},
+		[]string{"foo"},
 	)
 	assertResult(t,
 		arr(processEntries([]LookupEntry{
@@ -105,32 +169,1140 @@ func TestProcessEntries(t *testing.T) {
 			{Value: "/foo/baz", Ttl: 100},
 		},
 		[]LogStatement{},
+		[]string{"foo"},
 	)
 }
 
+func TestDecodedControlCharacters(t *testing.T) {
+	for _, chunks := range [][]string{
+		{`dnslink=/foo/bar\000`},
+		{`dnslink=/foo/b\009ar`},
+		{`dnslink=/foo/`, `bar\031`},
+		{`dnslink=/foo/bar\127`},
+		{`dnslink=/foo\010/bar`},
+	} {
+		value := utf8Value(chunks)
+		links, _, log, _ := processEntries([]LookupEntry{{Value: value, Ttl: 100}})
+		assertDeepEqual(t, links, map[string]NamespaceEntries{})
+		assertDeepEqual(t, log, []LogStatement{
+			{Code: "INVALID_ENTRY", Entry: value, Reason: "INVALID_CHARACTER"},
+		})
+	}
+}
+
+func TestTraceDecoding(t *testing.T) {
+	chunks := []string{`dnslink=/ipfs/`, `\226\130\172x`}
+	input := []LookupEntry{
+		{Value: utf8Value(chunks), Ttl: 100, Chunks: chunks},
+		{Value: "dnslink=/ipfs/a", Ttl: 100},
+	}
+	assertDeepEqual(t, traceEntries(input), []LogStatement{
+		{Code: "DECODED_ENTRY", Entry: "dnslink=/ipfs/€x", Reason: `chunks="dnslink=/ipfs/" "\226\130\172x" hex=646e736c696e6b3d2f697066732fe282ac78`},
+		{Code: "DECODED_ENTRY", Entry: "dnslink=/ipfs/a", Reason: `chunks="dnslink=/ipfs/a" hex=646e736c696e6b3d2f697066732f61`},
+	})
+
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, chunks...)}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0), TraceDecoding: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "INVALID_ENTRY", Entry: "dnslink=/ipfs/€x", Reason: "INVALID_CHARACTER"},
+		traceEntries(input)[0],
+	})
+}
+
+func TestChunkedEntries(t *testing.T) {
+	chunks := []string{"dnslink=/foo/", "bar"}
+	long := "dnslink=/foo/" + strings.Repeat("a", longEntryLength)
+	input := []LookupEntry{
+		{Value: utf8Value(chunks), Ttl: 100, Chunks: chunks},
+		{Value: "dnslink=/foo/baz", Ttl: 100, Chunks: []string{"dnslink=/foo/baz"}},
+		{Value: long, Ttl: 100, Chunks: []string{long[:255], long[255:510], long[510:765], long[765:1020], long[1020:]}},
+		{Value: "foo", Ttl: 100, Chunks: []string{"f", "oo"}},
+	}
+	assertDeepEqual(t, diagnoseEntries(input), []LogStatement{
+		{Code: "CHUNKED_ENTRY", Entry: "dnslink=/foo/bar"},
+		{Code: "CHUNKED_ENTRY", Entry: long},
+		{Code: "LONG_ENTRY", Entry: long},
+	})
+	_, _, log, _ := processEntries(input)
+	assertDeepEqual(t, log, []LogStatement{})
+
+	lookupTXT := func(name string) ([]LookupEntry, error) { return input[:2], nil }
+	result, err := (&Resolver{LookupTXT: lookupTXT}).Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{})
+	result, err = (&Resolver{LookupTXT: lookupTXT, Diagnostics: true}).Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "CHUNKED_ENTRY", Entry: "dnslink=/foo/bar"}})
+}
+
+func TestOrderedNamespaces(t *testing.T) {
+	_, _, _, namespaces := processEntries([]LookupEntry{
+		{Value: "dnslink=/foo/a", Ttl: 100},
+		{Value: "dnslink=/bar/b", Ttl: 100},
+		{Value: "dnslink=", Ttl: 100},
+		{Value: "dnslink=/baz/c", Ttl: 100},
+		{Value: "dnslink=/foo/d", Ttl: 100},
+	})
+	assertDeepEqual(t, namespaces, []string{"foo", "bar", "baz"})
+
+	mock := &mockDNS{
+		entries: map[string][]string{
+			"_dnslink.order.com": {"dnslink=/z/a", "dnslink=/a/b", "dnslink=/m/c", "dnslink=/a/d"},
+		},
+	}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	result, err := r.Resolve("order.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.OrderedNamespaces(), []string{"z", "a", "m"})
+
+	unordered := Result{Links: map[string]NamespaceEntries{
+		"z": {{Identifier: "a"}},
+		"a": {{Identifier: "b"}},
+	}}
+	assertDeepEqual(t, unordered.OrderedNamespaces(), []string{"a", "z"})
+}
+
+func TestAsList(t *testing.T) {
+	result := Result{Links: map[string]NamespaceEntries{
+		"z": {{Identifier: "c", Ttl: 100}},
+		"a": {{Identifier: "a", Ttl: 100}, {Identifier: "b", Ttl: 200}},
+		"m": {{Identifier: "d", Ttl: 100}},
+	}}
+	expected := []NamespaceList{
+		{Namespace: "a", Entries: []NamespaceEntry{{Identifier: "a", Ttl: 100}, {Identifier: "b", Ttl: 200}}},
+		{Namespace: "m", Entries: []NamespaceEntry{{Identifier: "d", Ttl: 100}}},
+		{Namespace: "z", Entries: []NamespaceEntry{{Identifier: "c", Ttl: 100}}},
+	}
+	for i := 0; i < 10; i++ {
+		assertDeepEqual(t, result.AsList(), expected)
+	}
+	assertDeepEqual(t, (&Result{}).AsList(), []NamespaceList{})
+
+	tmpl := template.Must(template.New("links").Parse(
+		`{{range .AsList}}{{.Namespace}}:{{range .Entries}} {{.Identifier}}{{end}};{{end}}`,
+	))
+	out := &strings.Builder{}
+	assert.NoError(t, tmpl.Execute(out, result))
+	assert.Equal(t, out.String(), "a: a b;m: d;z: c;")
+}
+
+func TestPreferNamespaces(t *testing.T) {
+	result := Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100}},
+		"ipns": {{Identifier: "b", Ttl: 100}},
+		"none": {},
+	}}
+	assertResult(t, arr(result.PreferNamespaces("ipns", "ipfs")), "ipns", []NamespaceEntry{{Identifier: "b", Ttl: 100}}, true)
+	assertResult(t, arr(result.PreferNamespaces("ipfs", "ipns")), "ipfs", []NamespaceEntry{{Identifier: "a", Ttl: 100}}, true)
+	assertResult(t, arr(result.PreferNamespaces("none", "foo", "ipfs")), "ipfs", []NamespaceEntry{{Identifier: "a", Ttl: 100}}, true)
+	assertResult(t, arr(result.PreferNamespaces("foo", "none")), "", []NamespaceEntry(nil), false)
+	assertResult(t, arr(result.PreferNamespaces()), "", []NamespaceEntry(nil), false)
+}
+
+func TestDisplayIdentifier(t *testing.T) {
+	assert.Equal(t, NamespaceEntry{Identifier: "xn--bcher-kva.example"}.DisplayIdentifier(), "bücher.example")
+	assert.Equal(t, NamespaceEntry{Identifier: "www.xn--bcher-kva.example/some/path"}.DisplayIdentifier(), "www.bücher.example/some/path")
+	assert.Equal(t, NamespaceEntry{Identifier: "website.ipfs.io"}.DisplayIdentifier(), "website.ipfs.io")
+	assert.Equal(t, NamespaceEntry{Identifier: "QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF"}.DisplayIdentifier(), "QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF")
+	assert.Equal(t, NamespaceEntry{Identifier: "xn--zz.example"}.DisplayIdentifier(), "xn--zz.example")
+}
+
+func TestFingerprint(t *testing.T) {
+	a := Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100}, {Identifier: "b", Ttl: 100}},
+		"ipns": {{Identifier: "c", Ttl: 100}},
+	}}
+	b := Result{Links: map[string]NamespaceEntries{
+		"ipns": {{Identifier: "c", Ttl: 10}},
+		"ipfs": {{Identifier: "b", Ttl: 20}, {Identifier: "a", Ttl: 30}},
+	}, Log: []LogStatement{{Code: "FALLBACK"}}}
+	assert.Equal(t, a.Fingerprint(), b.Fingerprint())
+	assert.Len(t, a.Fingerprint(), 64)
+	assert.NotEqual(t, a.Fingerprint(), Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100}},
+		"ipns": {{Identifier: "c", Ttl: 100}},
+	}}.Fingerprint())
+	assert.NotEqual(t, a.Fingerprint(), Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100}, {Identifier: "b", Ttl: 100}},
+		"ipnx": {{Identifier: "c", Ttl: 100}},
+	}}.Fingerprint())
+	// sha256 of an empty input
+	assert.Equal(t, Result{}.Fingerprint(), "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+}
+
+func TestValues(t *testing.T) {
+	result := Result{
+		TxtEntries: []TxtEntry{{Value: "/ipfs/a", Ttl: 100}, {Value: "/ipns/b", Ttl: 200}},
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a", Ttl: 100}},
+			"ipns": {{Identifier: "b", Ttl: 200}},
+		},
+		Log: []LogStatement{{Code: "FALLBACK"}},
+	}
+	values := result.Values()
+	assertDeepEqual(t, values, ResultNoTtl{
+		TxtEntries: []string{"/ipfs/a", "/ipns/b"},
+		Links:      map[string][]string{"ipfs": {"a"}, "ipns": {"b"}},
+		Log:        []LogStatement{{Code: "FALLBACK"}},
+	})
+
+	// Changes to the copy don't affect the result.
+	values.TxtEntries[0] = "/ipfs/x"
+	values.Links["ipfs"][0] = "x"
+	values.Links["other"] = []string{"y"}
+	values.Log[0].Code = "CHANGED"
+	assert.Equal(t, "/ipfs/a", result.TxtEntries[0].Value)
+	assert.Equal(t, "a", result.Links["ipfs"][0].Identifier)
+	assert.Len(t, result.Links, 2)
+	assert.Equal(t, "FALLBACK", result.Log[0].Code)
+
+	empty := (&Result{}).Values()
+	assertDeepEqual(t, empty, ResultNoTtl{TxtEntries: []string{}, Links: map[string][]string{}})
+}
+
+func TestNoTtl(t *testing.T) {
+	result := Result{
+		TxtEntries: []TxtEntry{{Value: "/ipfs/a", Ttl: 100, Source: SourcePrefixed}, {Value: "/ipns/b", Ttl: 200, Source: SourcePrefixed}},
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a", Ttl: 100, Source: SourcePrefixed}},
+			"ipns": {{Identifier: "b", Ttl: 200, Source: SourcePrefixed}},
+		},
+		Log:        []LogStatement{{Code: "FALLBACK"}},
+		Query:      "_dnslink.a.com",
+		namespaces: []string{"ipns", "ipfs"},
+	}
+	noTtl := result.NoTtl()
+	assertDeepEqual(t, noTtl, Result{
+		TxtEntries: []TxtEntry{{Value: "/ipfs/a", Source: SourcePrefixed}, {Value: "/ipns/b", Source: SourcePrefixed}},
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a", Source: SourcePrefixed}},
+			"ipns": {{Identifier: "b", Source: SourcePrefixed}},
+		},
+		Log:        []LogStatement{{Code: "FALLBACK"}},
+		Query:      "_dnslink.a.com",
+		namespaces: []string{"ipns", "ipfs"},
+	})
+
+	// Changes to the copy don't affect the result.
+	noTtl.TxtEntries[0].Value = "/ipfs/x"
+	noTtl.Links["ipfs"][0].Identifier = "x"
+	noTtl.Links["other"] = NamespaceEntries{{Identifier: "y"}}
+	noTtl.Log[0].Code = "CHANGED"
+	noTtl.namespaces[0] = "other"
+	assert.Equal(t, "/ipfs/a", result.TxtEntries[0].Value)
+	assert.Equal(t, "a", result.Links["ipfs"][0].Identifier)
+	assert.Equal(t, uint32(100), result.Links["ipfs"][0].Ttl)
+	assert.Len(t, result.Links, 2)
+	assert.Equal(t, "FALLBACK", result.Log[0].Code)
+	assert.Equal(t, []string{"ipns", "ipfs"}, result.OrderedNamespaces())
+
+	empty := (&Result{}).NoTtl()
+	assertDeepEqual(t, empty, Result{TxtEntries: []TxtEntry{}, Links: map[string]NamespaceEntries{}})
+}
+
+func TestWithTtl(t *testing.T) {
+	result := Result{
+		TxtEntries: []TxtEntry{{Value: "/ipfs/a"}, {Value: "/ipns/b"}},
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a"}},
+			"ipns": {{Identifier: "b"}},
+		},
+	}
+	withTtl := result.WithTtl(60)
+	assertDeepEqual(t, withTtl, Result{
+		TxtEntries: []TxtEntry{{Value: "/ipfs/a", Ttl: 60}, {Value: "/ipns/b", Ttl: 60}},
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a", Ttl: 60}},
+			"ipns": {{Identifier: "b", Ttl: 60}},
+		},
+	})
+	assertDeepEqual(t, withTtl.NoTtl(), result)
+
+	withTtl.Links["ipfs"][0].Identifier = "x"
+	assert.Equal(t, "a", result.Links["ipfs"][0].Identifier)
+
+	empty := (&Result{}).WithTtl(60)
+	assertDeepEqual(t, empty, Result{TxtEntries: []TxtEntry{}, Links: map[string]NamespaceEntries{}})
+}
+
+func TestLinkHeader(t *testing.T) {
+	assert.Equal(t, "", Result{}.LinkHeader())
+	single := Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF", Ttl: 100}},
+	}}
+	assert.Equal(t, `</ipfs/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEhNNaMPQBQF>; rel="dnslink"`, single.LinkHeader())
+	multiple := Result{Links: map[string]NamespaceEntries{
+		"ipns": {{Identifier: "k51/dir", Ttl: 100}},
+		"ipfs": {{Identifier: "a", Ttl: 100}, {Identifier: "b c>", Ttl: 100}},
+	}}
+	assert.Equal(t, `</ipfs/a>; rel="dnslink", </ipfs/b%20c%3E>; rel="dnslink", </ipns/k51/dir>; rel="dnslink"`, multiple.LinkHeader())
+
+	r := &Resolver{LookupTXT: func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{{Value: "dnslink=/ipns/b", Ttl: 100}, {Value: "dnslink=/ipfs/a", Ttl: 100}}, nil
+	}}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, `</ipns/b>; rel="dnslink", </ipfs/a>; rel="dnslink"`, result.LinkHeader())
+}
+
+func TestMergeResults(t *testing.T) {
+	a := Result{
+		Links: map[string]NamespaceEntries{
+			"ipns": {{Identifier: "c", Ttl: 100}},
+			"ipfs": {{Identifier: "b", Ttl: 100}},
+		},
+		Log:           []LogStatement{{Code: "FALLBACK"}},
+		Authenticated: true,
+		namespaces:    []string{"ipns", "ipfs"},
+	}
+	b := Result{
+		Links: map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "a", Ttl: 50}, {Identifier: "b", Ttl: 20}},
+			"dns":  {{Identifier: "d", Ttl: 100}},
+		},
+		Log:               []LogStatement{{Code: "INVALID_ENTRY", Entry: "dnslink=x", Reason: "WRONG_START"}},
+		RegistrableDomain: "b.com",
+	}
+	merged := MergeResults(a, b)
+	assertDeepEqual(t, merged.Links, map[string]NamespaceEntries{
+		"dns":  {{Identifier: "d", Ttl: 100}},
+		"ipfs": {{Identifier: "a", Ttl: 50}, {Identifier: "b", Ttl: 20}},
+		"ipns": {{Identifier: "c", Ttl: 100}},
+	})
+	assertDeepEqual(t, merged.TxtEntries, []TxtEntry{
+		{Value: "/dns/d", Ttl: 100},
+		{Value: "/ipfs/a", Ttl: 50},
+		{Value: "/ipfs/b", Ttl: 20},
+		{Value: "/ipns/c", Ttl: 100},
+	})
+	assertDeepEqual(t, merged.Log, append(a.Log, b.Log...))
+	assert.Equal(t, []string{"ipns", "ipfs", "dns"}, merged.OrderedNamespaces())
+	assert.Equal(t, "b.com", merged.RegistrableDomain)
+	assert.False(t, merged.Authenticated)
+	assert.True(t, MergeResults(a, a).Authenticated)
+	// The inputs are not modified.
+	assertDeepEqual(t, b.Links["ipfs"], NamespaceEntries{{Identifier: "a", Ttl: 50}, {Identifier: "b", Ttl: 20}})
+	assertDeepEqual(t, a.Links["ipfs"], NamespaceEntries{{Identifier: "b", Ttl: 100}})
+
+	empty := MergeResults()
+	assertDeepEqual(t, empty.Links, map[string]NamespaceEntries{})
+	assertDeepEqual(t, empty.TxtEntries, []TxtEntry{})
+	assert.False(t, empty.Authenticated)
+}
+
+func TestResultMerge(t *testing.T) {
+	ttls := map[string]uint32{"_dnslink.a.com": 100, "_dnslink.b.com": 20}
+	r := &Resolver{LookupTXT: func(name string) ([]LookupEntry, error) {
+		entries := map[string][]string{
+			"_dnslink.a.com": {"dnslink=/ipfs/x", "dnslink=/ipfs/y"},
+			"_dnslink.b.com": {"dnslink=/ipfs/y", "dnslink=/ipns/z", "dnslink=x"},
+		}[name]
+		res := []LookupEntry{}
+		for _, entry := range entries {
+			res = append(res, LookupEntry{Value: entry, Ttl: ttls[name]})
+		}
+		return res, nil
+	}}
+	a, err := r.Resolve("a.com")
+	assert.NoError(t, err)
+	b, err := r.Resolve("b.com")
+	assert.NoError(t, err)
+	merged := a.Merge(b)
+	assertDeepEqual(t, merged.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "x", Ttl: 100, Source: SourcePrefixed}, {Identifier: "y", Ttl: 20, Source: SourcePrefixed}},
+		"ipns": {{Identifier: "z", Ttl: 20, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, merged.TxtEntries, []TxtEntry{
+		{Value: "/ipfs/x", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/y", Ttl: 20, Source: SourcePrefixed},
+		{Value: "/ipns/z", Ttl: 20, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, merged.Log, []LogStatement{
+		{Code: "MERGED", Entry: "_dnslink.b.com"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=x", Reason: "WRONG_START"},
+	})
+	assert.Equal(t, "_dnslink.a.com", merged.Query)
+	// The receiver is not modified.
+	assertDeepEqual(t, a.Links["ipfs"], NamespaceEntries{{Identifier: "x", Ttl: 100, Source: SourcePrefixed}, {Identifier: "y", Ttl: 100, Source: SourcePrefixed}})
+	assert.Len(t, a.Log, 0)
+}
+
+func TestDiffResults(t *testing.T) {
+	a := Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100}, {Identifier: "b", Ttl: 100}},
+		"ipns": {{Identifier: "c", Ttl: 100}},
+	}}
+	b := Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "b", Ttl: 50}, {Identifier: "d", Ttl: 50}},
+	}}
+	diff := DiffResults(a, b)
+	assert.True(t, diff.Changed())
+	assertDeepEqual(t, diff, ResultDiff{
+		Added:   map[string][]string{"ipfs": {"d"}},
+		Removed: map[string][]string{"ipfs": {"a"}, "ipns": {"c"}},
+	})
+	diff = DiffResults(b, Result{Links: map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "d", Ttl: 10}, {Identifier: "b", Ttl: 10}},
+	}})
+	assert.False(t, diff.Changed())
+}
+
 func TestDnsLink(t *testing.T) {
 	mock := newMockDNS()
 	r := &Resolver{LookupTXT: mock.lookupTXT}
 	assertResult(t, arr(r.Resolve("foo.com")), Result{
 		Links: map[string]NamespaceEntries{
-			"x": {{Identifier: "a", Ttl: 100}},
+			"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}},
 		},
 		TxtEntries: []TxtEntry{
-			{Value: "/x/a", Ttl: 100},
+			{Value: "/x/a", Ttl: 100, Source: SourceBare},
 		},
 		Log: []LogStatement{
 			{Code: "FALLBACK"},
 		},
+		Query: "foo.com",
 	}, nil)
 	assertResult(t, arr(r.Resolve("bar.com")), Result{
 		Links: map[string]NamespaceEntries{
-			"y": {{Identifier: "b", Ttl: 100}},
+			"y": {{Identifier: "b", Ttl: 100, Source: SourcePrefixed}},
+		},
+		TxtEntries: []TxtEntry{
+			{Value: "/y/b", Ttl: 100, Source: SourcePrefixed},
+		},
+		Log:   []LogStatement{},
+		Query: "_dnslink.bar.com",
+	}, nil)
+}
+
+type servFailDNS struct {
+	mockDNS
+}
+
+func (m *servFailDNS) lookupTXT(name string) ([]LookupEntry, error) {
+	if strings.HasPrefix(name, "_dnslink.") {
+		return nil, NewDNSRCodeError(2, name)
+	}
+	return m.mockDNS.lookupTXT(name)
+}
+
+func TestFallbackOnServFail(t *testing.T) {
+	mock := &servFailDNS{*newMockDNS()}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	_, err := r.Resolve("foo.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(2, "_dnslink.foo.com"))
+
+	r.FallbackOnServFail = true
+	assertResult(t, arr(r.Resolve("foo.com")), Result{
+		Links: map[string]NamespaceEntries{
+			"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}},
+		},
+		TxtEntries: []TxtEntry{
+			{Value: "/x/a", Ttl: 100, Source: SourceBare},
+		},
+		Log: []LogStatement{
+			{Code: "FALLBACK", Reason: "SERVFAIL"},
+		},
+		Query: "foo.com",
+	}, nil)
+	_, err = r.Resolve("bar.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "No TXT entry for bar.com"))
+}
+
+func TestPrefixRequirement(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"foo.com":          {"dnslink=/x/a"},
+		"_dnslink.bar.com": {"dnslink=/y/b"},
+		"baz.com":          {"v=spf1 -all"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT, WarnNoPrefix: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "FALLBACK"},
+		{Code: "NO_PREFIXED_RECORD", Entry: "foo.com"},
+	})
+	result, err = r.Resolve("bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{})
+	// Without entries at the bare domain there is nothing to migrate.
+	result, err = r.Resolve("baz.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK"}})
+
+	r.RequirePrefix = true
+	_, err = r.Resolve("foo.com")
+	assert.Equal(t, NoPrefixedRecordError{Domain: "foo.com"}, err)
+	assert.EqualError(t, err, "NO_PREFIXED_RECORD (domain=foo.com)")
+	_, err = r.Resolve("bar.com")
+	assert.NoError(t, err)
+}
+
+type noDataDNS struct {
+	mockDNS
+}
+
+func (m *noDataDNS) lookupTXT(name string) ([]LookupEntry, error) {
+	if strings.HasPrefix(name, "_dnslink.") {
+		return []LookupEntry{}, nil
+	}
+	return m.mockDNS.lookupTXT(name)
+}
+
+func TestFallbackOnNoData(t *testing.T) {
+	mock := &noDataDNS{*newMockDNS()}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+	assertResult(t, arr(r.Resolve("foo.com")), Result{
+		Links:      map[string]NamespaceEntries{},
+		TxtEntries: []TxtEntry{},
+		Log:        []LogStatement{},
+		Query:      "_dnslink.foo.com",
+	}, nil)
+
+	r.FallbackOnNoData = true
+	assertResult(t, arr(r.Resolve("foo.com")), Result{
+		Links: map[string]NamespaceEntries{
+			"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}},
 		},
 		TxtEntries: []TxtEntry{
-			{Value: "/y/b", Ttl: 100},
+			{Value: "/x/a", Ttl: 100, Source: SourceBare},
+		},
+		Log: []LogStatement{
+			{Code: "FALLBACK", Reason: "NODATA"},
 		},
-		Log: []LogStatement{},
+		Query: "foo.com",
 	}, nil)
+	_, err := r.Resolve("bar.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "No TXT entry for bar.com"))
+}
+
+func TestLookupMode(t *testing.T) {
+	queried := []string{}
+	mock := newMockDNS()
+	lookupTXT := func(name string) ([]LookupEntry, error) {
+		queried = append(queried, name)
+		return mock.lookupTXT(name)
+	}
+	r := &Resolver{LookupTXT: lookupTXT}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK"}})
+	assert.Equal(t, []string{"_dnslink.foo.com", "foo.com"}, queried)
+
+	queried = []string{}
+	r.LookupMode = PrefixOnly
+	_, err = r.Resolve("foo.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "No TXT entry for _dnslink.foo.com"))
+	assert.Equal(t, []string{"_dnslink.foo.com"}, queried)
+	result, err = r.Resolve("bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{"y": {{Identifier: "b", Ttl: 100, Source: SourcePrefixed}}})
+
+	queried = []string{}
+	r.LookupMode = BareOnly
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{})
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}}})
+	assert.Equal(t, []string{"foo.com"}, queried)
+	_, err = r.Resolve("bar.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "No TXT entry for bar.com"))
+
+	assert.Equal(t, "prefix-then-bare", PrefixThenBare.String())
+	assert.Equal(t, "prefix-only", PrefixOnly.String())
+	assert.Equal(t, "bare-only", BareOnly.String())
+}
+
+func TestResultQuery(t *testing.T) {
+	r := &Resolver{LookupTXT: newMockDNS().lookupTXT}
+	result, err := r.Resolve("bar.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "_dnslink.bar.com", result.Query)
+	result, err = r.Resolve("foo.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.com", result.Query)
+
+	r.LookupMode = BareOnly
+	result, err = r.Resolve("_dnslink.foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.com", result.Query)
+
+	// The query is not part of the JSON form.
+	raw, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "foo.com")
+}
+
+func TestUDPFallbackOnNoData(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if !strings.HasPrefix(req.Question[0].Name, "_dnslink.") {
+			res.Answer = append(res.Answer, txtRecord(req.Question[0].Name, 100, "dnslink=/x/a"))
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0), FallbackOnNoData: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK", Reason: "NODATA"}})
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{"x": {{Identifier: "a", Ttl: 100, Source: SourceBare}}})
+}
+
+// startDNSServer runs a local dns server answering with the given handler
+// and returns its address.
+func startDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// startDNSServerWithTCP runs a local dns server like startDNSServer, that
+// also accepts queries over TCP at the same port.
+func startDNSServerWithTCP(t *testing.T, handler dns.HandlerFunc) string {
+	address := startDNSServer(t, handler)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Net: "tcp", Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return address
+}
+
+func netResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", server)
+		},
+	}
+}
+
+func TestDNSRCodeErrorPredicates(t *testing.T) {
+	nxdomain := NewDNSRCodeError(3, "foo.com")
+	wrapped := fmt.Errorf("custom lookup: %w", nxdomain)
+	assert.True(t, IsNXDomain(nxdomain))
+	assert.True(t, IsNXDomain(wrapped))
+	assert.False(t, IsServFail(wrapped))
+	assert.True(t, IsServFail(NewDNSRCodeError(2, "foo.com")))
+	assert.False(t, IsNXDomain(errors.New("NXDOMAIN")))
+	assert.False(t, IsNXDomain(nil))
+
+	rcodeErr, ok := AsDNSRCodeError(wrapped)
+	assert.True(t, ok)
+	assert.Equal(t, nxdomain, rcodeErr)
+	_, ok = AsDNSRCodeError(errors.New("EMPTY_PART"))
+	assert.False(t, ok)
+
+	// Wrapped errors of custom lookups fall back to the bare domain too.
+	r := &Resolver{LookupTXT: func(domain string) ([]LookupEntry, error) {
+		if strings.HasPrefix(domain, dnsPrefix) {
+			return nil, fmt.Errorf("custom lookup: %w", NewDNSRCodeError(3, domain))
+		}
+		return []LookupEntry{{Value: "dnslink=/ipfs/a", Ttl: 100}}, nil
+	}}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK"}})
+}
+
+func TestWrapLookupServFail(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		if strings.HasPrefix(req.Question[0].Name, "_dnslink.") {
+			res.SetRcode(req, dns.RcodeServerFailure)
+		} else {
+			res.SetReply(req)
+			res.Answer = append(res.Answer, txtRecord(req.Question[0].Name, 100, "dnslink=/x/a"))
+		}
+		w.WriteMsg(res)
+	})
+	lookup := wrapLookupContext(netResolver(server), 0)
+	_, err := lookup(context.Background(), "_dnslink.foo.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(2, "_dnslink.foo.com"))
+
+	r := &Resolver{LookupTXTContext: lookup, FallbackOnServFail: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK", Reason: "SERVFAIL"}})
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{"x": {{Identifier: "a", Ttl: 0, Source: SourceBare}}})
+}
+
+func TestResolveContext(t *testing.T) {
+	queried := []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Resolver{LookupTXTContext: func(ctx context.Context, domain string) ([]LookupEntry, error) {
+		queried = append(queried, domain)
+		// The prefixed domain doesn't exist, but the resolution is cancelled
+		// before the fallback.
+		cancel()
+		return nil, NewDNSRCodeError(3, domain)
+	}}
+	_, err := r.ResolveContext(ctx, "foo.com")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"_dnslink.foo.com"}, queried)
+
+	// A pending UDP query is aborted with the context.
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	r = &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.ResolveContext(ctx, "foo.com")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	result, err := (&Resolver{LookupTXT: newMockDNS().lookupTXT}).ResolveContext(context.Background(), "bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"y": {{Identifier: "b", Ttl: 100, Source: SourcePrefixed}},
+	})
+}
+
+func TestWrapLookupCancel(t *testing.T) {
+	// The server never answers, only the context can end the lookup.
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	r := &Resolver{LookupTXTContext: wrapLookupContext(netResolver(server), 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := resolveContext(ctx, r, "foo.com")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func txtRecord(name string, ttl uint32, txt ...string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: txt,
+	}
+}
+
+func TestUDPLookupOffDomainAnswer(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{
+			txtRecord("_dnslink.evil.com.", 100, "dnslink=/ipfs/evil"),
+			txtRecord("_dnslink.FOO.com.", 100, "dnslink=/ipfs/good"),
+			&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "_dnslink.foo.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100},
+				Target: "_dnslink.alias.com.",
+			},
+			txtRecord("_dnslink.alias.com.", 100, "dnslink=/ipfs/alias"),
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "alias", Ttl: 100, Source: SourcePrefixed}, {Identifier: "good", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "OFF_DOMAIN_ANSWER", Entry: "_dnslink.evil.com.\t100\tIN\tTXT\t\"dnslink=/ipfs/evil\""},
+	})
+}
+
+func TestUDPLookupDNAME(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{
+			&dns.DNAME{
+				Hdr:    dns.RR_Header{Name: "foo.com.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 100},
+				Target: "bar.net.",
+			},
+			&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "_dnslink.foo.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100},
+				Target: "_dnslink.bar.net.",
+			},
+			txtRecord("_dnslink.bar.net.", 100, "dnslink=/ipfs/bar"),
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "bar", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "DNAME", Entry: "foo.com.\t100\tIN\tDNAME\tbar.net."},
+	})
+}
+
+func TestUDPLookupCNAME(t *testing.T) {
+	cname := func(name string, target string) dns.RR {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100},
+			Target: target,
+		}
+	}
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		switch name := req.Question[0].Name; name {
+		case "_dnslink.foo.com.":
+			// The name server didn't follow the chain.
+			res.Answer = []dns.RR{cname(name, "a.example."), cname("a.example.", "b.example.")}
+		case "b.example.":
+			res.Answer = []dns.RR{txtRecord(name, 100, "dnslink=/ipfs/b")}
+		case "_dnslink.loop.com.":
+			res.Answer = []dns.RR{cname(name, "c.example.")}
+		case "c.example.":
+			res.Answer = []dns.RR{cname(name, "_dnslink.loop.com.")}
+		default:
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "b", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "CNAME_FOLLOWED", Entry: "_dnslink.foo.com.", Reason: "target=b.example."},
+	})
+
+	result, err = r.Resolve("loop.com")
+	assert.NoError(t, err)
+	assert.Len(t, result.Links, 0)
+	assert.Len(t, result.Log, maxCNAMEFollows+1)
+	assert.Equal(t, LogStatement{Code: "CNAME_FOLLOWED", Entry: "c.example.", Reason: "target=_dnslink.loop.com."}, result.Log[1])
+	assert.Equal(t, LogStatement{Code: "CNAME_LOOP", Entry: "_dnslink.loop.com."}, result.Log[maxCNAMEFollows])
+}
+
+func TestUDPLookupSizes(t *testing.T) {
+	sizes := make(chan [2]int, 2)
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/", strings.Repeat("a", 250), strings.Repeat("b", 250))}
+		packedReq, _ := req.Pack()
+		packedRes, _ := res.Pack()
+		sizes <- [2]int{len(packedReq), len(packedRes)}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{ReportSizes: true})}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	wire := <-sizes
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "SIZES", Entry: fmt.Sprintf("req=%d res=%d", wire[0], wire[1])},
+	})
+	assert.Greater(t, wire[1], 500)
+
+	r = &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	<-sizes
+	assertDeepEqual(t, result.Log, []LogStatement{})
+}
+
+func TestUDPLookupID(t *testing.T) {
+	ids := make(chan uint16, 1)
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		ids <- req.Id
+		res := new(dns.Msg)
+		res.SetReply(req)
+		w.WriteMsg(res)
+	})
+	lookup := NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{ID: func() uint16 { return 4242 }})
+	for i := 0; i < 2; i++ {
+		_, err := lookup(context.Background(), "foo.com")
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(4242), <-ids)
+	}
+}
+
+func TestUDPLookupNoServers(t *testing.T) {
+	_, err := NewUDPLookup([]string{}, 0)("foo.com")
+	assert.EqualError(t, err, "no DNS servers configured")
+	_, err = NewUDPLookupContext(nil, 0)(context.Background(), "foo.com")
+	assert.EqualError(t, err, "no DNS servers configured")
+	_, err = NewTLSLookup(nil, nil)("foo.com")
+	assert.EqualError(t, err, "no DNS servers configured")
+	_, err = (&Resolver{LookupTXT: NewUDPLookup(nil, 0)}).Resolve("foo.com")
+	assert.EqualError(t, err, "no DNS servers configured")
+}
+
+func TestUDPLookupRand(t *testing.T) {
+	servers := make([]string, 3)
+	for index := range servers {
+		identifier := fmt.Sprint(index)
+		servers[index] = startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/server/"+identifier)}
+			w.WriteMsg(res)
+		})
+	}
+	selection := func(seed int64) []string {
+		lookup := NewUDPLookupWithOptions(servers, UDPLookupOptions{Rand: rand.New(rand.NewSource(seed))})
+		selected := []string{}
+		for i := 0; i < 10; i++ {
+			entries, err := lookup(context.Background(), "foo.com")
+			assert.NoError(t, err)
+			selected = append(selected, entries[0].Value)
+		}
+		return selected
+	}
+	expected := []string{}
+	source := rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("dnslink=/server/%d", source.Intn(len(servers))))
+	}
+	assert.Equal(t, expected, selection(42))
+	assert.Equal(t, selection(7), selection(7))
+}
+
+func TestUDPLookupFailover(t *testing.T) {
+	hits := make(chan string, 100)
+	servFail := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		hits <- "servfail"
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(res)
+	})
+	good := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		hits <- "good"
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	// Nothing listens at the port anymore, the query fails right away.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refused := closed.LocalAddr().String()
+	closed.Close()
+
+	servers := []string{servFail, refused, good}
+	for seed := int64(0); seed < 5; seed++ {
+		lookup := NewUDPLookupWithOptions(servers, UDPLookupOptions{MaxAttempts: 3, Rand: rand.New(rand.NewSource(seed))})
+		entries, err := lookup(context.Background(), "foo.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "dnslink=/ipfs/a", entries[0].Value)
+	}
+
+	lookup := NewUDPLookupWithOptions([]string{refused, servFail}, UDPLookupOptions{MaxAttempts: 5, Rand: rand.New(rand.NewSource(1))})
+	_, err = lookup(context.Background(), "foo.com")
+	assert.Error(t, err)
+
+	// Every server is only tried once, however high MaxAttempts is.
+	for len(hits) > 0 {
+		<-hits
+	}
+	lookup = NewUDPLookupWithOptions([]string{servFail}, UDPLookupOptions{MaxAttempts: 3})
+	_, err = lookup(context.Background(), "foo.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(2, "foo.com."))
+	assert.Equal(t, 1, len(hits))
+
+	// A cancellation between two attempts is reported instead of the
+	// failure of the first server.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelling := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		cancel()
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(res)
+	})
+	lookup = NewUDPLookupWithOptions([]string{cancelling, cancelling}, UDPLookupOptions{MaxAttempts: 2})
+	_, err = lookup(ctx, "foo.com")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestUDPLookupTruncated(t *testing.T) {
+	server := startDNSServerWithTCP(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		for index := 0; index < 3; index++ {
+			res.Answer = append(res.Answer, txtRecord(req.Question[0].Name, 100, fmt.Sprintf("dnslink=/ipfs/%d", index)))
+		}
+		if w.RemoteAddr().Network() == "udp" {
+			res.Answer = res.Answer[:1]
+			res.Truncated = true
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {
+			{Identifier: "0", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "1", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "2", Ttl: 100, Source: SourcePrefixed},
+		},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "TRUNCATED", Entry: server, Reason: "udp=1 tcp=3"}})
+
+	r = &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{DisableTCPRetry: true})}
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "0", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "TRUNCATED_ANSWER", Entry: server, Reason: "answers=1"}})
+}
+
+func TestTruncationClient(t *testing.T) {
+	for network, expected := range map[string]string{"": "tcp", "udp": "tcp", "udp4": "tcp4", "udp6": "tcp6"} {
+		assert.Equal(t, expected, truncationClient(&dns.Client{Net: network}).Net)
+	}
+	assert.Nil(t, truncationClient(&dns.Client{Net: "tcp"}))
+	assert.Nil(t, truncationClient(&dns.Client{Net: "tcp-tls"}))
+}
+
+func TestUDPLookupTimeout(t *testing.T) {
+	// The queries are received but never answered.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	server := conn.LocalAddr().String()
+
+	lookup := NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	_, err = lookup(context.Background(), "foo.com")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	var timeout TimeoutError
+	assert.ErrorAs(t, err, &timeout)
+	assert.Equal(t, server, timeout.Server)
+	assert.Equal(t, "foo.com.", timeout.Domain)
+	assert.EqualError(t, err, "TIMEOUT (server="+server+", domain=foo.com.)")
+	var netErr net.Error
+	assert.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Implements(t, &netErr, TimeoutError{})
+}
+
+func TestServerOrder(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	pick := rand.New(rand.NewSource(1)).Intn
+	assert.Equal(t, 1, len(serverOrder(servers, 0, pick)))
+	assert.Equal(t, 2, len(serverOrder(servers, 2, pick)))
+	order := serverOrder(servers, 10, pick)
+	sort.Strings(order)
+	assert.Equal(t, servers, order)
+}
+
+func TestUDPLookupAuthenticated(t *testing.T) {
+	dnssecOK := make(chan bool, 1)
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		opt := req.IsEdns0()
+		do := opt != nil && opt.Do()
+		dnssecOK <- do
+		res := new(dns.Msg)
+		res.SetReply(req)
+		// Without the DO bit the flag is not requested and ignored.
+		res.AuthenticatedData = true
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{DNSSEC: true})}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.True(t, <-dnssecOK)
+	assert.True(t, result.Authenticated)
+
+	r = &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0)}
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.False(t, <-dnssecOK)
+	assert.False(t, result.Authenticated)
+}
+
+func TestUDPLookupNetwork(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	entries, err := NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Network: "udp4"})(context.Background(), "foo.com")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	// The server only has an IPv4 address.
+	_, err = NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Network: "udp6"})(context.Background(), "foo.com")
+	assert.Error(t, err)
+}
+
+func TestUDPLookupClass(t *testing.T) {
+	classes := make(chan uint16, 1)
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		classes <- req.Question[0].Qclass
+		res := new(dns.Msg)
+		res.SetReply(req)
+		w.WriteMsg(res)
+	})
+	_, err := NewUDPLookupContext([]string{server}, 0)(context.Background(), "foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(dns.ClassINET), <-classes)
+	_, err = NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Class: dns.ClassCHAOS})(context.Background(), "foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(dns.ClassCHAOS), <-classes)
+}
+
+func TestUDPLookupClientSubnet(t *testing.T) {
+	opts := make(chan *dns.OPT, 1)
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		opts <- req.IsEdns0()
+		res := new(dns.Msg)
+		res.SetReply(req)
+		w.WriteMsg(res)
+	})
+	_, err := NewUDPLookupContext([]string{server}, 0)(context.Background(), "foo.com")
+	assert.NoError(t, err)
+	assert.Nil(t, <-opts)
+
+	for _, test := range []struct {
+		cidr    string
+		family  uint16
+		netmask uint8
+		address string
+	}{
+		{"192.0.2.77/24", 1, 24, "192.0.2.0"},
+		{"2001:db8:1:2::1/56", 2, 56, "2001:db8:1::"},
+	} {
+		_, network, err := net.ParseCIDR(test.cidr)
+		assert.NoError(t, err)
+		_, err = NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{ClientSubnet: network})(context.Background(), "foo.com")
+		assert.NoError(t, err)
+		opt := <-opts
+		if !assert.NotNil(t, opt) || !assert.Len(t, opt.Option, 1) {
+			continue
+		}
+		assert.False(t, opt.Do())
+		subnet := opt.Option[0].(*dns.EDNS0_SUBNET)
+		assert.Equal(t, test.family, subnet.Family)
+		assert.Equal(t, test.netmask, subnet.SourceNetmask)
+		assert.Equal(t, test.address, subnet.Address.String())
+	}
 }
 
 func TestUDPLookup(t *testing.T) {
@@ -147,6 +1319,41 @@ func TestUtf8Value(t *testing.T) {
 	assert.Equal(t, utf8Value([]string{`\096`}), "`")
 	assert.Equal(t, utf8Value([]string{`\\`}), `\`)
 	assert.Equal(t, utf8Value([]string{`\"`}), `"`)
+	assert.Equal(t, utf8Value([]string{`\\065`}), `\065`)
+	assert.Equal(t, utf8Value([]string{`a\\`, `123`}), `a\123`)
+	assert.Equal(t, utf8Value([]string{`\\\\`}), `\\`)
+}
+
+func TestMultiStringTXT(t *testing.T) {
+	chunks := []string{
+		`dnslink=/ipfs/` + strings.Repeat("a", 186),
+		strings.Repeat("b", 190) + `\\065\"\195\164`,
+		`c`,
+	}
+	server := startDNSServerWithTCP(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, chunks...)}
+		w.WriteMsg(res)
+	})
+	expected := "dnslink=/ipfs/" + strings.Repeat("a", 186) + strings.Repeat("b", 190) + `\065"äc`
+
+	entries, err := NewUDPLookup([]string{server}, 0)("_dnslink.foo.com")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, expected, entries[0].Value)
+
+	system := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	entries, err = wrapLookupContext(system, 100)(context.Background(), "_dnslink.foo.com.")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, expected, entries[0].Value)
 }
 
 func arr(input ...interface{}) []interface{} {
@@ -162,3 +1369,341 @@ func assertDeepEqual(t *testing.T, a interface{}, b interface{}) {
 		t.Error(diff)
 	}
 }
+
+func TestDescribeLogCode(t *testing.T) {
+	assert.Equal(t, "DNSLink entry must start with a '/'.", DescribeLogCode("WRONG_START"))
+	assert.NotEqual(t, "", DescribeLogCode("INVALID_ENTRY"))
+	assert.NotEqual(t, "", DescribeLogCode("FALLBACK"))
+	assert.Equal(t, "", DescribeLogCode("UNKNOWN_CODE"))
+	assert.Equal(t, "", DescribeLogCode(""))
+}
+
+func TestMaxIdentifierLength(t *testing.T) {
+	long := "dnslink=/ipfs/" + strings.Repeat("a", 100000)
+	lookup := func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{
+			{Value: long, Ttl: 100},
+			{Value: "dnslink=/ipfs/short", Ttl: 100},
+		}, nil
+	}
+	r := &Resolver{LookupTXT: lookup, MaxIdentifierLength: 1000}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "short", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "IDENTIFIER_TOO_LONG", Entry: long},
+	})
+
+	r.MaxIdentifierLength = 0
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result.Links["ipfs"]))
+	assertDeepEqual(t, result.Log, []LogStatement{})
+}
+
+func TestCaseInsensitiveNamespaces(t *testing.T) {
+	lookup := func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{
+			{Value: "dnslink=/IPFS/b", Ttl: 100},
+			{Value: "dnslink=/ipfs/a", Ttl: 100},
+			{Value: "dnslink=/Ipns/CaseKept", Ttl: 100},
+			{Value: "dnslink=/IPFS/", Ttl: 100},
+		}, nil
+	}
+	r := &Resolver{LookupTXT: lookup, CaseInsensitiveNamespaces: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100, Source: SourcePrefixed}, {Identifier: "b", Ttl: 100, Source: SourcePrefixed}},
+		"ipns": {{Identifier: "CaseKept", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.TxtEntries, []TxtEntry{
+		{Value: "/ipfs/a", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/b", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipns/CaseKept", Ttl: 100, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "NAMESPACE_CASE", Entry: "dnslink=/IPFS/b"},
+		{Code: "NAMESPACE_CASE", Entry: "dnslink=/Ipns/CaseKept"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=/IPFS/", Reason: "NO_IDENTIFIER"},
+	})
+
+	r.CaseInsensitiveNamespaces = false
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(result.Links))
+	assert.Equal(t, NamespaceEntries{{Identifier: "b", Ttl: 100, Source: SourcePrefixed}}, result.Links["IPFS"])
+}
+
+func TestStripComments(t *testing.T) {
+	lookup := func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{
+			{Value: "dnslink=/ipfs/a # main site", Ttl: 100},
+			{Value: "dnslink=/ipfs/b  ", Ttl: 100},
+			{Value: "dnslink=/https/example.com/#top", Ttl: 100},
+			{Value: "dnslink=/ipfs/c", Ttl: 100},
+			{Value: "dnslink= # only a comment", Ttl: 100},
+		}, nil
+	}
+	r := &Resolver{LookupTXT: lookup, StripComments: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"https": {{Identifier: "example.com/#top", Ttl: 100, Source: SourcePrefixed}},
+		"ipfs": {
+			{Identifier: "a", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "b", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "c", Ttl: 100, Source: SourcePrefixed},
+		},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "COMMENT_STRIPPED", Entry: "dnslink=/ipfs/a # main site"},
+		{Code: "COMMENT_STRIPPED", Entry: "dnslink=/ipfs/b  "},
+		{Code: "COMMENT_STRIPPED", Entry: "dnslink= # only a comment"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=", Reason: "WRONG_START"},
+	})
+
+	r.StripComments = false
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{
+		{Identifier: "a # main site", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "b  ", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "c", Ttl: 100, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "INVALID_ENTRY", Entry: "dnslink= # only a comment", Reason: "WRONG_START"},
+	})
+}
+
+func TestDedupeEntries(t *testing.T) {
+	lookup := func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{
+			{Value: "dnslink=/ipfs/a", Ttl: 100},
+			{Value: "dnslink=/ipfs/b", Ttl: 300},
+			{Value: "dnslink=/ipfs/a", Ttl: 200},
+			{Value: "dnslink=/IPFS/b", Ttl: 50},
+			{Value: "dnslink=/ipns/a", Ttl: 100},
+			{Value: "dnslink=/ipfs/", Ttl: 100},
+			{Value: "dnslink=/ipfs/", Ttl: 100},
+		}, nil
+	}
+	r := &Resolver{LookupTXT: lookup, CaseInsensitiveNamespaces: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 200, Source: SourcePrefixed}, {Identifier: "b", Ttl: 300, Source: SourcePrefixed}},
+		"ipns": {{Identifier: "a", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.TxtEntries, []TxtEntry{
+		{Value: "/ipfs/a", Ttl: 200, Source: SourcePrefixed},
+		{Value: "/ipfs/b", Ttl: 300, Source: SourcePrefixed},
+		{Value: "/ipns/a", Ttl: 100, Source: SourcePrefixed},
+	})
+	// Invalid entries are reported every time.
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "NAMESPACE_CASE", Entry: "dnslink=/IPFS/b"},
+		{Code: "DUPLICATE_ENTRY", Entry: "dnslink=/ipfs/a"},
+		{Code: "DUPLICATE_ENTRY", Entry: "dnslink=/ipfs/b"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=/ipfs/", Reason: "NO_IDENTIFIER"},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=/ipfs/", Reason: "NO_IDENTIFIER"},
+	})
+
+	r.KeepDuplicateEntries = true
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Len(t, result.Links["ipfs"], 4)
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	queried := []string{}
+	r := &Resolver{
+		LookupTXT: func(name string) ([]LookupEntry, error) {
+			queried = append(queried, name)
+			return []LookupEntry{{Value: "dnslink=/ipfs/abcd", Ttl: 100}}, nil
+		},
+		NormalizeDomain: func(domain string) string {
+			return strings.TrimPrefix(domain, "www.")
+		},
+	}
+	for _, domain := range []string{"www.foo.com", "_dnslink.www.foo.com.", "foo.com"} {
+		result, err := r.Resolve(domain)
+		assert.NoError(t, err)
+		assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+			"ipfs": {{Identifier: "abcd", Ttl: 100, Source: SourcePrefixed}},
+		})
+	}
+	assert.Equal(t, []string{"_dnslink.foo.com", "_dnslink.foo.com", "_dnslink.foo.com"}, queried)
+
+	r.NormalizeDomain = func(domain string) string { return "" }
+	_, err := r.Resolve("foo.com")
+	assert.EqualError(t, err, "EMPTY_PART")
+}
+
+func TestNormalizeDomainOnce(t *testing.T) {
+	calls := []string{}
+	r := &Resolver{
+		LookupTXT: func(name string) ([]LookupEntry, error) {
+			return []LookupEntry{{Value: "dnslink=/ipfs/abcd", Ttl: 100}}, nil
+		},
+		NormalizeDomain: func(domain string) string {
+			calls = append(calls, domain)
+			return domain
+		},
+		FollowIndex:     true,
+		FollowRedirects: true,
+	}
+	_, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo.com"}, calls)
+
+	calls = []string{}
+	cache := NewCachingResolver(r, CacheOptions{})
+	_, err = cache.Resolve("bar.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar.com"}, calls)
+}
+
+func TestFastParse(t *testing.T) {
+	input := []LookupEntry{
+		{Value: "dnslink=/ipfs/b", Ttl: 100},
+		{Value: "dnslink=/ipns/c", Ttl: 100},
+		{Value: "dnslink=/ipfs/a", Ttl: 200},
+		{Value: "dnslink=ipfs/x", Ttl: 100},
+		{Value: "other=/ipfs/y", Ttl: 100},
+	}
+	links, txtEntries, log, namespaces := processEntriesFast(input)
+	assertDeepEqual(t, links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "b", Ttl: 100}, {Identifier: "a", Ttl: 200}},
+		"ipns": {{Identifier: "c", Ttl: 100}},
+	})
+	assertDeepEqual(t, txtEntries, []TxtEntry{{Value: "/ipfs/b", Ttl: 100}, {Value: "/ipns/c", Ttl: 100}, {Value: "/ipfs/a", Ttl: 200}})
+	assertDeepEqual(t, log, []LogStatement{{Code: "INVALID_ENTRY", Entry: "dnslink=ipfs/x", Reason: "WRONG_START"}})
+	assert.Equal(t, []string{"ipfs", "ipns"}, namespaces)
+
+	// The same entries as processEntries, apart from the order.
+	sortedLinks, _, sortedLog, _ := processEntries(input)
+	for ns, entries := range links {
+		sort.Sort(ByValue{entries})
+		assertDeepEqual(t, entries, sortedLinks[ns])
+	}
+	assertDeepEqual(t, log, sortedLog)
+
+	result, err := (&Resolver{LookupTXT: newMockDNS().lookupTXT, FastParse: true}).Resolve("bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{"y": {{Identifier: "b", Ttl: 100, Source: SourcePrefixed}}})
+}
+
+func TestKeepAnswerOrder(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.order.com": {"dnslink=/ipfs/c", "dnslink=/ipfs/a", "dnslink=/ipns/z", "dnslink=/ipfs/b"},
+	}}
+	result, err := (&Resolver{LookupTXT: mock.lookupTXT}).Resolve("order.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{
+		{Identifier: "a", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "b", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "c", Ttl: 100, Source: SourcePrefixed},
+	})
+
+	result, err = (&Resolver{LookupTXT: mock.lookupTXT, FastParse: true}).Resolve("order.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{
+		{Identifier: "c", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "a", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "b", Ttl: 100, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, result.TxtEntries, []TxtEntry{
+		{Value: "/ipfs/c", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/a", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipns/z", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/b", Ttl: 100, Source: SourcePrefixed},
+	})
+}
+
+func benchmarkEntries() []LookupEntry {
+	input := make([]LookupEntry, 100)
+	for index := range input {
+		input[index] = LookupEntry{
+			Value: fmt.Sprintf("dnslink=/ns%d/QmXNosdfz3WQUHncsYBTw7diwYzCibVhrJmEh%d", index%5, 100-index),
+			Ttl:   100,
+		}
+	}
+	return input
+}
+
+func BenchmarkProcessEntries(b *testing.B) {
+	input := benchmarkEntries()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		processEntries(input)
+	}
+}
+
+func BenchmarkProcessEntriesFast(b *testing.B) {
+	input := benchmarkEntries()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		processEntriesFast(input)
+	}
+}
+
+func TestComputeRegistrable(t *testing.T) {
+	lookup := func(name string) ([]LookupEntry, error) {
+		return []LookupEntry{{Value: "dnslink=/ipfs/a", Ttl: 100}}, nil
+	}
+	r := &Resolver{LookupTXT: lookup, ComputeRegistrable: true}
+	for domain, expected := range map[string]string{
+		"example.com":              "example.com",
+		"a.b.c.Example.com.":       "example.com",
+		"www.example.co.uk":        "example.co.uk",
+		"_dnslink.docs.ipfs.io":    "ipfs.io",
+		"site.user.github.io":      "user.github.io",
+		"foo.bar.s3.amazonaws.com": "bar.s3.amazonaws.com",
+		"co.uk":                    "",
+		"github.io":                "",
+	} {
+		result, err := r.Resolve(domain)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result.RegistrableDomain, domain)
+	}
+	result, err := (&Resolver{LookupTXT: lookup}).Resolve("www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "", result.RegistrableDomain)
+}
+
+func TestMaxInvalidRatio(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		// 1 of 4 dnslink entries is invalid, the other record doesn't count.
+		"_dnslink.quarter.com": {"dnslink=/ipfs/a", "dnslink=/ipfs/b", "dnslink=/ipfs/c", "dnslink=ipfs/d", "other=x"},
+		"_dnslink.half.com":    {"dnslink=/ipfs/a", "dnslink=ipfs/b"},
+		"_dnslink.all.com":     {"dnslink=ipfs/a"},
+		"_dnslink.none.com":    {"other=x"},
+	}}
+	for _, test := range []struct {
+		ratio  float64
+		domain string
+		fails  bool
+	}{
+		{0, "all.com", false},
+		{1, "all.com", false},
+		{0.99, "all.com", true},
+		{0.5, "half.com", false},
+		{0.49, "half.com", true},
+		{0.25, "quarter.com", false},
+		{0.2, "quarter.com", true},
+		{0.0001, "none.com", false},
+	} {
+		r := &Resolver{LookupTXT: mock.lookupTXT, MaxInvalidRatio: test.ratio}
+		_, err := r.Resolve(test.domain)
+		if test.fails {
+			assert.IsType(t, InvalidRatioError{}, err, "%s %v", test.domain, test.ratio)
+		} else {
+			assert.NoError(t, err, "%s %v", test.domain, test.ratio)
+		}
+	}
+	_, err := (&Resolver{LookupTXT: mock.lookupTXT, MaxInvalidRatio: 0.2}).Resolve("quarter.com")
+	assert.EqualError(t, err, "TOO_MANY_INVALID_ENTRIES (invalid=1, total=4, domain=quarter.com)")
+}
@@ -0,0 +1,222 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+// rootTrustAnchors are the DS records of the key signing keys of the root
+// zone, as published at https://data.iana.org/root-anchors/root-anchors.xml
+var rootTrustAnchors = []string{
+	". 0 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 0 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RootTrustAnchors returns the DS records of the root zone that
+// UDPLookupOptions.Validate trusts by default.
+func RootTrustAnchors() []*dns.DS {
+	anchors := make([]*dns.DS, len(rootTrustAnchors))
+	for index, anchor := range rootTrustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			panic(err)
+		}
+		anchors[index] = rr.(*dns.DS)
+	}
+	return anchors
+}
+
+// DNSSECError is returned by lookups with UDPLookupOptions.Validate or
+// UDPLookupOptions.RequireAuthenticated if the answer can't be trusted. The
+// Reason is one of:
+//
+// UNSIGNED: the answer has no signatures.
+// INVALID_SIGNATURE: no signature matches the records or it expired.
+// NO_TRUST_CHAIN: the keys of a zone can't be traced back to a trust anchor.
+// NOT_AUTHENTICATED: the name server didn't set the Authenticated Data flag.
+type DNSSECError struct {
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+}
+
+func (e DNSSECError) Error() string {
+	return fmt.Sprintf("DNSSEC_FAILED (reason=%s, domain=%s)", e.Reason, e.Domain)
+}
+
+// validator checks the signatures of answers up to the trust anchors,
+// querying the keys and delegations of the zones with exchange. The keys
+// that were validated are kept for the lifetime of the validator, which is
+// a single lookup.
+type validator struct {
+	exchange func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+	anchors  []*dns.DS
+	now      func() time.Time
+	keys     map[string][]*dns.DNSKEY
+}
+
+func newValidator(anchors []*dns.DS, exchange func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)) *validator {
+	if len(anchors) == 0 {
+		anchors = RootTrustAnchors()
+	}
+	return &validator{
+		exchange: exchange,
+		anchors:  anchors,
+		now:      time.Now,
+		keys:     map[string][]*dns.DNSKEY{},
+	}
+}
+
+// validateAnswer checks every RRset of the answer, like the TXT records and
+// the CNAMEs leading to them. Empty answers are not checked, as denials of
+// existence (NSEC, NSEC3) are not validated.
+func (v *validator) validateAnswer(ctx context.Context, res *dns.Msg) error {
+	for _, rrset := range rrsets(res.Answer) {
+		if err := v.validateRRset(ctx, rrset, res.Answer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rrsets groups the records, except the signatures, by name and type.
+func rrsets(records []dns.RR) [][]dns.RR {
+	sets := [][]dns.RR{}
+	index := map[string]int{}
+	for _, rr := range records {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := strings.ToLower(header.Name) + "/" + dns.TypeToString[header.Rrtype]
+		if position, ok := index[key]; ok {
+			sets[position] = append(sets[position], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// validateRRset checks that one of the signatures in records covers the
+// RRset and was made with a validated key of its zone.
+func (v *validator) validateRRset(ctx context.Context, rrset []dns.RR, records []dns.RR) error {
+	header := rrset[0].Header()
+	signed := false
+	for _, rr := range records {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != header.Rrtype || !strings.EqualFold(sig.Hdr.Name, header.Name) {
+			continue
+		}
+		if !dns.IsSubDomain(sig.SignerName, header.Name) {
+			continue
+		}
+		// DS records belong to the parent zone, which also ends the chain
+		// of zoneKeys and delegations.
+		if header.Rrtype == dns.TypeDS && dns.CountLabel(sig.SignerName) >= dns.CountLabel(header.Name) {
+			continue
+		}
+		signed = true
+		keys, err := v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if sig.Verify(key, rrset) == nil && sig.ValidityPeriod(v.now()) {
+				return nil
+			}
+		}
+	}
+	if !signed {
+		return DNSSECError{Domain: header.Name, Reason: "UNSIGNED"}
+	}
+	return DNSSECError{Domain: header.Name, Reason: "INVALID_SIGNATURE"}
+}
+
+// zoneKeys returns the DNSKEYs of the zone once they are signed by a key
+// that matches a DS record of the parent zone, or a trust anchor for the
+// root zone.
+func (v *validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	res, err := v.exchange(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*dns.DNSKEY{}
+	keySet := []dns.RR{}
+	for _, rr := range res.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			keys = append(keys, key)
+			keySet = append(keySet, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, DNSSECError{Domain: zone, Reason: "NO_TRUST_CHAIN"}
+	}
+	delegations := v.anchors
+	if zone != "." {
+		if delegations, err = v.delegations(ctx, zone); err != nil {
+			return nil, err
+		}
+	}
+	for _, rr := range res.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != dns.TypeDNSKEY || !strings.EqualFold(sig.SignerName, zone) {
+			continue
+		}
+		for _, key := range keys {
+			if !matchesDelegation(key, delegations) {
+				continue
+			}
+			if sig.Verify(key, keySet) == nil && sig.ValidityPeriod(v.now()) {
+				v.keys[zone] = keys
+				return keys, nil
+			}
+		}
+	}
+	return nil, DNSSECError{Domain: zone, Reason: "NO_TRUST_CHAIN"}
+}
+
+// delegations returns the validated DS records of the zone.
+func (v *validator) delegations(ctx context.Context, zone string) ([]*dns.DS, error) {
+	res, err := v.exchange(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	list := []*dns.DS{}
+	dsSet := []dns.RR{}
+	for _, rr := range res.Answer {
+		if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+			list = append(list, ds)
+			dsSet = append(dsSet, ds)
+		}
+	}
+	// Without DS records the zone is not signed, even if it has keys.
+	if len(list) == 0 {
+		return nil, DNSSECError{Domain: zone, Reason: "NO_TRUST_CHAIN"}
+	}
+	if err := v.validateRRset(ctx, dsSet, res.Answer); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func matchesDelegation(key *dns.DNSKEY, delegations []*dns.DS) bool {
+	for _, ds := range delegations {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		digest := key.ToDS(ds.DigestType)
+		if digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
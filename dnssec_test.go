@@ -0,0 +1,152 @@
+package dnslink
+
+import (
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// testZone is a zone with a single key that signs all of its records.
+type testZone struct {
+	name    string
+	key     *dns.DNSKEY
+	private crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: key, private: private.(crypto.Signer)}
+}
+
+// sign returns the records with their signature.
+func (zone *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	header := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: header.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: header.Ttl},
+		TypeCovered: header.Rrtype,
+		Algorithm:   zone.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(header.Name)),
+		OrigTtl:     header.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      zone.key.KeyTag(),
+		SignerName:  zone.name,
+	}
+	if err := sig.Sign(zone.private, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dns.RR{}, rrset...), sig)
+}
+
+func (zone *testZone) ds() *dns.DS {
+	return zone.key.ToDS(dns.SHA256)
+}
+
+// signedZones returns the answers of a signed chain from the root over com.
+// to example.com. with a signed TXT record at _dnslink.example.com. and the
+// trust anchor of the root.
+func signedZones(t *testing.T) (map[string][]dns.RR, []*dns.DS) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+	answers := map[string][]dns.RR{}
+	for _, zone := range []*testZone{root, com, example} {
+		answers[zone.name+"/DNSKEY"] = zone.sign(t, zone.key)
+	}
+	answers["com./DS"] = root.sign(t, com.ds())
+	answers["example.com./DS"] = com.sign(t, example.ds())
+	answers["_dnslink.example.com./TXT"] = example.sign(t, txtRecord("_dnslink.example.com.", 100, "dnslink=/ipfs/a"))
+	answers["_dnslink.unsigned.example.com./TXT"] = []dns.RR{txtRecord("_dnslink.unsigned.example.com.", 100, "dnslink=/ipfs/b")}
+	tampered := example.sign(t, txtRecord("_dnslink.tampered.example.com.", 100, "dnslink=/ipfs/c"))
+	tampered[0].(*dns.TXT).Txt = []string{"dnslink=/ipfs/evil"}
+	answers["_dnslink.tampered.example.com./TXT"] = tampered
+	return answers, []*dns.DS{root.ds()}
+}
+
+func startSignedDNSServer(t *testing.T, answers map[string][]dns.RR) string {
+	return startDNSServerWithTCP(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		question := req.Question[0]
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = answers[strings.ToLower(question.Name)+"/"+dns.TypeToString[question.Qtype]]
+		if res.Answer == nil {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+}
+
+func TestUDPLookupValidate(t *testing.T) {
+	answers, anchors := signedZones(t)
+	server := startSignedDNSServer(t, answers)
+	r := &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Validate: true, TrustAnchors: anchors})}
+
+	result, err := r.Resolve("example.com")
+	assert.NoError(t, err)
+	assert.True(t, result.Authenticated)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 100, Source: SourcePrefixed}},
+	})
+
+	_, err = r.Resolve("unsigned.example.com")
+	assert.Equal(t, DNSSECError{Domain: "_dnslink.unsigned.example.com.", Reason: "UNSIGNED"}, err)
+
+	_, err = r.Resolve("tampered.example.com")
+	assert.Equal(t, DNSSECError{Domain: "_dnslink.tampered.example.com.", Reason: "INVALID_SIGNATURE"}, err)
+	assert.EqualError(t, err, "DNSSEC_FAILED (reason=INVALID_SIGNATURE, domain=_dnslink.tampered.example.com.)")
+
+	// The root keys don't match a different anchor.
+	other := newTestZone(t, ".")
+	r = &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Validate: true, TrustAnchors: []*dns.DS{other.ds()}})}
+	_, err = r.Resolve("example.com")
+	assert.Equal(t, DNSSECError{Domain: ".", Reason: "NO_TRUST_CHAIN"}, err)
+
+	// A zone without DS record isn't trusted.
+	withoutDS := map[string][]dns.RR{}
+	for key, answer := range answers {
+		if key != "example.com./DS" {
+			withoutDS[key] = answer
+		}
+	}
+	server = startSignedDNSServer(t, withoutDS)
+	r = &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{Validate: true, TrustAnchors: anchors})}
+	_, err = r.Resolve("example.com")
+	assert.Equal(t, DNSSECError{Domain: "example.com.", Reason: "NO_TRUST_CHAIN"}, err)
+}
+
+func TestUDPLookupRequireAuthenticated(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.AuthenticatedData = !strings.Contains(req.Question[0].Name, "insecure")
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupWithOptions([]string{server}, UDPLookupOptions{RequireAuthenticated: true})}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.True(t, result.Authenticated)
+
+	_, err = r.Resolve("insecure.com")
+	assert.Equal(t, DNSSECError{Domain: "_dnslink.insecure.com.", Reason: "NOT_AUTHENTICATED"}, err)
+}
+
+func TestRootTrustAnchors(t *testing.T) {
+	anchors := RootTrustAnchors()
+	assert.Len(t, anchors, 2)
+	assert.Equal(t, uint16(20326), anchors[0].KeyTag)
+	assert.Equal(t, ".", anchors[0].Hdr.Name)
+}
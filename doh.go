@@ -0,0 +1,112 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// dohMaxSize is the largest possible DNS message.
+const dohMaxSize = 65535
+
+// DoHRedirectError is returned by DoH lookups if the endpoint answered with a
+// redirect, which isn't followed unless the http.Client allows it.
+type DoHRedirectError struct {
+	Endpoint string `json:"endpoint"`
+	Status   int    `json:"status"`
+	Location string `json:"location"`
+}
+
+func (e DoHRedirectError) Error() string {
+	return fmt.Sprintf("DOH_REDIRECT (status=%d, endpoint=%s, location=%s)", e.Status, e.Endpoint, e.Location)
+}
+
+// NewDoHLookup returns a lookup that queries TXT records with DNS-over-HTTPS
+// (RFC 8484) POST requests against an endpoint like
+// https://cloudflare-dns.com/dns-query.
+//
+// A nil client uses a client with a 10 second timeout. Redirects are not
+// followed, as they could send the query to an unexpected host, and fail
+// with a DoHRedirectError instead, unless the client has a CheckRedirect
+// function.
+func NewDoHLookup(endpoint string, client *http.Client) LookupTXTFunc {
+	lookupTXT := NewDoHLookupContext(endpoint, client)
+	return func(domain string) ([]LookupEntry, error) {
+		return lookupTXT(context.Background(), domain)
+	}
+}
+
+// NewDoHLookupContext works like NewDoHLookup, but the returned lookup aborts
+// the query once the context is done and adds log statements about the DNS
+// answer to the result, like NewUDPLookupContext.
+func NewDoHLookupContext(endpoint string, client *http.Client) LookupTXTContextFunc {
+	var configured http.Client
+	if client == nil {
+		configured.Timeout = 10 * time.Second
+	} else {
+		configured = *client
+	}
+	if configured.CheckRedirect == nil {
+		configured.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	var lookup LookupTXTContextFunc
+	lookup = func(ctx context.Context, domain string) ([]LookupEntry, error) {
+		if !strings.HasSuffix(domain, ".") {
+			domain += "."
+		}
+		req := new(dns.Msg)
+		// RFC 8484 recommends the id 0 to make the responses cacheable.
+		req.Id = 0
+		req.RecursionDesired = true
+		req.Question = []dns.Question{{Name: domain, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}}
+		query, err := req.Pack()
+		if err != nil {
+			return nil, err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", dohContentType)
+		httpReq.Header.Set("Accept", dohContentType)
+		httpRes, err := configured.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		defer httpRes.Body.Close()
+		if httpRes.StatusCode >= 300 && httpRes.StatusCode < 400 {
+			return nil, DoHRedirectError{Endpoint: endpoint, Status: httpRes.StatusCode, Location: httpRes.Header.Get("Location")}
+		}
+		if httpRes.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d from %s", httpRes.StatusCode, endpoint)
+		}
+		raw, err := ioutil.ReadAll(io.LimitReader(httpRes.Body, dohMaxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > dohMaxSize {
+			return nil, fmt.Errorf("response from %s is larger than a DNS message", endpoint)
+		}
+		res := new(dns.Msg)
+		if err := res.Unpack(raw); err != nil {
+			return nil, err
+		}
+		LogLookupServer(ctx, endpoint)
+		if res.Rcode != 0 {
+			return nil, NewDNSRCodeError(res.Rcode, domain)
+		}
+		return followCNAME(ctx, lookup, domain, res)
+	}
+	return lookup
+}
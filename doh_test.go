@@ -0,0 +1,104 @@
+package dnslink
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// startDoHServer runs a local DoH endpoint answering with the given handler.
+func startDoHServer(t *testing.T, handler func(req *dns.Msg) *dns.Msg) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packed, err := handler(req).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDoHLookup(t *testing.T) {
+	server := startDoHServer(t, func(req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg)
+		name := req.Question[0].Name
+		if name != "_dnslink.foo.com." && name != "bar.com." {
+			res.SetRcode(req, dns.RcodeNameError)
+			return res
+		}
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(name, 120, "dnslink=/ipfs/"+name)}
+		return res
+	})
+	r := &Resolver{LookupTXT: NewDoHLookup(server.URL, nil)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "_dnslink.foo.com.", Ttl: 120, Source: SourcePrefixed}},
+	})
+	result, err = r.Resolve("bar.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "bar.com.", Ttl: 120, Source: SourceBare}},
+	})
+	_, err = r.Resolve("baz.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "baz.com."))
+
+	r = &Resolver{LookupTXTContext: NewDoHLookupContext(server.URL, nil), Provenance: true}
+	result, err = r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL, result.Provenance[0].Server)
+}
+
+func TestDoHLookupStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	_, err := NewDoHLookup(server.URL, nil)("foo.com")
+	assert.EqualError(t, err, "unexpected status 500 from "+server.URL)
+}
+
+func TestDoHLookupRedirect(t *testing.T) {
+	target := startDoHServer(t, func(req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		return res
+	})
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", target.URL)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	_, err := NewDoHLookup(redirect.URL, nil)("foo.com")
+	assert.Equal(t, DoHRedirectError{Endpoint: redirect.URL, Status: http.StatusTemporaryRedirect, Location: target.URL}, err)
+	_, err = NewDoHLookup(redirect.URL, http.DefaultClient)("foo.com")
+	assert.Error(t, err)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return nil }}
+	entries, err := NewDoHLookup(redirect.URL, client)("foo.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []LookupEntry{{Value: "dnslink=/ipfs/a", Ttl: 100, Chunks: []string{"dnslink=/ipfs/a"}}}, entries)
+}
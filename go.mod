@@ -3,11 +3,11 @@ module github.com/dnslink-std/go
 go 1.16
 
 require (
+	github.com/go-test/deep v1.0.7
 	github.com/miekg/dns v1.1.43
-	github.com/go-test/deep v1.0.7 // indirect
 	github.com/stretchr/objx v0.3.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -0,0 +1,78 @@
+package dnslink
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// indexNamespace marks entries that list further domains whose entries
+// belong to the result, e.g. dnslink=/dnslink-index/1.example.com. This
+// allows to spread many entries over several names.
+const indexNamespace = "dnslink-index"
+
+// maxIndexDepth limits how many index entries are followed in a row.
+const maxIndexDepth = 4
+
+func indexKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// followIndex resolves the domains of the index entries of the result and
+// merges their entries into it. Domains that were visited before are skipped
+// with an INDEX_CYCLE log statement, domains beyond maxIndexDepth with
+// INDEX_TOO_DEEP and domains that can not be resolved with INDEX_ERROR. The
+// returned log only contains those statements, the logs of the indexed
+// domains themselves are not part of the result.
+func followIndex(ctx context.Context, r *Resolver, result *Result, visited map[string]bool, depth int) []LogStatement {
+	log := []LogStatement{}
+	for _, entry := range result.Links[indexNamespace] {
+		domain := indexKey(entry.Identifier)
+		if visited[domain] {
+			log = append(log, LogStatement{Code: "INDEX_CYCLE", Entry: entry.Identifier})
+			continue
+		}
+		if depth > maxIndexDepth {
+			log = append(log, LogStatement{Code: "INDEX_TOO_DEEP", Entry: entry.Identifier})
+			continue
+		}
+		visited[domain] = true
+		child, err := resolveDomain(ctx, r, domain)
+		if err != nil {
+			log = append(log, LogStatement{Code: "INDEX_ERROR", Entry: entry.Identifier, Reason: err.Error()})
+			continue
+		}
+		log = append(log, followIndex(ctx, r, &child, visited, depth+1)...)
+		mergeLinks(result, child, indexNamespace, r.FastParse)
+	}
+	return log
+}
+
+// mergeLinks adds the links of a followed domain, except its entries of the
+// skipped namespace, to the result. With keepOrder the entries are appended
+// in their order instead of being sorted.
+func mergeLinks(result *Result, child Result, skip string, keepOrder bool) {
+	for _, ns := range child.OrderedNamespaces() {
+		if ns == skip {
+			continue
+		}
+		list, hasList := result.Links[ns]
+		if !hasList {
+			result.namespaces = append(result.namespaces, ns)
+		}
+		list = append(list, child.Links[ns]...)
+		if !keepOrder {
+			sort.Sort(ByValue{list})
+		}
+		result.Links[ns] = list
+	}
+	if !keepOrder {
+		result.TxtEntries = txtEntriesOf(result.Links)
+		return
+	}
+	for _, entry := range child.TxtEntries {
+		if !strings.HasPrefix(entry.Value, "/"+skip+"/") {
+			result.TxtEntries = append(result.TxtEntries, entry)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package dnslink
+
+import (
+	"fmt"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestFollowIndex(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.example.com":   {"dnslink=/ipfs/root", "dnslink=/dnslink-index/1.example.com", "dnslink=/dnslink-index/2.example.com."},
+		"_dnslink.1.example.com": {"dnslink=/ipfs/a", "dnslink=/ipns/c"},
+		"2.example.com":          {"dnslink=/ipfs/b", "dnslink=/dnslink-index/Example.com", "dnslink=/dnslink-index/3.example.com"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT, FollowIndex: true}
+	result, err := r.Resolve("example.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"dnslink-index": {
+			{Identifier: "1.example.com", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "2.example.com.", Ttl: 100, Source: SourcePrefixed},
+		},
+		"ipfs": {
+			{Identifier: "a", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "b", Ttl: 100, Source: SourceBare},
+			{Identifier: "root", Ttl: 100, Source: SourcePrefixed},
+		},
+		"ipns": {{Identifier: "c", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.TxtEntries, []TxtEntry{
+		{Value: "/dnslink-index/1.example.com", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/dnslink-index/2.example.com.", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/a", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipfs/b", Ttl: 100, Source: SourceBare},
+		{Value: "/ipfs/root", Ttl: 100, Source: SourcePrefixed},
+		{Value: "/ipns/c", Ttl: 100, Source: SourcePrefixed},
+	})
+	assert.Equal(t, []string{"ipfs", "dnslink-index", "ipns"}, result.OrderedNamespaces())
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "INDEX_ERROR", Entry: "3.example.com", Reason: NewDNSRCodeError(3, "No TXT entry for 3.example.com").Error()},
+		{Code: "INDEX_CYCLE", Entry: "Example.com"},
+	})
+
+	r.FollowIndex = false
+	result, err = r.Resolve("example.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{{Identifier: "root", Ttl: 100, Source: SourcePrefixed}})
+	assertDeepEqual(t, result.Log, []LogStatement{})
+}
+
+func TestFollowIndexDepth(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{}}
+	for depth := 0; depth <= maxIndexDepth+1; depth++ {
+		mock.entries[fmt.Sprintf("_dnslink.%d.com", depth)] = []string{
+			fmt.Sprintf("dnslink=/ipfs/%d", depth),
+			fmt.Sprintf("dnslink=/dnslink-index/%d.com", depth+1),
+		}
+	}
+	result, err := (&Resolver{LookupTXT: mock.lookupTXT, FollowIndex: true}).Resolve("0.com")
+	assert.NoError(t, err)
+	assert.Len(t, result.Links["ipfs"], maxIndexDepth+1)
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "INDEX_TOO_DEEP", Entry: fmt.Sprintf("%d.com", maxIndexDepth+1)},
+	})
+}
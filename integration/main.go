@@ -20,7 +20,9 @@ func main() {
 	options := Options{}
 	json.Unmarshal([]byte(os.Args[2]), &options)
 	r := &dnslink.Resolver{
-		LookupTXT: dnslink.NewUDPLookup([]string{"127.0.0.1:" + fmt.Sprint(options.Udp)}, 0),
+		LookupTXTContext: dnslink.NewUDPLookupContext([]string{"127.0.0.1:" + fmt.Sprint(options.Udp)}, 0),
+		// The test suite of the specification expects duplicate entries.
+		KeepDuplicateEntries: true,
 	}
 
 	resolved, error := r.Resolve(domain)
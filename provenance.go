@@ -0,0 +1,49 @@
+package dnslink
+
+import "strings"
+
+// EntryProvenance describes where a valid entry of a result came from, to
+// answer support cases without a packet capture.
+type EntryProvenance struct {
+	Namespace  string `json:"namespace"`
+	Identifier string `json:"identifier"`
+	// Query is the name that was looked up, with or without the _dnslink.
+	// prefix.
+	Query  string      `json:"query"`
+	Source EntrySource `json:"source"`
+	// Server is the name server that answered, if the lookup reported it
+	// with LogLookupServer.
+	Server string `json:"server,omitempty"`
+	// Ttl is the ttl of the TXT record as received.
+	Ttl uint32 `json:"ttl"`
+	// RecordIndex is the position of the TXT record in the answer.
+	RecordIndex int `json:"recordIndex"`
+}
+
+// provenance returns the provenance of the entries of the TXT answer that
+// are valid after the preparation by the resolver options.
+func (r *Resolver) provenance(input []LookupEntry, query string, source EntrySource, server string) []EntryProvenance {
+	provenance := []EntryProvenance{}
+	for index, entry := range input {
+		// All preparation steps work per entry, which keeps the index of
+		// the record.
+		prepared, _ := r.prepareEntries([]LookupEntry{entry})
+		if len(prepared) == 0 || !strings.HasPrefix(prepared[0].Value, txtPrefix) {
+			continue
+		}
+		namespace, identifier, reason := validateDNSLinkEntry(prepared[0].Value)
+		if reason != "" {
+			continue
+		}
+		provenance = append(provenance, EntryProvenance{
+			Namespace:   namespace,
+			Identifier:  identifier,
+			Query:       query,
+			Source:      source,
+			Server:      server,
+			Ttl:         entry.Ttl,
+			RecordIndex: index,
+		})
+	}
+	return provenance
+}
@@ -0,0 +1,67 @@
+package dnslink
+
+import (
+	"context"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestProvenance(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"v=spf1 -all", "dnslink=/ipfs/b", "dnslink=", "dnslink=/ipns/a"},
+		"bare.com":       {"dnslink=/ipfs/c"},
+	}}
+	r := &Resolver{
+		LookupTXTContext: func(ctx context.Context, domain string) ([]LookupEntry, error) {
+			LogLookupServer(ctx, "192.0.2.1:53")
+			return mock.lookupTXT(domain)
+		},
+		Provenance: true,
+	}
+	result, err := r.Resolve("a.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Provenance, []EntryProvenance{
+		{Namespace: "ipfs", Identifier: "b", Query: "_dnslink.a.com", Source: SourcePrefixed, Server: "192.0.2.1:53", Ttl: 100, RecordIndex: 1},
+		{Namespace: "ipns", Identifier: "a", Query: "_dnslink.a.com", Source: SourcePrefixed, Server: "192.0.2.1:53", Ttl: 100, RecordIndex: 3},
+	})
+
+	result, err = r.Resolve("bare.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Provenance, []EntryProvenance{
+		{Namespace: "ipfs", Identifier: "c", Query: "bare.com", Source: SourceBare, Server: "192.0.2.1:53", Ttl: 100, RecordIndex: 0},
+	})
+
+	// Entries dropped by the resolver options have no provenance.
+	r.MaxIdentifierLength = 1
+	r.LookupTXTContext = nil
+	r.LookupTXT = mock.lookupTXT
+	r.CaseInsensitiveNamespaces = true
+	mock.entries["_dnslink.a.com"] = []string{"dnslink=/ipfs/long", "dnslink=/IPNS/a"}
+	result, err = r.Resolve("a.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Provenance, []EntryProvenance{
+		{Namespace: "ipns", Identifier: "a", Query: "_dnslink.a.com", Source: SourcePrefixed, Ttl: 100, RecordIndex: 1},
+	})
+
+	r.Provenance = false
+	result, err = r.Resolve("a.com")
+	assert.NoError(t, err)
+	assert.Nil(t, result.Provenance)
+}
+
+func TestUDPProvenanceServer(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 60, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXTContext: NewUDPLookupContext([]string{server}, 0), Provenance: true}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Provenance, []EntryProvenance{
+		{Namespace: "ipfs", Identifier: "a", Query: "_dnslink.foo.com", Source: SourcePrefixed, Server: server, Ttl: 60, RecordIndex: 0},
+	})
+}
@@ -0,0 +1,54 @@
+package dnslink
+
+import (
+	"context"
+	"time"
+)
+
+// QueryEvent describes a single lookup of TXT records by a Resolver, see
+// Resolver.OnQuery.
+type QueryEvent struct {
+	// Domain is the name that was looked up, with or without the _dnslink.
+	// prefix.
+	Domain string
+	// Source tells whether the prefixed domain or the bare domain was
+	// looked up, the latter usually after a fallback.
+	Source EntrySource
+	// Server is the name server that answered, if the lookup reported it
+	// with LogLookupServer, like the udp, tcp and tls lookups do.
+	Server   string
+	Duration time.Duration
+	// Entries is the number of TXT records that were received.
+	Entries int
+	// RCode is the response code of a lookup that returned a DNSRCodeError,
+	// like dns.RcodeNameError (3), and 0 otherwise.
+	RCode int
+	Err   error
+}
+
+// queryTXT looks up the TXT records of the name and reports the lookup to
+// Resolver.OnQuery.
+func (r *Resolver) queryTXT(ctx context.Context, lookupTXT LookupTXTContextFunc, name string, source EntrySource) ([]LookupEntry, error) {
+	// The server of a previous lookup doesn't belong to this one.
+	LogLookupServer(ctx, "")
+	if r.OnQuery == nil {
+		return lookupTXT(ctx, name)
+	}
+	start := time.Now()
+	entries, err := lookupTXT(ctx, name)
+	event := QueryEvent{
+		Domain:   name,
+		Source:   source,
+		Duration: time.Since(start),
+		Entries:  len(entries),
+		Err:      err,
+	}
+	if log, ok := ctx.Value(lookupLogKey{}).(*lookupLog); ok {
+		event.Server = log.lastServer()
+	}
+	if rcodeErr, ok := AsDNSRCodeError(err); ok {
+		event.RCode = int(rcodeErr.DNSRCode)
+	}
+	r.OnQuery(event)
+	return entries, err
+}
@@ -0,0 +1,69 @@
+package dnslink
+
+import (
+	"sync"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestOnQuery(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if req.Question[0].Name == "foo.com." {
+			res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 100, "dnslink=/ipfs/a")}
+		} else {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+	var mutex sync.Mutex
+	events := []QueryEvent{}
+	r := &Resolver{
+		LookupTXTContext: NewUDPLookupContext([]string{server}, 0),
+		OnQuery: func(event QueryEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+		},
+	}
+	_, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	if !assert.Len(t, events, 2) {
+		return
+	}
+	assert.Equal(t, "_dnslink.foo.com", events[0].Domain)
+	assert.Equal(t, SourcePrefixed, events[0].Source)
+	assert.Equal(t, server, events[0].Server)
+	assert.Equal(t, dns.RcodeNameError, events[0].RCode)
+	assert.True(t, IsNXDomain(events[0].Err))
+	assert.Equal(t, "foo.com", events[1].Domain)
+	assert.Equal(t, SourceBare, events[1].Source)
+	assert.Equal(t, 0, events[1].RCode)
+	assert.Equal(t, 1, events[1].Entries)
+	assert.NoError(t, events[1].Err)
+	for _, event := range events {
+		assert.Greater(t, int64(event.Duration), int64(0))
+	}
+
+	// Lookups that don't report a server don't carry the one of an earlier
+	// lookup.
+	events = []QueryEvent{}
+	answered := false
+	r.LookupTXTContext = nil
+	r.LookupTXT = func(domain string) ([]LookupEntry, error) {
+		if !answered {
+			answered = true
+			return nil, NewDNSRCodeError(dns.RcodeServerFailure, domain)
+		}
+		return []LookupEntry{}, nil
+	}
+	_, err = r.Resolve("bar.com")
+	assert.Error(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "", events[0].Server)
+		assert.Equal(t, dns.RcodeServerFailure, events[0].RCode)
+	}
+}
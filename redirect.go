@@ -0,0 +1,82 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// redirectNamespace marks entries that redirect to the entries of another
+// domain, e.g. dnslink=/dnslink/other.example.com.
+const redirectNamespace = "dnslink"
+
+// defaultMaxDepth is used if Resolver.MaxDepth isn't set.
+const defaultMaxDepth = 32
+
+// RecursiveLoopError is returned with Resolver.FollowRedirects if a /dnslink/
+// redirect leads back to a domain that was already resolved (Reason CYCLE)
+// or if more than Resolver.MaxDepth redirects were followed in a row (Reason
+// TOO_DEEP).
+type RecursiveLoopError struct {
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+}
+
+func (e RecursiveLoopError) Error() string {
+	return fmt.Sprintf("RECURSIVE_LOOP (reason=%s, domain=%s)", e.Reason, e.Domain)
+}
+
+// redirectTarget returns the domain of a /dnslink/ identifier, which may be
+// followed by a path.
+func redirectTarget(identifier string) string {
+	if index := strings.Index(identifier, "/"); index != -1 {
+		identifier = identifier[:index]
+	}
+	return indexKey(identifier)
+}
+
+// followRedirects resolves the domains of the /dnslink/ entries of the result
+// and merges their links, except their own /dnslink/ entries, into it.
+// visited holds the domains that were resolved, true for those on the current
+// chain of redirects.
+// Redirects of the resolved domains are followed as well. A redirect to a
+// domain that can not be resolved is skipped with a REDIRECT_FAILED log
+// statement, keeping the links found so far. Cycles and redirects beyond the
+// maximum depth are logged with RECURSIVE_LOOP and end the resolution with a
+// RecursiveLoopError.
+func followRedirects(ctx context.Context, r *Resolver, result *Result, visited map[string]bool, depth int) ([]LogStatement, error) {
+	maxDepth := r.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	log := []LogStatement{}
+	for _, entry := range result.Links[redirectNamespace] {
+		domain := redirectTarget(entry.Identifier)
+		if onPath, ok := visited[domain]; ok {
+			if !onPath {
+				// The links of the domain were merged through another redirect.
+				continue
+			}
+			log = append(log, LogStatement{Code: "RECURSIVE_LOOP", Entry: entry.Identifier, Reason: "CYCLE"})
+			return log, RecursiveLoopError{Domain: domain, Reason: "CYCLE"}
+		}
+		if depth > maxDepth {
+			log = append(log, LogStatement{Code: "RECURSIVE_LOOP", Entry: entry.Identifier, Reason: "TOO_DEEP"})
+			return log, RecursiveLoopError{Domain: domain, Reason: "TOO_DEEP"}
+		}
+		child, err := resolveDomain(ctx, r, domain)
+		if err != nil {
+			log = append(log, LogStatement{Code: "REDIRECT_FAILED", Entry: entry.Identifier, Reason: err.Error()})
+			continue
+		}
+		visited[domain] = true
+		childLog, err := followRedirects(ctx, r, &child, visited, depth+1)
+		visited[domain] = false
+		log = append(log, childLog...)
+		if err != nil {
+			return log, err
+		}
+		mergeLinks(result, child, redirectNamespace, r.FastParse)
+	}
+	return log, nil
+}
@@ -0,0 +1,91 @@
+package dnslink
+
+import (
+	"fmt"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"dnslink=/ipfs/root", "dnslink=/dnslink/b.com/path", "dnslink=/dnslink/c.com"},
+		"_dnslink.b.com": {"dnslink=/ipfs/b", "dnslink=/dnslink/d.com"},
+		"_dnslink.c.com": {"dnslink=/ipns/c", "dnslink=/dnslink/D.com."},
+		"d.com":          {"dnslink=/ipfs/d"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT, FollowRedirects: true}
+	result, err := r.Resolve("a.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"dnslink": {
+			{Identifier: "b.com/path", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "c.com", Ttl: 100, Source: SourcePrefixed},
+		},
+		// d.com is reached through b.com and c.com, but merged once.
+		"ipfs": {
+			{Identifier: "b", Ttl: 100, Source: SourcePrefixed},
+			{Identifier: "d", Ttl: 100, Source: SourceBare},
+			{Identifier: "root", Ttl: 100, Source: SourcePrefixed},
+		},
+		"ipns": {{Identifier: "c", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{})
+
+	r.FollowRedirects = false
+	result, err = r.Resolve("a.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{{Identifier: "root", Ttl: 100, Source: SourcePrefixed}})
+}
+
+func TestFollowRedirectsFailed(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"dnslink=/ipfs/root", "dnslink=/dnslink/broken.com", "dnslink=/dnslink/b.com"},
+		"_dnslink.b.com": {"dnslink=/ipfs/b", "dnslink=/dnslink/hello..com"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT, FollowRedirects: true}
+	result, err := r.Resolve("a.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links["ipfs"], NamespaceEntries{
+		{Identifier: "b", Ttl: 100, Source: SourcePrefixed},
+		{Identifier: "root", Ttl: 100, Source: SourcePrefixed},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "REDIRECT_FAILED", Entry: "hello..com", Reason: "EMPTY_PART"},
+		{Code: "REDIRECT_FAILED", Entry: "broken.com", Reason: NewDNSRCodeError(3, "No TXT entry for broken.com").Error()},
+	})
+}
+
+func TestFollowRedirectsLoop(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"dnslink=/ipfs/a", "dnslink=/dnslink/b.com"},
+		"_dnslink.b.com": {"dnslink=/ipfs/b", "dnslink=/dnslink/A.com"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT, FollowRedirects: true}
+	result, err := r.Resolve("a.com")
+	assert.Equal(t, RecursiveLoopError{Domain: "a.com", Reason: "CYCLE"}, err)
+	assert.EqualError(t, err, "RECURSIVE_LOOP (reason=CYCLE, domain=a.com)")
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "RECURSIVE_LOOP", Entry: "A.com", Reason: "CYCLE"},
+	})
+}
+
+func TestFollowRedirectsDepth(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{}}
+	for depth := 0; depth <= defaultMaxDepth+1; depth++ {
+		mock.entries[fmt.Sprintf("_dnslink.%d.com", depth)] = []string{
+			fmt.Sprintf("dnslink=/ipfs/%d", depth),
+			fmt.Sprintf("dnslink=/dnslink/%d.com", depth+1),
+		}
+	}
+	r := &Resolver{LookupTXT: mock.lookupTXT, FollowRedirects: true, MaxDepth: 3}
+	result, err := r.Resolve("0.com")
+	assert.Equal(t, RecursiveLoopError{Domain: "4.com", Reason: "TOO_DEEP"}, err)
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "RECURSIVE_LOOP", Entry: "4.com", Reason: "TOO_DEEP"},
+	})
+
+	r.MaxDepth = 0
+	_, err = r.Resolve("0.com")
+	assert.Equal(t, RecursiveLoopError{Domain: fmt.Sprintf("%d.com", defaultMaxDepth+1), Reason: "TOO_DEEP"}, err)
+}
@@ -0,0 +1,33 @@
+package dnslink
+
+import (
+	"net"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+// NewResolvConfLookup returns a lookup that queries the name servers of the
+// resolv.conf file at the path, usually /etc/resolv.conf, directly instead
+// of through the system resolver, so that the entries have the ttl of the
+// answer. The servers are tried in random order, each with the timeout of
+// the file. If the file can't be read or has no name servers, like on
+// Windows, the lookup falls back to the system resolver without ttls.
+func NewResolvConfLookup(path string) LookupTXTContextFunc {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil || len(config.Servers) == 0 {
+		return defaultLookupTXT
+	}
+	return newClientConfigLookup(config)
+}
+
+func newClientConfigLookup(config *dns.ClientConfig) LookupTXTContextFunc {
+	servers := make([]string, len(config.Servers))
+	for index, server := range config.Servers {
+		servers[index] = net.JoinHostPort(server, config.Port)
+	}
+	return NewUDPLookupWithOptions(servers, UDPLookupOptions{
+		Timeout:     time.Duration(config.Timeout) * time.Second,
+		MaxAttempts: len(servers),
+	})
+}
@@ -0,0 +1,54 @@
+package dnslink
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestResolvConfLookup(t *testing.T) {
+	server := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 1234, "dnslink=/ipfs/a")}
+		w.WriteMsg(res)
+	})
+	host, port, err := net.SplitHostPort(server)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# local\nnameserver "+host+"\noptions timeout:3\n"), 0644))
+
+	config, err := dns.ClientConfigFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{host}, config.Servers)
+	assert.Equal(t, 3, config.Timeout)
+	// resolv.conf has no ports, the test server doesn't run on 53.
+	config.Port = port
+	r := &Resolver{LookupTXTContext: newClientConfigLookup(config)}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 1234, Source: SourcePrefixed}},
+	})
+}
+
+func TestResolvConfLookupFallback(t *testing.T) {
+	isSystemLookup := func(lookup LookupTXTContextFunc) bool {
+		return reflect.ValueOf(lookup).Pointer() == reflect.ValueOf(defaultLookupTXT).Pointer()
+	}
+	dir := t.TempDir()
+	assert.True(t, isSystemLookup(NewResolvConfLookup(filepath.Join(dir, "missing.conf"))))
+
+	empty := filepath.Join(dir, "empty.conf")
+	assert.NoError(t, ioutil.WriteFile(empty, []byte("search example.com\n"), 0644))
+	assert.True(t, isSystemLookup(NewResolvConfLookup(empty)))
+
+	configured := filepath.Join(dir, "resolv.conf")
+	assert.NoError(t, ioutil.WriteFile(configured, []byte("nameserver 127.0.0.1\n"), 0644))
+	assert.False(t, isSystemLookup(NewResolvConfLookup(configured)))
+}
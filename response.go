@@ -0,0 +1,47 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	dns "github.com/miekg/dns"
+)
+
+// ResolveResponse resolves the dnslink of the domain in the question of a
+// DNS response in wire format, like a saved capture, instead of querying
+// a name server. The answer is processed like the answer of NewUDPLookup. A
+// response for the bare domain is treated like a fallback, as if the
+// _dnslink. prefixed domain didn't exist. Next to the result, the domain of
+// the question is returned.
+func (r *Resolver) ResolveResponse(response io.Reader) (Result, string, error) {
+	raw, err := ioutil.ReadAll(response)
+	if err != nil {
+		return Result{}, "", err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return Result{}, "", err
+	}
+	if len(msg.Question) != 1 {
+		return Result{}, "", errors.New("the response needs to have exactly one question")
+	}
+	question := strings.ToLower(msg.Question[0].Name)
+	domain := strings.TrimPrefix(strings.TrimSuffix(question, "."), dnsPrefix)
+	resolver := *r
+	resolver.LookupTXT = nil
+	resolver.LookupTXTContext = func(ctx context.Context, name string) ([]LookupEntry, error) {
+		name = dns.Fqdn(name)
+		if strings.ToLower(name) != question {
+			return nil, NewDNSRCodeError(dns.RcodeNameError, name)
+		}
+		if msg.Rcode != dns.RcodeSuccess {
+			return nil, NewDNSRCodeError(msg.Rcode, name)
+		}
+		return answerEntries(ctx, name, msg), nil
+	}
+	result, err := resolver.Resolve(domain)
+	return result, domain, err
+}
@@ -0,0 +1,57 @@
+package dnslink
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func packResponse(t *testing.T, name string, rcode int, answer ...dns.RR) *bytes.Reader {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeTXT)
+	res := new(dns.Msg)
+	res.SetRcode(req, rcode)
+	res.Answer = answer
+	raw, err := res.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(raw)
+}
+
+func TestResolveResponse(t *testing.T) {
+	r := &Resolver{}
+	result, domain, err := r.ResolveResponse(packResponse(t, "_dnslink.Foo.com.", dns.RcodeSuccess,
+		txtRecord("_dnslink.foo.com.", 100, "dnslink=/ipfs/", `\226\130\172`),
+		txtRecord("_dnslink.foo.com.", 100, "dnslink=/ipns/abc"),
+		txtRecord("_dnslink.evil.com.", 100, "dnslink=/ipfs/evil"),
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.com", domain)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipns": {{Identifier: "abc", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{
+		{Code: "OFF_DOMAIN_ANSWER", Entry: "_dnslink.evil.com.\t100\tIN\tTXT\t\"dnslink=/ipfs/evil\""},
+		{Code: "INVALID_ENTRY", Entry: "dnslink=/ipfs/€", Reason: "INVALID_CHARACTER"},
+	})
+
+	result, domain, err = r.ResolveResponse(packResponse(t, "bar.com.", dns.RcodeSuccess,
+		txtRecord("bar.com.", 60, "dnslink=/ipfs/bar"),
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, "bar.com", domain)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "bar", Ttl: 60, Source: SourceBare}},
+	})
+	assertDeepEqual(t, result.Log, []LogStatement{{Code: "FALLBACK"}})
+
+	_, _, err = r.ResolveResponse(packResponse(t, "_dnslink.baz.com.", dns.RcodeServerFailure))
+	assertDeepEqual(t, err, NewDNSRCodeError(2, "_dnslink.baz.com."))
+
+	_, _, err = r.ResolveResponse(strings.NewReader("not a dns message"))
+	assert.Error(t, err)
+}
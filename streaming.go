@@ -0,0 +1,18 @@
+package dnslink
+
+// ResolveStreaming resolves the domain like Resolve and calls onNamespace
+// once per namespace of the result, in the order the namespaces appeared in
+// the TXT answer, before the result is returned. The entries of a domain
+// arrive with a single TXT answer, so the callbacks are fired together once
+// that answer is parsed; they let a UI fill its sections without walking the
+// result itself. onNamespace is not called if the resolution fails.
+func (r *Resolver) ResolveStreaming(domain string, onNamespace func(ns string, entries []NamespaceEntry)) (Result, error) {
+	result, err := r.Resolve(domain)
+	if err != nil {
+		return result, err
+	}
+	for _, ns := range result.OrderedNamespaces() {
+		onNamespace(ns, result.Links[ns])
+	}
+	return result, nil
+}
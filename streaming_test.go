@@ -0,0 +1,35 @@
+package dnslink
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestResolveStreaming(t *testing.T) {
+	mock := &mockDNS{entries: map[string][]string{
+		"_dnslink.a.com": {"dnslink=/ipns/b", "dnslink=/ipfs/c", "dnslink=/ipns/a"},
+	}}
+	r := &Resolver{LookupTXT: mock.lookupTXT}
+
+	namespaces := []string{}
+	entries := map[string][]NamespaceEntry{}
+	result, err := r.ResolveStreaming("a.com", func(ns string, nsEntries []NamespaceEntry) {
+		namespaces = append(namespaces, ns)
+		entries[ns] = nsEntries
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ipns", "ipfs"}, namespaces)
+	assertDeepEqual(t, entries, map[string][]NamespaceEntry{
+		"ipfs": {{Identifier: "c", Ttl: 100, Source: SourcePrefixed}},
+		"ipns": {{Identifier: "a", Ttl: 100, Source: SourcePrefixed}, {Identifier: "b", Ttl: 100, Source: SourcePrefixed}},
+	})
+	assertDeepEqual(t, result.Links["ipns"], NamespaceEntries(entries["ipns"]))
+
+	called := false
+	_, err = r.ResolveStreaming("a..com", func(ns string, nsEntries []NamespaceEntry) {
+		called = true
+	})
+	assert.EqualError(t, err, "EMPTY_PART")
+	assert.False(t, called)
+}
@@ -0,0 +1,28 @@
+package dnslink
+
+import (
+	"context"
+
+	dns "github.com/miekg/dns"
+)
+
+// NewTCPLookup returns a lookup that queries TXT records over TCP, which has
+// no size limit for answers with many dnslink entries. Servers without a
+// port use port 53. NewUDPLookup repeats truncated answers over TCP on its
+// own, this lookup saves the UDP round trip for domains that are known to
+// need it.
+func NewTCPLookup(servers []string) LookupTXTFunc {
+	lookupTXT := NewTCPLookupContext(servers)
+	return func(domain string) ([]LookupEntry, error) {
+		return lookupTXT(context.Background(), domain)
+	}
+}
+
+// NewTCPLookupContext works like NewTCPLookup, but the returned lookup aborts
+// the query once the context is done and adds log statements about the DNS
+// answer to the result, like NewUDPLookupContext.
+func NewTCPLookupContext(servers []string) LookupTXTContextFunc {
+	client := new(dns.Client)
+	client.Net = "tcp"
+	return newClientLookup(client, withDefaultPorts(servers, "53"), UDPLookupOptions{})
+}
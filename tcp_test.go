@@ -0,0 +1,32 @@
+package dnslink
+
+import (
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestTCPLookup(t *testing.T) {
+	networks := make(chan string, 10)
+	server := startDNSServerWithTCP(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		networks <- w.RemoteAddr().Network()
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if req.Question[0].Name == "_dnslink.foo.com." {
+			res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 300, "dnslink=/ipfs/a")}
+		} else {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXT: NewTCPLookup([]string{server})}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 300, Source: SourcePrefixed}},
+	})
+	assert.Equal(t, "tcp", <-networks)
+	_, err = r.Resolve("bar.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "bar.com."))
+}
@@ -0,0 +1,51 @@
+package dnslink
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+
+	dns "github.com/miekg/dns"
+)
+
+// NewTLSLookup returns a lookup that queries TXT records with DNS-over-TLS
+// (RFC 7858). Servers without a port use port 853, e.g. "1.1.1.1" or
+// "dns.example:853". A nil tlsConfig verifies the servers against the system
+// cert pool; pass a config to pin certificates or use custom roots. Failed
+// verifications are returned as errors.
+func NewTLSLookup(servers []string, tlsConfig *tls.Config) LookupTXTFunc {
+	lookupTXT := NewTLSLookupContext(servers, tlsConfig)
+	return func(domain string) ([]LookupEntry, error) {
+		return lookupTXT(context.Background(), domain)
+	}
+}
+
+// NewTLSLookupContext works like NewTLSLookup, but the returned lookup aborts
+// the query once the context is done and adds log statements about the DNS
+// answer to the result, like NewUDPLookupContext.
+func NewTLSLookupContext(servers []string, tlsConfig *tls.Config) LookupTXTContextFunc {
+	client := new(dns.Client)
+	client.Net = "tcp-tls"
+	client.TLSConfig = tlsConfig
+	return newClientLookup(client, withDefaultPorts(servers, "853"), UDPLookupOptions{})
+}
+
+// withDefaultPorts adds the port to the servers that have none.
+func withDefaultPorts(servers []string, port string) []string {
+	withPorts := make([]string, len(servers))
+	for index, server := range servers {
+		withPorts[index] = WithDefaultPort(server, port)
+	}
+	return withPorts
+}
+
+// WithDefaultPort adds the port to the server if it has none, e.g. 1.1.1.1
+// becomes 1.1.1.1:53 and 2606:4700:4700::1111 [2606:4700:4700::1111]:53 for
+// the port 53. The lookups use it for the servers they are given.
+func WithDefaultPort(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
@@ -0,0 +1,70 @@
+package dnslink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// startTLSDNSServer runs a local DNS-over-TLS server with the test
+// certificate of httptest, which is valid for 127.0.0.1, and returns its
+// address and a pool that trusts the certificate.
+func startTLSDNSServer(t *testing.T, handler dns.HandlerFunc) (string, *x509.CertPool) {
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certificates := certServer.TLS.Certificates
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	certServer.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String(), roots
+}
+
+func TestTLSLookup(t *testing.T) {
+	server, roots := startTLSDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if req.Question[0].Name == "_dnslink.foo.com." {
+			res.Answer = []dns.RR{txtRecord(req.Question[0].Name, 300, "dnslink=/ipfs/a")}
+		} else {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+	r := &Resolver{LookupTXT: NewTLSLookup([]string{server}, &tls.Config{RootCAs: roots})}
+	result, err := r.Resolve("foo.com")
+	assert.NoError(t, err)
+	assertDeepEqual(t, result.Links, map[string]NamespaceEntries{
+		"ipfs": {{Identifier: "a", Ttl: 300, Source: SourcePrefixed}},
+	})
+	_, err = r.Resolve("bar.com")
+	assertDeepEqual(t, err, NewDNSRCodeError(3, "bar.com."))
+
+	// The system cert pool doesn't trust the test certificate.
+	_, err = NewTLSLookup([]string{server}, nil)("foo.com")
+	assert.Error(t, err)
+	var unknownAuthority x509.UnknownAuthorityError
+	assert.ErrorAs(t, err, &unknownAuthority)
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	assert.Equal(t, "1.1.1.1:853", WithDefaultPort("1.1.1.1", "853"))
+	assert.Equal(t, "1.1.1.1:8853", WithDefaultPort("1.1.1.1:8853", "853"))
+	assert.Equal(t, "dns.example:853", WithDefaultPort("dns.example", "853"))
+	assert.Equal(t, "[::1]:853", WithDefaultPort("::1", "853"))
+	assert.Equal(t, "[::1]:853", WithDefaultPort("[::1]", "853"))
+	assert.Equal(t, "[::1]:8853", WithDefaultPort("[::1]:8853", "853"))
+}